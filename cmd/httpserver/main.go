@@ -1,31 +1,202 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"io/fs"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/middleware"
+	"github.com/johndosdos/http-from-tcp/internal/proxy"
 	"github.com/johndosdos/http-from-tcp/internal/request"
 	"github.com/johndosdos/http-from-tcp/internal/response"
 	"github.com/johndosdos/http-from-tcp/internal/server"
+	"github.com/johndosdos/http-from-tcp/internal/websocket"
 )
 
+// Serves https://httpbin.org under /httpbin.
+var httpbin *proxy.ReverseProxy
+
+// listenFlag collects every -listen address.
+type listenFlag []string
+
+func (f *listenFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listenFlag) Set(address string) error {
+	*f = append(*f, address)
+	return nil
+}
+
 func main() {
-	const port = 42069
+	var addresses listenFlag
+	flag.Var(&addresses, "listen", "listen on this host:port or unix:/path/to/socket, may be repeated (default \":42069\")")
+	unixSocketMode := flag.String("unix-socket-mode", "", "octal permissions of -listen Unix domain sockets, such as 660")
+	certFile := flag.String("tls-cert", "", "serve over TLS with this PEM certificate chain")
+	keyFile := flag.String("tls-key", "", "private key of the -tls-cert certificate")
+	clientCAFile := flag.String("tls-client-ca", "", "verify client certificates against the PEM CAs in this file")
+	clientAuthMode := flag.String("tls-client-auth", "require", "whether -tls-client-ca client certificates are \"require\" or \"optional\"")
+	acceptors := flag.Int("acceptors", 1, "accept -listen TCP connections on this many SO_REUSEPORT sockets (Linux only)")
+	maxConns := flag.Int("max-conns", 0, "serve at most this many connections at once per -listen address, 0 for no limit")
+	maxConnsMode := flag.String("max-conns-mode", "block", "whether connections over -max-conns wait to be accepted, \"block\", or get a 503, \"reject\"")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "how long to wait for connections to finish when stopping")
+	flag.Parse()
+
+	if len(addresses) == 0 {
+		addresses = listenFlag{":42069"}
+	}
+
+	var unixMode fs.FileMode
+	if *unixSocketMode != "" {
+		mode, err := strconv.ParseUint(*unixSocketMode, 8, 32)
+		if err != nil || mode > 0o777 {
+			log.Fatalf("Error parsing -unix-socket-mode: %q is not an octal file mode", *unixSocketMode)
+		}
+		unixMode = fs.FileMode(mode)
+	}
+
+	connLimitMode, err := server.ParseConnLimitMode(*maxConnsMode)
+	if err != nil {
+		log.Fatalf("Error parsing -max-conns-mode: %v", err)
+	}
+
+	httpbin, err = proxy.NewReverseProxy("https://httpbin.org")
+	if err != nil {
+		log.Fatalf("Error creating proxy: %v", err)
+	}
+	httpbin.StripPrefix = "/httpbin"
+	httpbin.ChecksumTrailers = true
+	httpbin.Cache = proxy.NewCache(64 << 20)
+
+	handler := middleware.RequestID(middleware.Compress(handlerRequest))
+
+	var config *tls.Config
+	if *certFile != "" || *keyFile != "" {
+		certs, err := server.LoadCertificates(server.CertFiles{CertFile: *certFile, KeyFile: *keyFile})
+		if err != nil {
+			log.Fatalf("Error loading certificate: %v", err)
+		}
+		// Pick up renewed certificates on SIGHUP or when the files change.
+		stopWatching := certs.Watch(server.DefaultWatchInterval)
+		defer stopWatching()
+
+		config = certs.TLSConfig()
+		if *clientCAFile != "" {
+			clientCAs, err := server.LoadClientCAs(*clientCAFile)
+			if err != nil {
+				log.Fatalf("Error loading client CAs: %v", err)
+			}
+			mode, err := server.ParseClientAuth(*clientAuthMode)
+			if err != nil {
+				log.Fatalf("Error parsing -tls-client-auth: %v", err)
+			}
+			config = server.WithClientAuth(config, clientCAs, mode)
+		}
+	}
+
+	// Sockets passed down by systemd take the place of -listen. Those on the
+	// same address, opened with -acceptors, are served together again.
+	var groups [][]net.Listener
+	inherited, err := server.InheritedListeners()
+	if err != nil {
+		log.Fatalf("Error using inherited sockets: %v", err)
+	}
+	for _, listener := range inherited {
+		i := slices.IndexFunc(groups, func(group []net.Listener) bool {
+			return group[0].Addr().String() == listener.Addr().String()
+		})
+		if i < 0 {
+			groups = append(groups, nil)
+			i = len(groups) - 1
+		}
+		groups[i] = append(groups[i], listener)
+	}
+
+	if len(groups) == 0 {
+		for _, address := range addresses {
+			var group []net.Listener
+			if *acceptors > 1 && !strings.HasPrefix(address, "unix:") {
+				group, err = server.ListenReusePort(address, *acceptors)
+			} else {
+				var listener net.Listener
+				listener, err = server.Listen(address, unixMode)
+				group = []net.Listener{listener}
+			}
+			if err != nil {
+				log.Fatalf("Error starting server: %v", err)
+			}
+			groups = append(groups, group)
+		}
+	}
+
+	var listeners []net.Listener
+	var servers []*server.Server
+	for _, group := range groups {
+		listeners = append(listeners, group...)
+
+		if config != nil {
+			group = slices.Clone(group)
+			for i, listener := range group {
+				group[i] = tls.NewListener(listener, config)
+			}
+		}
 
-	server, err := server.Serve(port, handlerRequest)
+		srv := server.NewServer(group, handler)
+		srv.MaxConns = *maxConns
+		srv.ConnLimitMode = connLimitMode
+		go srv.Listen()
+		servers = append(servers, srv)
+		log.Printf("Server started on %v with %d acceptors", srv.Addr(), len(group))
+	}
+
+	// If we replace an older instance, it can stop now.
+	err = server.UpgradeReady()
 	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
+		log.Printf("Error telling the old process to stop: %v", err)
 	}
-	defer server.Close()
-	log.Println("Server started on port", port)
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	// SIGUSR2 hands the sockets over to a new instance of the binary, e.g.
+	// after deploying a new version, which sends SIGTERM once it's ready.
+	for sig := <-sigChan; sig == syscall.SIGUSR2; sig = <-sigChan {
+		process, err := server.Upgrade(listeners)
+		if err != nil {
+			log.Printf("Error upgrading: %v", err)
+			continue
+		}
+		log.Println("Started new process", process.Pid)
+	}
+
+	log.Println("Draining connections")
+	ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := srv.Shutdown(ctx)
+			if err != nil {
+				log.Printf("Error draining %v: %v", srv.Addr(), err)
+			}
+		}()
+	}
+	wg.Wait()
 	log.Println("Server gracefully stopped")
 }
 
@@ -90,12 +261,11 @@ func handlerRequest(w *response.Writer, req *request.Request) {
 			return
 		}
 
+	case req.RequestLine.RequestTarget == "/ws":
+		handlerWebSocket(w, req)
+
 	case strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin"):
-		err := response.HandlerProxy(w, req, h)
-		if err != nil {
-			log.Printf("%v", err)
-			return
-		}
+		httpbin.Handle(w, req)
 
 	default:
 		err := w.WriteStatusLine(response.StatusOK)
@@ -125,3 +295,33 @@ func handlerRequest(w *response.Writer, req *request.Request) {
 		}
 	}
 }
+
+// handlerWebSocket echoes every message back to the client.
+func handlerWebSocket(w *response.Writer, req *request.Request) {
+	conn, err := websocket.Upgrade(w, req)
+	if err != nil {
+		log.Printf("failed to upgrade connection: %v", err)
+		return
+	}
+
+	// Tell the client we're going away when the server stops.
+	stop := context.AfterFunc(req.Context(), func() {
+		conn.Close(websocket.CloseGoingAway, "server shutting down")
+	})
+	defer stop()
+
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			log.Printf("websocket connection closed: %v", err)
+			return
+		}
+
+		err = conn.WriteMessage(messageType, message)
+		if err != nil {
+			log.Printf("failed to write websocket message: %v", err)
+			conn.Close(websocket.CloseInternalServerErr, "")
+			return
+		}
+	}
+}
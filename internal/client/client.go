@@ -0,0 +1,317 @@
+// Package client is an HTTP/1.1 client keeping connections alive between
+// requests.
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Defaults of the clients returned by New.
+const (
+	DefaultDialTimeout         = 10 * time.Second
+	DefaultIdleConnTimeout     = 90 * time.Second
+	DefaultMaxIdleConnsPerHost = 8
+)
+
+// Size of the buffers of each conn. This also caps the length of the status
+// line and of each field line of the responses.
+const bufferSize = 8192
+
+// Client sends requests over pooled connections. It never follows
+// redirects. A Client is safe for concurrent use.
+type Client struct {
+	// DialTimeout limits the time to connect, including the TLS handshake.
+	DialTimeout time.Duration
+	// ResponseHeaderTimeout limits the time to wait for the response
+	// headers once the request has been sent. Zero means no limit.
+	ResponseHeaderTimeout time.Duration
+	// IdleConnTimeout is how long a conn is kept for another request.
+	IdleConnTimeout time.Duration
+	// MaxIdleConnsPerHost is the number of conns kept for each host.
+	MaxIdleConnsPerHost int
+	// TLSConfig is used for https URLs. ServerName is set from the URL.
+	TLSConfig *tls.Config
+
+	mu sync.Mutex
+	// Idle conns by scheme and address, most recently used last.
+	idle map[string][]*persistConn
+}
+
+// New returns a client with the default settings.
+func New() *Client {
+	return &Client{
+		DialTimeout:         DefaultDialTimeout,
+		IdleConnTimeout:     DefaultIdleConnTimeout,
+		MaxIdleConnsPerHost: DefaultMaxIdleConnsPerHost,
+	}
+}
+
+// persistConn is a conn that can carry one request after another.
+type persistConn struct {
+	key       string
+	conn      net.Conn
+	br        *bufio.Reader
+	bw        *bufio.Writer
+	idleSince time.Time
+}
+
+// Do sends req and returns the response once its headers have been read.
+// The caller must close the response body.
+func (c *Client) Do(req *Request) (*Response, error) {
+	ctx := req.context()
+
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return nil, err
+		}
+
+		pc, reused, err := c.getConn(req)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.roundTrip(pc, req)
+		if err == nil {
+			return resp, nil
+		}
+		pc.conn.Close()
+
+		// Whatever went wrong, it's because of the deadline set when ctx
+		// was done.
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("request aborted: %w", ctx.Err())
+		}
+
+		// The server may have closed an idle conn while we weren't looking.
+		// Try again on a new one, unless it may have acted on the request
+		// anyway.
+		var retry *retryableError
+		if reused && req.replayable() && errors.As(err, &retry) {
+			continue
+		}
+
+		return nil, err
+	}
+}
+
+// retryableError is returned by roundTrip when the server didn't answer at
+// all, i.e. it may not have seen the request.
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// connError marks err as retryable if it means the conn was closed.
+func connError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return &retryableError{err}
+	}
+
+	return err
+}
+
+func (c *Client) roundTrip(pc *persistConn, req *Request) (*Response, error) {
+	ctx := req.context()
+	// Interrupt whatever we're doing with the conn once ctx is done.
+	stop := context.AfterFunc(ctx, func() {
+		pc.conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	resp, err := c.exchange(pc, req)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+
+	resp.Body = &body{
+		ReadCloser: resp.Body,
+		ctx:        ctx,
+		done: func(clean bool) {
+			// A conn interrupted by ctx can't be used again.
+			if stop() && clean && resp.keepAlive {
+				c.putConn(pc)
+			} else {
+				pc.conn.Close()
+			}
+		},
+	}
+
+	// Without a body there is nothing to wait for.
+	if resp.ContentLength == 0 || resp.StatusCode == 204 || resp.StatusCode == 304 || req.Method == "HEAD" {
+		resp.Body.(*body).finish(true)
+	}
+
+	return resp, nil
+}
+
+// exchange writes req to pc and reads the headers of the response.
+func (c *Client) exchange(pc *persistConn, req *Request) (*Response, error) {
+	err := writeRequest(pc.bw, req)
+	if err == nil {
+		err = pc.bw.Flush()
+	}
+	if err != nil {
+		return nil, connError(fmt.Errorf("failed to write request: %w", err))
+	}
+
+	if c.ResponseHeaderTimeout > 0 {
+		pc.conn.SetReadDeadline(time.Now().Add(c.ResponseHeaderTimeout))
+	}
+
+	_, err = pc.br.Peek(1)
+	if err != nil {
+		return nil, connError(fmt.Errorf("failed to read response: %w", err))
+	}
+
+	resp, err := readResponse(pc.br, req.Method)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	pc.conn.SetReadDeadline(time.Time{})
+	// Clearing the deadline may have undone the one set for ctx.
+	if err := req.context().Err(); err != nil {
+		return nil, err
+	}
+
+	if req.wantsClose() {
+		resp.keepAlive = false
+	}
+
+	return resp, nil
+}
+
+// getConn returns an idle conn for req, or a new one.
+func (c *Client) getConn(req *Request) (*persistConn, bool, error) {
+	addr := net.JoinHostPort(req.URL.Hostname(), port(req.URL))
+	key := req.URL.Scheme + "://" + addr
+
+	c.mu.Lock()
+	for len(c.idle[key]) > 0 {
+		conns := c.idle[key]
+		pc := conns[len(conns)-1]
+		c.idle[key] = conns[:len(conns)-1]
+
+		if c.IdleConnTimeout > 0 && time.Since(pc.idleSince) > c.IdleConnTimeout {
+			pc.conn.Close()
+			continue
+		}
+
+		c.mu.Unlock()
+		return pc, true, nil
+	}
+	c.mu.Unlock()
+
+	conn, err := c.dial(req.context(), req, addr)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &persistConn{
+		key:  key,
+		conn: conn,
+		br:   bufio.NewReaderSize(conn, bufferSize),
+		bw:   bufio.NewWriterSize(conn, bufferSize),
+	}, false, nil
+}
+
+func (c *Client) dial(ctx context.Context, req *Request, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: c.DialTimeout}
+
+	if req.URL.Scheme != "https" {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to %v: %w", addr, err)
+		}
+		return conn, nil
+	}
+
+	cfg := &tls.Config{}
+	if c.TLSConfig != nil {
+		cfg = c.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = req.URL.Hostname()
+	}
+
+	tlsDialer := &tls.Dialer{NetDialer: dialer, Config: cfg}
+	conn, err := tlsDialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %v: %w", addr, err)
+	}
+
+	return conn, nil
+}
+
+// putConn keeps pc for the next request to the same host, if there is room.
+func (c *Client) putConn(pc *persistConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.idle[pc.key]) >= c.MaxIdleConnsPerHost {
+		pc.conn.Close()
+		return
+	}
+
+	if c.idle == nil {
+		c.idle = make(map[string][]*persistConn)
+	}
+
+	pc.idleSince = time.Now()
+	c.idle[pc.key] = append(c.idle[pc.key], pc)
+}
+
+// CloseIdleConnections closes the conns kept for later requests.
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, conns := range c.idle {
+		for _, pc := range conns {
+			pc.conn.Close()
+		}
+	}
+	c.idle = nil
+}
+
+// body hands the conn back once the body has been read to the end, or
+// closes it if the body is closed early.
+type body struct {
+	io.ReadCloser
+	ctx  context.Context
+	once sync.Once
+	done func(clean bool)
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.finish(errors.Is(err, io.EOF))
+	}
+	if err != nil && !errors.Is(err, io.EOF) && b.ctx.Err() != nil {
+		err = fmt.Errorf("request aborted: %w", b.ctx.Err())
+	}
+
+	return n, err
+}
+
+func (b *body) Close() error {
+	b.finish(false)
+	return nil
+}
+
+func (b *body) finish(clean bool) {
+	b.once.Do(func() { b.done(clean) })
+}
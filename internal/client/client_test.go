@@ -0,0 +1,389 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/conntest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rawServer answers every conn with raw, after reading the request headers.
+func rawServer(t *testing.T, raw string) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				br := bufio.NewReader(conn)
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil || line == "\r\n" {
+						break
+					}
+				}
+				io.WriteString(conn, raw)
+			}()
+		}
+	}()
+
+	return "http://" + ln.Addr().String()
+}
+
+func TestClient(t *testing.T) {
+	var conns atomic.Int32
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Token", r.Header.Get("X-Token"))
+		w.Header().Set("X-Content-Length", r.Header.Get("Content-Length"))
+		w.Header().Set("X-Transfer-Encoding", strings.Join(r.TransferEncoding, ","))
+
+		switch r.URL.Path {
+		case "/chunked":
+			w.Header().Set("Trailer", "X-Checksum")
+			io.WriteString(w, "part one, ")
+			w.(http.Flusher).Flush()
+			io.WriteString(w, "part two")
+			w.Header().Set("X-Checksum", "abc123")
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			io.WriteString(w, r.URL.RequestURI())
+			w.Write(body)
+		}
+	}))
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	c := New()
+
+	// Test: content-length body
+	req, err := NewRequest("GET", upstream.URL+"/path?q=1", nil)
+	require.NoError(t, err)
+	req.Headers.Set("X-Token", "Secret-Value")
+	resp, err := c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "OK", resp.Reason)
+	assert.Equal(t, "GET", resp.Headers.Get("x-method"))
+	assert.Equal(t, "Secret-Value", resp.Headers.Get("x-token"))
+	assert.Equal(t, int64(9), resp.ContentLength)
+	assert.Equal(t, "/path?q=1", conntest.ReadBody(t, resp.Body))
+
+	// Test: chunked body with trailers
+	req, err = NewRequest("GET", upstream.URL+"/chunked", nil)
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.Equal(t, "part one, part two", conntest.ReadBody(t, resp.Body))
+	assert.Equal(t, "abc123", resp.Trailers.Get("x-checksum"))
+
+	// Test: request body of known length
+	req, err = NewRequest("POST", upstream.URL+"/echo", strings.NewReader("hello"))
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "5", resp.Headers.Get("x-content-length"))
+	assert.Equal(t, "/echohello", conntest.ReadBody(t, resp.Body))
+
+	// Test: request body of unknown length is sent chunked
+	req, err = NewRequest("POST", upstream.URL+"/echo", io.MultiReader(strings.NewReader("hel"), strings.NewReader("lo")))
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "chunked", resp.Headers.Get("x-transfer-encoding"))
+	assert.Equal(t, "/echohello", conntest.ReadBody(t, resp.Body))
+
+	// Test: responses without a body
+	req, err = NewRequest("GET", upstream.URL+"/empty", nil)
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, 204, resp.StatusCode)
+	assert.Equal(t, "", conntest.ReadBody(t, resp.Body))
+
+	req, err = NewRequest("HEAD", upstream.URL+"/path", nil)
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), resp.ContentLength)
+	assert.Equal(t, "", conntest.ReadBody(t, resp.Body))
+
+	// Test: all of the above went over a single conn
+	assert.Equal(t, int32(1), conns.Load())
+
+	// Test: a body closed early doesn't leave the conn in a bad state
+	req, err = NewRequest("GET", upstream.URL+"/chunked", nil)
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	req, err = NewRequest("GET", upstream.URL+"/path", nil)
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "/path", conntest.ReadBody(t, resp.Body))
+	assert.Equal(t, int32(2), conns.Load())
+
+	// Test: conns the server closed while idle are replaced
+	upstream.CloseClientConnections()
+	time.Sleep(10 * time.Millisecond)
+
+	req, err = NewRequest("GET", upstream.URL+"/path", nil)
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "/path", conntest.ReadBody(t, resp.Body))
+}
+
+func TestClientFraming(t *testing.T) {
+	c := New()
+
+	get := func(url string) *Response {
+		req, err := NewRequest("GET", url, nil)
+		require.NoError(t, err)
+		resp, err := c.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// Test: body delimited by the end of the conn
+	url := rawServer(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nuntil the end")
+	resp := get(url)
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.Equal(t, "until the end", conntest.ReadBody(t, resp.Body))
+
+	// Test: interim responses are skipped
+	url = rawServer(t, "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 103 Early Hints\r\nLink: </style.css>\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	resp = get(url)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "", resp.Headers.Get("link"))
+	assert.Equal(t, "ok", conntest.ReadBody(t, resp.Body))
+
+	// Test: chunk extensions are ignored
+	url = rawServer(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5;name=value\r\nhello\r\n0\r\n\r\n")
+	resp = get(url)
+	assert.Equal(t, "hello", conntest.ReadBody(t, resp.Body))
+
+	// Test: truncated body
+	url = rawServer(t, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort")
+	resp = get(url)
+	_, err := io.ReadAll(resp.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: malformed status line
+	url = rawServer(t, "HTTP/1.1 OK\r\n\r\n")
+	req, err := NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	_, err = c.Do(req)
+	assert.Error(t, err)
+
+	// Test: conflicting content lengths
+	url = rawServer(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nContent-Length: 3\r\n\r\nok")
+	req, err = NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	_, err = c.Do(req)
+	assert.Error(t, err)
+
+	// Test: unsupported scheme
+	_, err = NewRequest("GET", "ftp://example.com/", nil)
+	assert.Error(t, err)
+}
+
+func TestClientTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	// Accept but never answer.
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	c := New()
+	c.ResponseHeaderTimeout = 50 * time.Millisecond
+
+	req, err := NewRequest("GET", "http://"+ln.Addr().String()+"/", nil)
+	require.NoError(t, err)
+
+	_, err = c.Do(req)
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+}
+
+func TestClientContext(t *testing.T) {
+	flush := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first part"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-flush:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(flush)
+
+	c := New()
+
+	// Test: requests with a context that's already done aren't sent
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, err := NewRequest("GET", srv.URL, nil)
+	require.NoError(t, err)
+	req.Context = ctx
+	_, err = c.Do(req)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Test: waiting for the response is aborted
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err = NewRequest("GET", "http://"+ln.Addr().String()+"/", nil)
+	require.NoError(t, err)
+	req.Context = ctx
+	_, err = c.Do(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Test: reading the body is aborted, and the conn isn't reused
+	ctx, cancel = context.WithCancel(context.Background())
+	req, err = NewRequest("GET", srv.URL, nil)
+	require.NoError(t, err)
+	req.Context = ctx
+	resp, err := c.Do(req)
+	require.NoError(t, err)
+
+	buf := make([]byte, len("first part"))
+	_, err = io.ReadFull(resp.Body, buf)
+	require.NoError(t, err)
+	cancel()
+	_, err = resp.Body.Read(buf)
+	assert.ErrorIs(t, err, context.Canceled)
+	resp.Body.Close()
+	assert.Empty(t, c.idle)
+}
+
+func TestClientRetry(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	// Every conn gets the first request answered, then is closed on the
+	// second, as if the server had timed it out right as it arrived.
+	var requests atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				br := bufio.NewReader(conn)
+				for i := range 2 {
+					for {
+						line, err := br.ReadString('\n')
+						if err != nil {
+							return
+						}
+						if line == "\r\n" {
+							break
+						}
+					}
+					requests.Add(1)
+
+					if i == 0 {
+						io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+					}
+				}
+			}()
+		}
+	}()
+
+	url := "http://" + ln.Addr().String() + "/"
+
+	var c *Client
+	do := func(method string, idempotent bool) error {
+		req, err := NewRequest(method, url, nil)
+		require.NoError(t, err)
+		req.Idempotent = idempotent
+
+		resp, err := c.Do(req)
+		if err != nil {
+			return err
+		}
+		conntest.ReadBody(t, resp.Body)
+		return nil
+	}
+
+	// Test: safe methods are sent again on a new conn
+	c = New()
+	require.NoError(t, do("GET", false))
+	require.NoError(t, do("GET", false))
+	assert.Equal(t, int32(3), requests.Load())
+
+	// Test: other methods aren't, even without a body
+	for _, method := range []string{"POST", "PATCH", "DELETE"} {
+		c = New()
+		requests.Store(0)
+		require.NoError(t, do("GET", false))
+		assert.Error(t, do(method, false))
+		assert.Equal(t, int32(2), requests.Load(), method)
+	}
+
+	// Test: unless they're marked idempotent
+	c = New()
+	requests.Store(0)
+	require.NoError(t, do("GET", false))
+	require.NoError(t, do("DELETE", true))
+	assert.Equal(t, int32(3), requests.Load())
+}
@@ -0,0 +1,212 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+)
+
+// Size of the chunks of bodies of unknown length.
+const chunkSize = 32 * 1024
+
+// Request is a request to be sent by a Client.
+type Request struct {
+	Method string
+	URL    *url.URL
+	// Host is sent in the Host header instead of URL.Host, if set.
+	Host    string
+	Headers headers.Headers
+	// Body is sent after the headers, if set.
+	Body io.Reader
+	// ContentLength is the length of Body. Bodies of unknown length, -1,
+	// are sent chunked.
+	ContentLength int64
+	// Context, if set, aborts the request once done, up to the end of the
+	// response body.
+	Context context.Context
+	// Idempotent lets Do send the request again when a reused conn turns
+	// out to be closed, as it does for GET, HEAD, OPTIONS and TRACE. Only
+	// set it, e.g. for a PUT or DELETE, if the server acting on the request
+	// twice does no harm. Refer to RFC 9110 9.2.2.
+	Idempotent bool
+}
+
+// NewRequest returns a request for target, e.g. "http://example.com/path".
+// The length of body is known if it is a *bytes.Reader, *bytes.Buffer or
+// *strings.Reader.
+func NewRequest(method, target string, body io.Reader) (*Request, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse url: %w", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in url %q", target)
+	}
+
+	contentLength := int64(0)
+	switch b := body.(type) {
+	case nil:
+	case *bytes.Reader:
+		contentLength = int64(b.Len())
+	case *bytes.Buffer:
+		contentLength = int64(b.Len())
+	case *strings.Reader:
+		contentLength = int64(b.Len())
+	default:
+		contentLength = -1
+	}
+
+	return &Request{
+		Method:        method,
+		URL:           u,
+		Headers:       headers.NewHeaders(),
+		Body:          body,
+		ContentLength: contentLength,
+	}, nil
+}
+
+func (r *Request) context() context.Context {
+	if r.Context == nil {
+		return context.Background()
+	}
+
+	return r.Context
+}
+
+// replayable reports whether the request can be sent again without the
+// server acting on it twice, as far as we know.
+func (r *Request) replayable() bool {
+	// A body can't be read twice.
+	if r.Body != nil {
+		return false
+	}
+
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+
+	return r.Idempotent
+}
+
+// wantsClose reports whether the request asks for the conn to be closed
+// after the response.
+func (r *Request) wantsClose() bool {
+	return hasToken(r.Headers.Get("connection"), "close")
+}
+
+// writeRequest serializes req to bw. The framing of the body is up to us,
+// whatever the caller set in the headers.
+func writeRequest(bw *bufio.Writer, req *Request) error {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	_, err := fmt.Fprintf(bw, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), host)
+	if err != nil {
+		return err
+	}
+
+	for key := range req.Headers {
+		switch strings.ToLower(key) {
+		case "host", "content-length", "transfer-encoding":
+			continue
+		}
+
+		for _, value := range req.Headers.Values(key) {
+			_, err = fmt.Fprintf(bw, "%s: %s\r\n", key, value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	switch {
+	case req.Body == nil || req.ContentLength == 0:
+		// Methods that usually have a body need to say it's empty.
+		// Refer to RFC 9110 8.6.
+		if req.Method == "POST" || req.Method == "PUT" || req.Method == "PATCH" {
+			_, err = bw.WriteString("Content-Length: 0\r\n\r\n")
+		} else {
+			_, err = bw.WriteString("\r\n")
+		}
+		return err
+	case req.ContentLength > 0:
+		_, err = fmt.Fprintf(bw, "Content-Length: %d\r\n\r\n", req.ContentLength)
+		if err != nil {
+			return err
+		}
+
+		n, err := io.CopyN(bw, req.Body, req.ContentLength)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return fmt.Errorf("request body is shorter than its content length: %d < %d", n, req.ContentLength)
+			}
+			return err
+		}
+		return nil
+	}
+
+	_, err = bw.WriteString("Transfer-Encoding: chunked\r\n\r\n")
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, chunkSize)
+	for {
+		readBytes, err := req.Body.Read(data)
+		if readBytes > 0 {
+			_, err := fmt.Fprintf(bw, "%x\r\n%s\r\n", readBytes, data[:readBytes])
+			if err != nil {
+				return err
+			}
+		}
+
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+	}
+
+	_, err = bw.WriteString("0\r\n\r\n")
+	return err
+}
+
+// hasToken reports whether the comma-separated list value contains token.
+func hasToken(value, token string) bool {
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// port returns the port of u, or the default one of its scheme.
+func port(u *url.URL) string {
+	if p := u.Port(); p != "" {
+		return p
+	}
+
+	if u.Scheme == "https" {
+		return "443"
+	}
+
+	return "80"
+}
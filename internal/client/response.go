@@ -0,0 +1,60 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+)
+
+// Response is the response to a Request. Field names in Headers and
+// Trailers are lowercase, the way the parser stores them.
+type Response struct {
+	StatusCode int
+	Reason     string
+	Headers    headers.Headers
+	// Body streams the body off the conn. It must be closed, and read to
+	// the end for the conn to be reused.
+	Body io.ReadCloser
+	// ContentLength is the length of Body, or -1 if it isn't known upfront.
+	ContentLength int64
+	// Trailers are the fields sent after a chunked body. They are only
+	// known once Body has been read to the end.
+	Trailers headers.Headers
+
+	// Whether the conn can carry another request once the body is read.
+	keepAlive bool
+}
+
+// readResponse reads the response to a request with method from br. Interim
+// 1xx responses are skipped, except for 101 Switching Protocols.
+func readResponse(br *bufio.Reader, method string) (*Response, error) {
+	parsed, err := response.ResponseHeadersFromReader(br, method)
+	if err != nil {
+		return nil, err
+	}
+
+	statusCode, err := strconv.Atoi(parsed.StatusLine.StatusCode)
+	if err != nil {
+		return nil, fmt.Errorf("invalid status code: %q", parsed.StatusLine.StatusCode)
+	}
+
+	return &Response{
+		StatusCode:    statusCode,
+		Reason:        parsed.StatusLine.ReasonPhrase,
+		Headers:       parsed.Headers,
+		Body:          io.NopCloser(parsed.BodyReader()),
+		ContentLength: parsed.ContentLength,
+		Trailers:      parsed.Trailers,
+		// HTTP/1.0 conns are closed after each response unless asked
+		// otherwise, which we don't. After a 101 the conn speaks another
+		// protocol.
+		keepAlive: parsed.StatusLine.HttpVersion == "1.1" &&
+			!hasToken(parsed.Headers.Get("connection"), "close") &&
+			!parsed.DelimitedByClose() &&
+			statusCode != 101,
+	}, nil
+}
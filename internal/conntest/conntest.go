@@ -0,0 +1,81 @@
+// Package conntest helps test code that answers HTTP requests on a conn, by
+// running it against one end of a connection and parsing what it writes at
+// the other.
+package conntest
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Response writes the request raw, if any, to one end of a pipe, runs serve
+// on the other end and returns the response serve wrote. The server end is
+// closed once serve returns.
+func Response(t testing.TB, raw string, serve func(conn net.Conn)) *http.Response {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	return exchange(t, serverConn, clientConn, raw, serve)
+}
+
+// TCPResponse is like Response but over a loopback TCP connection, for code
+// that takes another path on a *net.TCPConn, such as sendfile.
+func TCPResponse(t testing.TB, raw string, serve func(conn net.Conn)) *http.Response {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	serverConn, err := listener.Accept()
+	if err != nil {
+		clientConn.Close()
+	}
+	require.NoError(t, err)
+
+	return exchange(t, serverConn, clientConn, raw, serve)
+}
+
+func exchange(t testing.TB, serverConn, clientConn net.Conn, raw string, serve func(conn net.Conn)) *http.Response {
+	t.Helper()
+
+	t.Cleanup(func() { clientConn.Close() })
+
+	go func() {
+		defer serverConn.Close()
+		serve(serverConn)
+	}()
+
+	if raw != "" {
+		go io.WriteString(clientConn, raw)
+	}
+
+	// Responses to HEAD have no body, whatever their headers say.
+	method, _, _ := strings.Cut(raw, " ")
+	if method == "" {
+		method = "GET"
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(clientConn), &http.Request{Method: method})
+	require.NoError(t, err)
+
+	return resp
+}
+
+// ReadBody reads body to the end and closes it.
+func ReadBody(t testing.TB, body io.ReadCloser) string {
+	t.Helper()
+
+	data, err := io.ReadAll(body)
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+	return string(data)
+}
@@ -0,0 +1,95 @@
+package fileserver
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+)
+
+// checkPreconditions evaluates the conditional request headers in the order
+// given by RFC 9110 13.2.2. It returns the status code to respond with
+// instead of the file, or an empty string if the file should be served.
+func checkPreconditions(req *request.Request, etag string, modTime time.Time) string {
+	if ifMatch := req.Headers.Get("if-match"); ifMatch != "" {
+		if !matchETag(ifMatch, etag, false) {
+			return response.StatusPreconditionFailed
+		}
+	} else if ifUnmodifiedSince := req.Headers.Get("if-unmodified-since"); ifUnmodifiedSince != "" {
+		t, err := http.ParseTime(ifUnmodifiedSince)
+		if err == nil && modifiedAfter(modTime, t) {
+			return response.StatusPreconditionFailed
+		}
+	}
+
+	if ifNoneMatch := req.Headers.Get("if-none-match"); ifNoneMatch != "" {
+		if matchETag(ifNoneMatch, etag, true) {
+			return response.StatusNotModified
+		}
+	} else if ifModifiedSince := req.Headers.Get("if-modified-since"); ifModifiedSince != "" {
+		t, err := http.ParseTime(ifModifiedSince)
+		if err == nil && !modifiedAfter(modTime, t) {
+			return response.StatusNotModified
+		}
+	}
+
+	return ""
+}
+
+// checkIfRange reports whether the Range header should be honored. A Range
+// is ignored when If-Range names a different version of the file. Refer to
+// RFC 9110 13.1.5.
+func checkIfRange(req *request.Request, etag string, modTime time.Time) bool {
+	ifRange := req.Headers.Get("if-range")
+	if ifRange == "" {
+		return true
+	}
+
+	if strings.HasPrefix(ifRange, `"`) || hasWeakPrefix(ifRange) {
+		return matchETag(ifRange, etag, false)
+	}
+
+	t, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+
+	return t.Equal(modTime.Truncate(time.Second))
+}
+
+// matchETag reports whether etag is in the comma separated list of entity
+// tags. Weak comparison ignores the W/ prefix, strong comparison never
+// matches weak tags.
+func matchETag(list, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if candidate == "*" {
+			return true
+		}
+
+		if hasWeakPrefix(candidate) {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+
+		if candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasWeakPrefix(etag string) bool {
+	return len(etag) >= 2 && strings.EqualFold(etag[:2], "W/")
+}
+
+// HTTP dates only have second precision.
+func modifiedAfter(modTime, t time.Time) bool {
+	return modTime.Truncate(time.Second).After(t)
+}
@@ -0,0 +1,287 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+	"github.com/johndosdos/http-from-tcp/internal/server"
+)
+
+// Served in place of a directory when the request path ends with a slash.
+const indexFile = "index.html"
+
+// IMF-fixdate, the preferred format for HTTP dates. Refer to RFC 9110 5.6.7.
+const timeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// Number of bytes used to detect the content type of files with unknown
+// extensions.
+const sniffLen = 512
+
+type fileServer struct {
+	root *os.Root
+}
+
+// FileServer returns a handler that serves the files under dir. The request
+// target is used as the path of the file relative to dir. Requests are never
+// allowed to reach outside of dir, whether through ".." segments or
+// symlinks.
+func FileServer(dir string) (server.Handler, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open root directory %v: %w", dir, err)
+	}
+
+	s := &fileServer{
+		root: root,
+	}
+
+	return s.serve, nil
+}
+
+func (s *fileServer) serve(w *response.Writer, req *request.Request) {
+	method := req.RequestLine.Method
+	if method != "GET" && method != "HEAD" {
+		h := headers.NewHeaders()
+		h.Set("Allow", "GET, HEAD")
+		writeError(w, response.StatusMethodNotAllowed, h, "method not allowed")
+		return
+	}
+
+	rawPath, rawQuery, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+
+	urlPath, err := url.PathUnescape(rawPath)
+	if err != nil || !strings.HasPrefix(urlPath, "/") || strings.ContainsRune(urlPath, 0) {
+		writeError(w, response.StatusBadRequest, headers.NewHeaders(), "invalid path")
+		return
+	}
+
+	// Refuse path traversal outright instead of silently cleaning it up.
+	for _, segment := range strings.Split(urlPath, "/") {
+		if segment == ".." {
+			writeError(w, response.StatusBadRequest, headers.NewHeaders(), "invalid path")
+			return
+		}
+	}
+
+	name := strings.TrimPrefix(path.Clean(urlPath), "/")
+	if name == "" {
+		name = "."
+	}
+
+	f, info, err := s.open(name)
+	if err != nil {
+		writeOpenError(w, err)
+		return
+	}
+	defer f.Close()
+
+	if info.IsDir() {
+		// Relative links in the index file only work if the directory path
+		// ends with a slash.
+		if !strings.HasSuffix(urlPath, "/") {
+			location := rawPath + "/"
+			if rawQuery != "" {
+				location += "?" + rawQuery
+			}
+			redirect(w, location)
+			return
+		}
+
+		index, indexInfo, err := s.open(path.Join(name, indexFile))
+		if err != nil {
+			writeOpenError(w, err)
+			return
+		}
+		defer index.Close()
+
+		f, info = index, indexInfo
+		if info.IsDir() {
+			writeError(w, response.StatusNotFound, headers.NewHeaders(), "not found")
+			return
+		}
+	}
+
+	serveContent(w, req, f, info)
+}
+
+func (s *fileServer) open(name string) (*os.File, fs.FileInfo, error) {
+	f, err := s.root.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return f, info, nil
+}
+
+func serveContent(w *response.Writer, req *request.Request, f *os.File, info fs.FileInfo) {
+	size := info.Size()
+	modTime := info.ModTime().UTC()
+
+	h := headers.NewHeaders()
+	h.Set("ETag", etag(info))
+	h.Set("Last-Modified", modTime.Format(timeFormat))
+	h.Set("Accept-Ranges", "bytes")
+
+	switch checkPreconditions(req, h.Get("ETag"), modTime) {
+	case response.StatusNotModified:
+		err := w.WriteStatusLine(response.StatusNotModified)
+		if err != nil {
+			log.Printf("failed to write status line to conn: %v", err)
+			return
+		}
+
+		err = w.WriteHeaders(h)
+		if err != nil {
+			log.Printf("failed to write headers to conn: %v", err)
+		}
+		return
+	case response.StatusPreconditionFailed:
+		writeError(w, response.StatusPreconditionFailed, headers.NewHeaders(), "precondition failed")
+		return
+	}
+
+	contentType, err := detectContentType(f, info.Name())
+	if err != nil {
+		log.Printf("failed to detect content type of %v: %v", info.Name(), err)
+		writeError(w, response.StatusInternalServerError, headers.NewHeaders(), "internal server error")
+		return
+	}
+
+	var ranges []byteRange
+	if rangeHeader := req.Headers.Get("range"); rangeHeader != "" && checkIfRange(req, h.Get("ETag"), modTime) {
+		ranges, err = parseRange(rangeHeader, size)
+		if err != nil {
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			writeError(w, response.StatusRangeNotSatisfiable, h, "range not satisfiable")
+			return
+		}
+	}
+
+	isHead := req.RequestLine.Method == "HEAD"
+
+	switch len(ranges) {
+	case 0:
+		h.Set("Content-Type", contentType)
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+		if !writeHead(w, response.StatusOK, h) || isHead {
+			return
+		}
+
+		_, err = w.WriteFile(f, 0, size)
+	case 1:
+		r := ranges[0]
+		h.Set("Content-Type", contentType)
+		h.Set("Content-Range", r.contentRange(size))
+		h.Set("Content-Length", strconv.FormatInt(r.length, 10))
+		if !writeHead(w, response.StatusPartialContent, h) || isHead {
+			return
+		}
+
+		_, err = w.WriteFile(f, r.start, r.length)
+	default:
+		mw := newMultipartWriter(contentType, size)
+		h.Set("Content-Type", "multipart/byteranges; boundary="+mw.boundary)
+		h.Set("Content-Length", strconv.FormatInt(mw.length(ranges), 10))
+		if !writeHead(w, response.StatusPartialContent, h) || isHead {
+			return
+		}
+
+		err = mw.write(w, f, ranges)
+	}
+
+	if err != nil {
+		log.Printf("failed to write body to conn: %v", err)
+	}
+}
+
+func etag(info fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+func detectContentType(f *os.File, name string) (string, error) {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType != "" {
+		return contentType, nil
+	}
+
+	buffer := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, buffer)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	return http.DetectContentType(buffer[:n]), nil
+}
+
+// writeHead writes the status line and headers, logging any failure. It
+// reports whether the body can follow.
+func writeHead(w *response.Writer, statusCode string, h headers.Headers) bool {
+	err := w.WriteStatusLine(statusCode)
+	if err != nil {
+		log.Printf("failed to write status line to conn: %v", err)
+		return false
+	}
+
+	err = w.WriteHeaders(h)
+	if err != nil {
+		log.Printf("failed to write headers to conn: %v", err)
+		return false
+	}
+
+	return true
+}
+
+func writeError(w *response.Writer, statusCode string, h headers.Headers, message string) {
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(message)))
+
+	if !writeHead(w, statusCode, h) {
+		return
+	}
+
+	_, err := w.WriteBody([]byte(message))
+	if err != nil {
+		log.Printf("failed to write body to conn: %v", err)
+	}
+}
+
+func writeOpenError(w *response.Writer, err error) {
+	if errors.Is(err, fs.ErrPermission) {
+		writeError(w, response.StatusForbidden, headers.NewHeaders(), "forbidden")
+		return
+	}
+
+	// Anything else, including symlinks escaping the root, is reported as
+	// missing so we don't leak what exists outside of it.
+	writeError(w, response.StatusNotFound, headers.NewHeaders(), "not found")
+}
+
+func redirect(w *response.Writer, location string) {
+	h := headers.NewHeaders()
+	h.Set("Location", location)
+	writeError(w, response.StatusMovedPermanently, h, "moved permanently")
+}
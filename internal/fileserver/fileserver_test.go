@@ -0,0 +1,161 @@
+package fileserver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/johndosdos/http-from-tcp/internal/conntest"
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+	"github.com/johndosdos/http-from-tcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serve(t *testing.T, handler server.Handler, method, target string, h headers.Headers) *http.Response {
+	t.Helper()
+
+	var raw strings.Builder
+	fmt.Fprintf(&raw, "%s %s HTTP/1.1\r\nHost: localhost\r\n", method, target)
+	for key, value := range h {
+		fmt.Fprintf(&raw, "%s: %s\r\n", key, value)
+	}
+	raw.WriteString("\r\n")
+
+	return conntest.Response(t, raw.String(), func(conn net.Conn) {
+		req, err := request.RequestHeadersFromReader(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+
+		w := response.NewWriter(conn)
+		handler(&w, req)
+		w.Finish()
+	})
+}
+
+func TestFileServer(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello world!\n"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "docs"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docs", "index.html"), []byte("<h1>docs</h1>"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "blob"), []byte("\x89PNG\r\n\x1a\nrest"), 0o644))
+
+	handler, err := FileServer(dir)
+	require.NoError(t, err)
+
+	// Test: plain file
+	resp := serve(t, handler, "GET", "/hello.txt", nil)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "13", resp.Header.Get("Content-Length"))
+	assert.NotEmpty(t, resp.Header.Get("ETag"))
+	assert.NotEmpty(t, resp.Header.Get("Last-Modified"))
+	assert.Equal(t, "hello world!\n", conntest.ReadBody(t, resp.Body))
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+
+	// Test: HEAD has no body
+	resp = serve(t, handler, "HEAD", "/hello.txt", nil)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "", conntest.ReadBody(t, resp.Body))
+
+	// Test: content type detection without extension
+	resp = serve(t, handler, "GET", "/blob", nil)
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+
+	// Test: If-None-Match
+	resp = serve(t, handler, "GET", "/hello.txt", headers.Headers{"if-none-match": etag})
+	assert.Equal(t, 304, resp.StatusCode)
+
+	// Test: If-Modified-Since
+	resp = serve(t, handler, "GET", "/hello.txt", headers.Headers{"if-modified-since": lastModified})
+	assert.Equal(t, 304, resp.StatusCode)
+
+	// Test: If-Match mismatch
+	resp = serve(t, handler, "GET", "/hello.txt", headers.Headers{"if-match": `"nope"`})
+	assert.Equal(t, 412, resp.StatusCode)
+
+	// Test: single range
+	resp = serve(t, handler, "GET", "/hello.txt", headers.Headers{"range": "bytes=0-4"})
+	assert.Equal(t, 206, resp.StatusCode)
+	assert.Equal(t, "bytes 0-4/13", resp.Header.Get("Content-Range"))
+	assert.Equal(t, "hello", conntest.ReadBody(t, resp.Body))
+
+	// Test: suffix range
+	resp = serve(t, handler, "GET", "/hello.txt", headers.Headers{"range": "bytes=-7"})
+	assert.Equal(t, 206, resp.StatusCode)
+	assert.Equal(t, "world!\n", conntest.ReadBody(t, resp.Body))
+
+	// Test: multiple ranges
+	resp = serve(t, handler, "GET", "/hello.txt", headers.Headers{"range": "bytes=0-4, 6-10"})
+	assert.Equal(t, 206, resp.StatusCode)
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	part, err := mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "bytes 0-4/13", part.Header.Get("Content-Range"))
+	data, err := io.ReadAll(part)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "bytes 6-10/13", part.Header.Get("Content-Range"))
+	data, err = io.ReadAll(part)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(data))
+	_, err = mr.NextPart()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: unsatisfiable range
+	resp = serve(t, handler, "GET", "/hello.txt", headers.Headers{"range": "bytes=100-200"})
+	assert.Equal(t, 416, resp.StatusCode)
+	assert.Equal(t, "bytes */13", resp.Header.Get("Content-Range"))
+
+	// Test: If-Range with a stale validator serves the whole file
+	resp = serve(t, handler, "GET", "/hello.txt", headers.Headers{"range": "bytes=0-4", "if-range": `"stale"`})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "hello world!\n", conntest.ReadBody(t, resp.Body))
+
+	// Test: directory index
+	resp = serve(t, handler, "GET", "/docs/", nil)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "<h1>docs</h1>", conntest.ReadBody(t, resp.Body))
+
+	// Test: directory without trailing slash
+	resp = serve(t, handler, "GET", "/docs", nil)
+	assert.Equal(t, 301, resp.StatusCode)
+	assert.Equal(t, "/docs/", resp.Header.Get("Location"))
+
+	// Test: missing file
+	resp = serve(t, handler, "GET", "/missing.txt", nil)
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// Test: path traversal
+	resp = serve(t, handler, "GET", "/../etc/passwd", nil)
+	assert.Equal(t, 400, resp.StatusCode)
+	resp = serve(t, handler, "GET", "/docs/%2e%2e/%2e%2e/etc/passwd", nil)
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// Test: symlink escaping the root
+	require.NoError(t, os.Symlink("/etc/passwd", filepath.Join(dir, "passwd")))
+	resp = serve(t, handler, "GET", "/passwd", nil)
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// Test: unsupported method
+	resp = serve(t, handler, "POST", "/hello.txt", nil)
+	assert.Equal(t, 405, resp.StatusCode)
+	assert.Equal(t, "GET, HEAD", resp.Header.Get("Allow"))
+}
@@ -0,0 +1,178 @@
+package fileserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/johndosdos/http-from-tcp/internal/response"
+)
+
+var errNoOverlap = errors.New("invalid range: no range overlaps the file")
+
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses the value of a Range header for a file of the given
+// size. Refer to RFC 9110 14.1.2.
+//
+// A nil slice with no error means the header should be ignored and the whole
+// file served, which is what we do with malformed headers and units other
+// than bytes. errNoOverlap is returned if none of the ranges can be
+// satisfied.
+func parseRange(s string, size int64) ([]byteRange, error) {
+	const prefix = "bytes="
+
+	if !strings.HasPrefix(strings.ToLower(s), prefix) {
+		return nil, nil
+	}
+
+	var ranges []byteRange
+	var total int64
+	specs := 0
+
+	for _, spec := range strings.Split(s[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		specs++
+
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, nil
+		}
+		first = strings.TrimSpace(first)
+		last = strings.TrimSpace(last)
+
+		var r byteRange
+
+		if first == "" {
+			// suffix-range: the last N bytes of the file.
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+
+			if n == 0 || size == 0 {
+				continue
+			}
+
+			if n > size {
+				n = size
+			}
+
+			r = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, nil
+				}
+			}
+
+			if start >= size {
+				continue
+			}
+
+			if end >= size {
+				end = size - 1
+			}
+
+			r = byteRange{start: start, length: end - start + 1}
+		}
+
+		total += r.length
+		ranges = append(ranges, r)
+	}
+
+	if specs == 0 {
+		return nil, nil
+	}
+
+	if len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+
+	// Asking for more bytes than the file has is either a mistake or an
+	// attempt to make us do extra work. Serve the whole file instead.
+	if total > size {
+		return nil, nil
+	}
+
+	return ranges, nil
+}
+
+// multipartWriter writes a multipart/byteranges body. Refer to RFC 9110
+// 14.6.
+type multipartWriter struct {
+	boundary    string
+	contentType string
+	size        int64
+}
+
+func newMultipartWriter(contentType string, size int64) *multipartWriter {
+	buffer := make([]byte, 16)
+	rand.Read(buffer)
+
+	return &multipartWriter{
+		boundary:    hex.EncodeToString(buffer),
+		contentType: contentType,
+		size:        size,
+	}
+}
+
+func (mw *multipartWriter) partHeader(r byteRange) string {
+	return fmt.Sprintf("\r\n--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n", mw.boundary, mw.contentType, r.contentRange(mw.size))
+}
+
+func (mw *multipartWriter) closeDelimiter() string {
+	return fmt.Sprintf("\r\n--%s--\r\n", mw.boundary)
+}
+
+// length returns the size of the body written for ranges, which we need for
+// the Content-Length header.
+func (mw *multipartWriter) length(ranges []byteRange) int64 {
+	var total int64
+
+	for _, r := range ranges {
+		total += int64(len(mw.partHeader(r))) + r.length
+	}
+
+	return total + int64(len(mw.closeDelimiter()))
+}
+
+func (mw *multipartWriter) write(w *response.Writer, f *os.File, ranges []byteRange) error {
+	for _, r := range ranges {
+		_, err := io.WriteString(w, mw.partHeader(r))
+		if err != nil {
+			return err
+		}
+
+		_, err = w.WriteFile(f, r.start, r.length)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(w, mw.closeDelimiter())
+	return err
+}
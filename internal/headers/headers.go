@@ -9,7 +9,27 @@ import (
 type Headers map[string]string
 
 func (h Headers) Get(key string) string {
-	return h[key]
+	if v, ok := h[key]; ok {
+		return v
+	}
+
+	// Parsed headers are stored in lowercase while handlers usually set them
+	// in canonical form, so fall back to a case-insensitive lookup.
+	for k, v := range h {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+
+	return ""
+}
+
+func (h Headers) Del(key string) {
+	for k := range h {
+		if strings.EqualFold(k, key) {
+			delete(h, k)
+		}
+	}
 }
 
 func (h Headers) Set(key, value string) {
@@ -17,9 +37,33 @@ func (h Headers) Set(key, value string) {
 	// If header name exists but both have different values, join them.
 	v, ok := h[key]
 	if ok {
-		value = strings.Join([]string{v, value}, ", ")
+		sep := ", "
+		// Set-Cookie values may contain commas, so they can't be joined into
+		// one line. Keep them on lines of their own. Refer to RFC 9110 5.3.
+		if strings.EqualFold(key, "set-cookie") {
+			sep = "\n"
+		}
+		value = v + sep + value
+	}
+
+	h[key] = value
+}
+
+// Values returns the values of key, one per field line it's sent as. Only
+// Set-Cookie has more than one.
+func (h Headers) Values(key string) []string {
+	v := h.Get(key)
+	if v == "" {
+		return nil
 	}
 
+	return strings.Split(v, "\n")
+}
+
+// Replace sets key to value, dropping any previous value regardless of the
+// case it was stored in.
+func (h Headers) Replace(key, value string) {
+	h.Del(key)
 	h[key] = value
 }
 
@@ -92,9 +136,9 @@ func (h Headers) Parse(data []byte) (int, bool, error) {
 	// Trim whitespaces at field value since they're optional.
 	fieldValue = bytes.TrimSpace(fieldValue)
 
-	// Covert header name and value chars to lowercase.
+	// Covert header name chars to lowercase. Field names are case-insensitive
+	// but values are not, e.g. Last-Event-ID or Authorization.
 	fieldName = bytes.ToLower(fieldName)
-	fieldValue = bytes.ToLower(fieldValue)
 
 	fieldNameStr := string(fieldName)
 	fieldValueStr := string(fieldValue)
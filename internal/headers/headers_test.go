@@ -43,6 +43,13 @@ func TestHeaders(t *testing.T) {
 	assert.Equal(t, "localhost:42069", headers["host"])
 	assert.False(t, done)
 
+	// Test: values keep their case, only names are case-insensitive
+	headers = NewHeaders()
+	data = []byte("Authorization: Bearer AbC123\r\n\r\n")
+	_, _, err = headers.Parse(data)
+	require.NoError(t, err)
+	assert.Equal(t, Headers{"authorization": "Bearer AbC123"}, headers)
+
 	// Test: invalid header name
 	headers = NewHeaders()
 	data = []byte("H©st: localhost:42069\r\n\r\n")
@@ -73,4 +80,21 @@ func TestHeaders(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "text/html, application/json", headers["accept"])
 	assert.False(t, done)
+
+	// Test: repeated Set-Cookie values are kept apart, as they may contain
+	// commas
+	headers = NewHeaders()
+	data = []byte("Set-Cookie: a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT\r\nSet-Cookie: b=2\r\n\r\n")
+	bytesParsed, _, err = headers.Parse(data)
+	require.NoError(t, err)
+	_, _, err = headers.Parse(data[bytesParsed:])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", "b=2"}, headers.Values("Set-Cookie"))
+	assert.Equal(t, []string{"text/html, application/json"}, Headers{"accept": "text/html, application/json"}.Values("Accept"))
+	assert.Nil(t, headers.Values("Accept"))
+
+	// Test: replace a value regardless of case
+	headers = Headers{"accept": "text/html"}
+	headers.Replace("Accept", "application/json")
+	assert.Equal(t, Headers{"Accept": "application/json"}, headers)
 }
@@ -0,0 +1,375 @@
+// Package http2 implements the framing layer of HTTP/2 and HPACK header
+// compression. Refer to RFC 9113 and RFC 7541.
+package http2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ClientPreface is what every HTTP/2 connection starts with, before the
+// client's SETTINGS frame. Refer to RFC 9113 3.4.
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// Length of the frame header preceding every payload.
+const frameHeaderLen = 9
+
+type FrameType uint8
+
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+type Flags uint8
+
+const (
+	FlagEndStream  Flags = 0x1
+	FlagAck        Flags = 0x1
+	FlagEndHeaders Flags = 0x4
+	FlagPadded     Flags = 0x8
+	FlagPriority   Flags = 0x20
+)
+
+// ErrCode is the reason a stream or connection was closed. Refer to
+// RFC 9113 7.
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+func (c ErrCode) String() string {
+	switch c {
+	case ErrCodeNo:
+		return "NO_ERROR"
+	case ErrCodeProtocol:
+		return "PROTOCOL_ERROR"
+	case ErrCodeInternal:
+		return "INTERNAL_ERROR"
+	case ErrCodeFlowControl:
+		return "FLOW_CONTROL_ERROR"
+	case ErrCodeSettingsTimeout:
+		return "SETTINGS_TIMEOUT"
+	case ErrCodeStreamClosed:
+		return "STREAM_CLOSED"
+	case ErrCodeFrameSize:
+		return "FRAME_SIZE_ERROR"
+	case ErrCodeRefusedStream:
+		return "REFUSED_STREAM"
+	case ErrCodeCancel:
+		return "CANCEL"
+	case ErrCodeCompression:
+		return "COMPRESSION_ERROR"
+	case ErrCodeConnect:
+		return "CONNECT_ERROR"
+	case ErrCodeEnhanceYourCalm:
+		return "ENHANCE_YOUR_CALM"
+	case ErrCodeInadequateSecurity:
+		return "INADEQUATE_SECURITY"
+	case ErrCodeHTTP11Required:
+		return "HTTP_1_1_REQUIRED"
+	}
+
+	return fmt.Sprintf("unknown error code 0x%x", uint32(c))
+}
+
+// ConnectionError is an error that ends the whole connection.
+type ConnectionError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e ConnectionError) Error() string {
+	return fmt.Sprintf("connection error %v: %v", e.Code, e.Reason)
+}
+
+// StreamError is an error that only ends a single stream.
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+	Reason   string
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("stream %d error %v: %v", e.StreamID, e.Code, e.Reason)
+}
+
+// SettingID identifies a connection setting. Refer to RFC 9113 6.5.2.
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+// Initial values of the settings a peer hasn't sent.
+const (
+	DefaultHeaderTableSize   uint32 = 4096
+	DefaultInitialWindowSize uint32 = 65535
+	DefaultMaxFrameSize      uint32 = 16384
+)
+
+// Limits on the values of the settings.
+const (
+	MaxWindowSize     uint32 = 1<<31 - 1
+	MaxFrameSizeLimit uint32 = 1<<24 - 1
+)
+
+type Setting struct {
+	ID    SettingID
+	Value uint32
+}
+
+// Valid checks the value against the bounds of the setting.
+func (s Setting) Valid() error {
+	switch s.ID {
+	case SettingEnablePush:
+		if s.Value > 1 {
+			return ConnectionError{ErrCodeProtocol, "invalid SETTINGS_ENABLE_PUSH"}
+		}
+	case SettingInitialWindowSize:
+		if s.Value > MaxWindowSize {
+			return ConnectionError{ErrCodeFlowControl, "invalid SETTINGS_INITIAL_WINDOW_SIZE"}
+		}
+	case SettingMaxFrameSize:
+		if s.Value < DefaultMaxFrameSize || s.Value > MaxFrameSizeLimit {
+			return ConnectionError{ErrCodeProtocol, "invalid SETTINGS_MAX_FRAME_SIZE"}
+		}
+	}
+
+	return nil
+}
+
+// Frame is a single frame. The meaning of the payload depends on the type,
+// see the accessors below.
+type Frame struct {
+	Type     FrameType
+	Flags    Flags
+	StreamID uint32
+	Payload  []byte
+}
+
+// Has reports whether all of flags are set.
+func (f *Frame) Has(flags Flags) bool {
+	return f.Flags&flags == flags
+}
+
+// ReadFrame reads the next frame from r. Frames with a payload longer than
+// maxSize are a connection error. Refer to RFC 9113 4.1.
+func ReadFrame(r io.Reader, maxSize uint32) (*Frame, error) {
+	var header [frameHeaderLen]byte
+
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+
+	length := uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+	if length > maxSize {
+		return nil, ConnectionError{ErrCodeFrameSize, fmt.Sprintf("frame of %d bytes exceeds %d", length, maxSize)}
+	}
+
+	f := &Frame{
+		Type:  FrameType(header[3]),
+		Flags: Flags(header[4]),
+		// The reserved bit is ignored.
+		StreamID: binary.BigEndian.Uint32(header[5:]) & (1<<31 - 1),
+		Payload:  make([]byte, length),
+	}
+
+	_, err = io.ReadFull(r, f.Payload)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// WriteFrame writes f to w.
+func WriteFrame(w io.Writer, f Frame) error {
+	length := len(f.Payload)
+	if uint32(length) > MaxFrameSizeLimit {
+		return fmt.Errorf("frame payload of %d bytes is too long", length)
+	}
+
+	header := [frameHeaderLen]byte{
+		byte(length >> 16), byte(length >> 8), byte(length),
+		byte(f.Type),
+		byte(f.Flags),
+	}
+	binary.BigEndian.PutUint32(header[5:], f.StreamID)
+
+	_, err := w.Write(header[:])
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(f.Payload)
+	return err
+}
+
+// unpad strips the padding of DATA, HEADERS and PUSH_PROMISE payloads.
+// Refer to RFC 9113 6.1.
+func (f *Frame) unpad() ([]byte, error) {
+	payload := f.Payload
+	if !f.Has(FlagPadded) {
+		return payload, nil
+	}
+
+	if len(payload) == 0 {
+		return nil, ConnectionError{ErrCodeFrameSize, "padded frame without pad length"}
+	}
+
+	padLength := int(payload[0])
+	payload = payload[1:]
+	if padLength > len(payload) {
+		return nil, ConnectionError{ErrCodeProtocol, "padding exceeds the payload"}
+	}
+
+	return payload[:len(payload)-padLength], nil
+}
+
+// Data returns the data of a DATA frame.
+func (f *Frame) Data() ([]byte, error) {
+	return f.unpad()
+}
+
+// HeaderBlockFragment returns the part of the header block carried by a
+// HEADERS or CONTINUATION frame, without padding or priority.
+func (f *Frame) HeaderBlockFragment() ([]byte, error) {
+	if f.Type == FrameContinuation {
+		return f.Payload, nil
+	}
+
+	payload, err := f.unpad()
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Has(FlagPriority) {
+		// Stream dependency and weight, which are deprecated.
+		if len(payload) < 5 {
+			return nil, ConnectionError{ErrCodeFrameSize, "HEADERS frame too short for priority"}
+		}
+		payload = payload[5:]
+	}
+
+	return payload, nil
+}
+
+// Settings returns the settings of a SETTINGS frame.
+func (f *Frame) Settings() ([]Setting, error) {
+	return ParseSettings(f.Payload)
+}
+
+// ParseSettings parses a SETTINGS payload, also sent base64 encoded in the
+// HTTP2-Settings header when upgrading from HTTP/1.1.
+func ParseSettings(payload []byte) ([]Setting, error) {
+	if len(payload)%6 != 0 {
+		return nil, ConnectionError{ErrCodeFrameSize, "SETTINGS payload not a multiple of 6"}
+	}
+
+	settings := make([]Setting, 0, len(payload)/6)
+	for i := 0; i < len(payload); i += 6 {
+		s := Setting{
+			ID:    SettingID(binary.BigEndian.Uint16(payload[i:])),
+			Value: binary.BigEndian.Uint32(payload[i+2:]),
+		}
+
+		err := s.Valid()
+		if err != nil {
+			return nil, err
+		}
+
+		settings = append(settings, s)
+	}
+
+	return settings, nil
+}
+
+// SettingsPayload encodes settings as a SETTINGS payload.
+func SettingsPayload(settings ...Setting) []byte {
+	payload := make([]byte, 0, 6*len(settings))
+	for _, s := range settings {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(s.ID))
+		payload = binary.BigEndian.AppendUint32(payload, s.Value)
+	}
+
+	return payload
+}
+
+// WindowIncrement returns the increment of a WINDOW_UPDATE frame.
+func (f *Frame) WindowIncrement() (uint32, error) {
+	if len(f.Payload) != 4 {
+		return 0, ConnectionError{ErrCodeFrameSize, "WINDOW_UPDATE payload not 4 bytes"}
+	}
+
+	return binary.BigEndian.Uint32(f.Payload) & (1<<31 - 1), nil
+}
+
+// WindowUpdatePayload encodes a WINDOW_UPDATE payload.
+func WindowUpdatePayload(increment uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, increment)
+}
+
+// ErrCode returns the error code of a RST_STREAM frame.
+func (f *Frame) ErrCode() (ErrCode, error) {
+	if len(f.Payload) != 4 {
+		return 0, ConnectionError{ErrCodeFrameSize, "RST_STREAM payload not 4 bytes"}
+	}
+
+	return ErrCode(binary.BigEndian.Uint32(f.Payload)), nil
+}
+
+// RSTStreamPayload encodes a RST_STREAM payload.
+func RSTStreamPayload(code ErrCode) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(code))
+}
+
+// GoAway returns the last stream ID and the error code of a GOAWAY frame.
+func (f *Frame) GoAway() (uint32, ErrCode, error) {
+	if len(f.Payload) < 8 {
+		return 0, 0, ConnectionError{ErrCodeFrameSize, "GOAWAY payload too short"}
+	}
+
+	lastStreamID := binary.BigEndian.Uint32(f.Payload) & (1<<31 - 1)
+	return lastStreamID, ErrCode(binary.BigEndian.Uint32(f.Payload[4:])), nil
+}
+
+// GoAwayPayload encodes a GOAWAY payload.
+func GoAwayPayload(lastStreamID uint32, code ErrCode, debug string) []byte {
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	return append(payload, debug...)
+}
@@ -0,0 +1,81 @@
+package http2
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrame(t *testing.T) {
+	// Test: round trip
+	var buf bytes.Buffer
+	require.NoError(t, WriteFrame(&buf, Frame{Type: FrameData, Flags: FlagEndStream, StreamID: 3, Payload: []byte("hello")}))
+	assert.Equal(t, []byte{0, 0, 5, 0, 1, 0, 0, 0, 3}, buf.Bytes()[:frameHeaderLen])
+
+	f, err := ReadFrame(&buf, DefaultMaxFrameSize)
+	require.NoError(t, err)
+	assert.Equal(t, FrameData, f.Type)
+	assert.True(t, f.Has(FlagEndStream))
+	assert.Equal(t, uint32(3), f.StreamID)
+	assert.Equal(t, "hello", string(f.Payload))
+
+	// Test: the reserved bit of the stream ID is ignored
+	f, err = ReadFrame(bytes.NewReader([]byte{0, 0, 0, 4, 0, 0x80, 0, 0, 0}), DefaultMaxFrameSize)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), f.StreamID)
+
+	// Test: frames over the max size
+	_, err = ReadFrame(bytes.NewReader([]byte{0, 0x40, 1, 0, 0, 0, 0, 0, 1}), DefaultMaxFrameSize)
+	var connErr ConnectionError
+	require.ErrorAs(t, err, &connErr)
+	assert.Equal(t, ErrCodeFrameSize, connErr.Code)
+
+	// Test: truncated payload
+	_, err = ReadFrame(bytes.NewReader([]byte{0, 0, 5, 0, 0, 0, 0, 0, 1, 'h'}), DefaultMaxFrameSize)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: padding
+	f = &Frame{Type: FrameData, Flags: FlagPadded, Payload: []byte{2, 'h', 'i', 0, 0}}
+	data, err := f.Data()
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(data))
+
+	f = &Frame{Type: FrameData, Flags: FlagPadded, Payload: []byte{5, 'h', 'i'}}
+	_, err = f.Data()
+	assert.True(t, errors.As(err, &connErr))
+
+	// Test: header block fragment with priority and padding
+	f = &Frame{Type: FrameHeaders, Flags: FlagPadded | FlagPriority, Payload: []byte{1, 0, 0, 0, 1, 16, 0x82, 0}}
+	fragment, err := f.HeaderBlockFragment()
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x82}, fragment)
+}
+
+func TestSettings(t *testing.T) {
+	// Test: round trip
+	payload := SettingsPayload(Setting{SettingInitialWindowSize, 1 << 20}, Setting{SettingMaxFrameSize, 1 << 15})
+	settings, err := ParseSettings(payload)
+	require.NoError(t, err)
+	assert.Equal(t, []Setting{{SettingInitialWindowSize, 1 << 20}, {SettingMaxFrameSize, 1 << 15}}, settings)
+
+	// Test: invalid values
+	_, err = ParseSettings(SettingsPayload(Setting{SettingInitialWindowSize, 1 << 31}))
+	assert.Error(t, err)
+	_, err = ParseSettings(SettingsPayload(Setting{SettingMaxFrameSize, 100}))
+	assert.Error(t, err)
+	_, err = ParseSettings(SettingsPayload(Setting{SettingEnablePush, 2}))
+	assert.Error(t, err)
+
+	// Test: payload not a multiple of 6
+	_, err = ParseSettings([]byte{0, 1, 0})
+	assert.Error(t, err)
+
+	// Test: unknown settings are kept for the caller to ignore
+	settings, err = ParseSettings(SettingsPayload(Setting{0xff, 1}))
+	require.NoError(t, err)
+	assert.Len(t, settings, 1)
+}
@@ -0,0 +1,383 @@
+package http2
+
+import (
+	"errors"
+	"fmt"
+)
+
+// HeaderField is a single header, including the pseudo-headers such as
+// :method and :status.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// Size of a field in the dynamic table. Refer to RFC 7541 4.1.
+func (hf HeaderField) size() uint32 {
+	return uint32(len(hf.Name) + len(hf.Value) + 32)
+}
+
+// The static table, indexed from 1. Refer to RFC 7541 Appendix A.
+var staticTable = []HeaderField{
+	{":authority", ""},
+	{":method", "GET"},
+	{":method", "POST"},
+	{":path", "/"},
+	{":path", "/index.html"},
+	{":scheme", "http"},
+	{":scheme", "https"},
+	{":status", "200"},
+	{":status", "204"},
+	{":status", "206"},
+	{":status", "304"},
+	{":status", "400"},
+	{":status", "404"},
+	{":status", "500"},
+	{"accept-charset", ""},
+	{"accept-encoding", "gzip, deflate"},
+	{"accept-language", ""},
+	{"accept-ranges", ""},
+	{"accept", ""},
+	{"access-control-allow-origin", ""},
+	{"age", ""},
+	{"allow", ""},
+	{"authorization", ""},
+	{"cache-control", ""},
+	{"content-disposition", ""},
+	{"content-encoding", ""},
+	{"content-language", ""},
+	{"content-length", ""},
+	{"content-location", ""},
+	{"content-range", ""},
+	{"content-type", ""},
+	{"cookie", ""},
+	{"date", ""},
+	{"etag", ""},
+	{"expect", ""},
+	{"expires", ""},
+	{"from", ""},
+	{"host", ""},
+	{"if-match", ""},
+	{"if-modified-since", ""},
+	{"if-none-match", ""},
+	{"if-range", ""},
+	{"if-unmodified-since", ""},
+	{"last-modified", ""},
+	{"link", ""},
+	{"location", ""},
+	{"max-forwards", ""},
+	{"proxy-authenticate", ""},
+	{"proxy-authorization", ""},
+	{"range", ""},
+	{"referer", ""},
+	{"refresh", ""},
+	{"retry-after", ""},
+	{"server", ""},
+	{"set-cookie", ""},
+	{"strict-transport-security", ""},
+	{"transfer-encoding", ""},
+	{"user-agent", ""},
+	{"vary", ""},
+	{"via", ""},
+	{"www-authenticate", ""},
+}
+
+// Indexes of the static table by field and by name, for the encoder.
+var (
+	staticFieldIndex = make(map[HeaderField]uint64)
+	staticNameIndex  = make(map[string]uint64)
+)
+
+func init() {
+	for i, hf := range staticTable {
+		index := uint64(i + 1)
+		if _, ok := staticNameIndex[hf.Name]; !ok {
+			staticNameIndex[hf.Name] = index
+		}
+		staticFieldIndex[hf] = index
+	}
+}
+
+var errCompression = errors.New("malformed header block")
+
+// Decoder decodes header blocks. The dynamic table is carried over from
+// one block to the next, so all the blocks of a connection must go through
+// the same decoder, in order.
+type Decoder struct {
+	// The dynamic table, newest entry first.
+	dynamic []HeaderField
+	size    uint32
+	// Current limit on size, as set by the encoder with a size update.
+	maxSize uint32
+	// Limit on maxSize, the SETTINGS_HEADER_TABLE_SIZE we announced.
+	allowedMaxSize uint32
+	// Limit on the decoded size of a header list.
+	maxListSize uint32
+}
+
+// NewDecoder returns a decoder for a peer we announced
+// SETTINGS_HEADER_TABLE_SIZE tableSize to. Header lists decoding to more
+// than maxListSize bytes, counted the way the dynamic table does, are
+// rejected.
+func NewDecoder(tableSize, maxListSize uint32) *Decoder {
+	return &Decoder{
+		maxSize:        tableSize,
+		allowedMaxSize: tableSize,
+		maxListSize:    maxListSize,
+	}
+}
+
+// Decode decodes a complete header block. Refer to RFC 7541 6.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	var listSize uint32
+	// Size updates are only allowed at the start of a block.
+	fieldSeen := false
+
+	for len(block) > 0 {
+		b := block[0]
+
+		var hf HeaderField
+		var err error
+
+		switch {
+		case b&0x80 != 0:
+			// Indexed field.
+			var index uint64
+			index, block, err = readInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+
+			hf, err = d.field(index)
+			if err != nil {
+				return nil, err
+			}
+		case b&0xc0 == 0x40:
+			// Literal with incremental indexing.
+			hf, block, err = d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+
+			d.add(hf)
+		case b&0xe0 == 0x20:
+			// Dynamic table size update.
+			if fieldSeen {
+				return nil, fmt.Errorf("%w: table size update after a field", errCompression)
+			}
+
+			var size uint64
+			size, block, err = readInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+
+			if size > uint64(d.allowedMaxSize) {
+				return nil, fmt.Errorf("%w: table size %d exceeds %d", errCompression, size, d.allowedMaxSize)
+			}
+
+			d.maxSize = uint32(size)
+			d.evict()
+			continue
+		default:
+			// Literal without indexing, or never indexed.
+			hf, block, err = d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		fieldSeen = true
+
+		listSize += hf.size()
+		if d.maxListSize > 0 && listSize > d.maxListSize {
+			return nil, fmt.Errorf("header list exceeds %d bytes", d.maxListSize)
+		}
+
+		fields = append(fields, hf)
+	}
+
+	return fields, nil
+}
+
+// field returns the field at index, counting the static table first and
+// then the dynamic table. Refer to RFC 7541 2.3.3.
+func (d *Decoder) field(index uint64) (HeaderField, error) {
+	switch {
+	case index == 0:
+		return HeaderField{}, fmt.Errorf("%w: index 0", errCompression)
+	case index <= uint64(len(staticTable)):
+		return staticTable[index-1], nil
+	case index-uint64(len(staticTable)) <= uint64(len(d.dynamic)):
+		return d.dynamic[index-uint64(len(staticTable))-1], nil
+	}
+
+	return HeaderField{}, fmt.Errorf("%w: index %d out of range", errCompression, index)
+}
+
+// readLiteral reads a literal field whose name index has an n-bit prefix.
+func (d *Decoder) readLiteral(block []byte, n uint8) (HeaderField, []byte, error) {
+	index, block, err := readInt(block, n)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+
+	var hf HeaderField
+	if index > 0 {
+		named, err := d.field(index)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+		hf.Name = named.Name
+	} else {
+		hf.Name, block, err = readString(block)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+	}
+
+	hf.Value, block, err = readString(block)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+
+	return hf, block, nil
+}
+
+// add inserts hf into the dynamic table, evicting the oldest entries to
+// make room. Refer to RFC 7541 4.4.
+func (d *Decoder) add(hf HeaderField) {
+	d.dynamic = append([]HeaderField{hf}, d.dynamic...)
+	d.size += hf.size()
+	d.evict()
+}
+
+func (d *Decoder) evict() {
+	for d.size > d.maxSize && len(d.dynamic) > 0 {
+		last := d.dynamic[len(d.dynamic)-1]
+		d.dynamic = d.dynamic[:len(d.dynamic)-1]
+		d.size -= last.size()
+	}
+}
+
+// Encoder encodes header blocks. It doesn't use the dynamic table, so
+// blocks can be decoded in any order and the table size the peer allows
+// doesn't matter.
+type Encoder struct{}
+
+// Encode appends the encoded fields to block.
+func (Encoder) Encode(block []byte, fields ...HeaderField) []byte {
+	for _, hf := range fields {
+		if index, ok := staticFieldIndex[hf]; ok {
+			block = appendInt(block, 0x80, 7, index)
+			continue
+		}
+
+		// Literal without indexing. Refer to RFC 7541 6.2.2.
+		if index, ok := staticNameIndex[hf.Name]; ok {
+			block = appendInt(block, 0x00, 4, index)
+		} else {
+			block = append(block, 0x00)
+			block = appendString(block, hf.Name)
+		}
+		block = appendString(block, hf.Value)
+	}
+
+	return block
+}
+
+// readInt reads an integer with an n-bit prefix. Refer to RFC 7541 5.1.
+func readInt(block []byte, n uint8) (uint64, []byte, error) {
+	if len(block) == 0 {
+		return 0, nil, fmt.Errorf("%w: truncated integer", errCompression)
+	}
+
+	mask := uint64(1)<<n - 1
+	value := uint64(block[0]) & mask
+	block = block[1:]
+
+	if value < mask {
+		return value, block, nil
+	}
+
+	for shift := uint(0); ; shift += 7 {
+		if len(block) == 0 {
+			return 0, nil, fmt.Errorf("%w: truncated integer", errCompression)
+		}
+		// Anything longer can't be a sensible index or length.
+		if shift > 28 {
+			return 0, nil, fmt.Errorf("%w: integer too large", errCompression)
+		}
+
+		b := block[0]
+		block = block[1:]
+		value += uint64(b&0x7f) << shift
+
+		if b&0x80 == 0 {
+			return value, block, nil
+		}
+	}
+}
+
+// appendInt appends value with an n-bit prefix, the rest of the first byte
+// being flags.
+func appendInt(block []byte, flags byte, n uint8, value uint64) []byte {
+	mask := uint64(1)<<n - 1
+	if value < mask {
+		return append(block, flags|byte(value))
+	}
+
+	block = append(block, flags|byte(mask))
+	value -= mask
+	for value >= 0x80 {
+		block = append(block, byte(value&0x7f)|0x80)
+		value >>= 7
+	}
+
+	return append(block, byte(value))
+}
+
+// readString reads a string literal. Refer to RFC 7541 5.2.
+func readString(block []byte) (string, []byte, error) {
+	if len(block) == 0 {
+		return "", nil, fmt.Errorf("%w: truncated string", errCompression)
+	}
+
+	huffman := block[0]&0x80 != 0
+
+	length, block, err := readInt(block, 7)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if uint64(len(block)) < length {
+		return "", nil, fmt.Errorf("%w: truncated string", errCompression)
+	}
+
+	data := block[:length]
+	block = block[length:]
+
+	if !huffman {
+		return string(data), block, nil
+	}
+
+	s, err := huffmanDecode(data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return s, block, nil
+}
+
+// appendString appends s as a string literal, Huffman coded if that makes
+// it shorter.
+func appendString(block []byte, s string) []byte {
+	if n := huffmanEncodedLen(s); n < len(s) {
+		block = appendInt(block, 0x80, 7, uint64(n))
+		return huffmanEncode(block, s)
+	}
+
+	block = appendInt(block, 0x00, 7, uint64(len(s)))
+	return append(block, s...)
+}
@@ -0,0 +1,159 @@
+package http2
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	data, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return data
+}
+
+func TestDecoder(t *testing.T) {
+	// Test: requests without Huffman coding, refer to RFC 7541 C.3
+	d := NewDecoder(DefaultHeaderTableSize, 0)
+
+	fields, err := d.Decode(mustHex(t, "8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{
+		{":method", "GET"},
+		{":scheme", "http"},
+		{":path", "/"},
+		{":authority", "www.example.com"},
+	}, fields)
+	assert.Equal(t, uint32(57), d.size)
+
+	fields, err = d.Decode(mustHex(t, "8286 84be 5808 6e6f 2d63 6163 6865"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{
+		{":method", "GET"},
+		{":scheme", "http"},
+		{":path", "/"},
+		{":authority", "www.example.com"},
+		{"cache-control", "no-cache"},
+	}, fields)
+	assert.Equal(t, uint32(110), d.size)
+
+	// Test: requests with Huffman coding, refer to RFC 7541 C.4
+	d = NewDecoder(DefaultHeaderTableSize, 0)
+
+	fields, err = d.Decode(mustHex(t, "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{":authority", "www.example.com"}, fields[3])
+
+	_, err = d.Decode(mustHex(t, "8286 84be 5886 a8eb 1064 9cbf"))
+	require.NoError(t, err)
+
+	fields, err = d.Decode(mustHex(t, "8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{
+		{":method", "GET"},
+		{":scheme", "https"},
+		{":path", "/index.html"},
+		{":authority", "www.example.com"},
+		{"custom-key", "custom-value"},
+	}, fields)
+	assert.Equal(t, uint32(164), d.size)
+
+	// Test: size updates evict entries
+	_, err = d.Decode([]byte{0x20})
+	require.NoError(t, err)
+	assert.Empty(t, d.dynamic)
+	_, err = d.Decode(mustHex(t, "be"))
+	assert.Error(t, err)
+
+	// Test: size updates beyond what we allow
+	_, err = d.Decode(mustHex(t, "3fe2 1f"))
+	assert.Error(t, err)
+
+	// Test: size updates after a field
+	_, err = d.Decode(mustHex(t, "8220"))
+	assert.Error(t, err)
+
+	// Test: index out of range
+	_, err = d.Decode([]byte{0x80})
+	assert.Error(t, err)
+	_, err = d.Decode(mustHex(t, "ff00"))
+	assert.Error(t, err)
+
+	// Test: truncated block
+	_, err = d.Decode(mustHex(t, "4088 25a8"))
+	assert.Error(t, err)
+
+	// Test: header lists over the limit
+	d = NewDecoder(DefaultHeaderTableSize, 64)
+	_, err = d.Decode(mustHex(t, "8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d"))
+	assert.Error(t, err)
+}
+
+func TestEncoder(t *testing.T) {
+	fields := []HeaderField{
+		{":status", "200"},
+		{":status", "418"},
+		{"content-type", "text/html; charset=utf-8"},
+		{"x-custom", "Some Value"},
+		{"x-empty", ""},
+		{"x-binary", "\x00\xff"},
+	}
+
+	// Test: round trip
+	block := Encoder{}.Encode(nil, fields...)
+	decoded, err := NewDecoder(DefaultHeaderTableSize, 0).Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields, decoded)
+
+	// Test: static table entries are indexed
+	assert.Equal(t, []byte{0x88}, Encoder{}.Encode(nil, HeaderField{":status", "200"}))
+}
+
+func TestHuffman(t *testing.T) {
+	// Test: round trip of every octet
+	var all strings.Builder
+	for i := range 256 {
+		all.WriteByte(byte(i))
+	}
+	encoded := huffmanEncode(nil, all.String())
+	assert.Len(t, encoded, huffmanEncodedLen(all.String()))
+	decoded, err := huffmanDecode(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, all.String(), decoded)
+
+	// Test: RFC 7541 C.4.1
+	assert.Equal(t, mustHex(t, "f1e3 c2e5 f23a 6ba0 ab90 f4ff"), huffmanEncode(nil, "www.example.com"))
+
+	// Test: padding that isn't ones
+	_, err = huffmanDecode([]byte{0xf1, 0xe0})
+	assert.Error(t, err)
+
+	// Test: padding longer than 7 bits
+	_, err = huffmanDecode([]byte{0xff})
+	assert.Error(t, err)
+
+	// Test: EOS
+	_, err = huffmanDecode([]byte{0xff, 0xff, 0xff, 0xff})
+	assert.Error(t, err)
+}
+
+func TestInt(t *testing.T) {
+	// Test: RFC 7541 C.1
+	assert.Equal(t, []byte{0x0a}, appendInt(nil, 0, 5, 10))
+	assert.Equal(t, []byte{0x1f, 0x9a, 0x0a}, appendInt(nil, 0, 5, 1337))
+	assert.Equal(t, []byte{0x2a}, appendInt(nil, 0, 8, 42))
+
+	value, rest, err := readInt([]byte{0x1f, 0x9a, 0x0a, 0xff}, 5)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1337), value)
+	assert.Equal(t, []byte{0xff}, rest)
+
+	// Test: integers too large
+	_, _, err = readInt([]byte{0x1f, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, 5)
+	assert.Error(t, err)
+}
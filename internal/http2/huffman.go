@@ -0,0 +1,110 @@
+package http2
+
+import (
+	"fmt"
+	"strings"
+)
+
+// huffmanNode is a node of the decoding tree. Leaves have no children.
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      byte
+}
+
+var huffmanRoot = buildHuffmanTree()
+
+func buildHuffmanTree() *huffmanNode {
+	root := &huffmanNode{}
+
+	for sym, code := range huffmanCodes {
+		node := root
+		for i := int(huffmanCodeLen[sym]) - 1; i >= 0; i-- {
+			bit := code >> i & 1
+			if node.children[bit] == nil {
+				node.children[bit] = &huffmanNode{}
+			}
+			node = node.children[bit]
+		}
+		node.sym = byte(sym)
+	}
+
+	return root
+}
+
+func (n *huffmanNode) leaf() bool {
+	return n.children[0] == nil && n.children[1] == nil
+}
+
+// huffmanDecode decodes a Huffman coded string. The string must be padded
+// with the most significant bits of EOS, i.e. ones, to a whole byte. Refer
+// to RFC 7541 5.2.
+func huffmanDecode(data []byte) (string, error) {
+	var sb strings.Builder
+	node := huffmanRoot
+	// Bits read since the last symbol, and whether they were all ones.
+	pending := 0
+	allOnes := true
+
+	for _, b := range data {
+		for i := 7; i >= 0; i-- {
+			bit := b >> i & 1
+
+			node = node.children[bit]
+			if node == nil {
+				// Only EOS, 30 ones, runs off the tree.
+				return "", fmt.Errorf("%w: EOS in Huffman string", errCompression)
+			}
+
+			pending++
+			allOnes = allOnes && bit == 1
+
+			if node.leaf() {
+				sb.WriteByte(node.sym)
+				node = huffmanRoot
+				pending = 0
+				allOnes = true
+			}
+		}
+	}
+
+	if pending > 7 || !allOnes {
+		return "", fmt.Errorf("%w: invalid Huffman padding", errCompression)
+	}
+
+	return sb.String(), nil
+}
+
+// huffmanEncodedLen returns the length of s once Huffman coded.
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodeLen[s[i]])
+	}
+
+	return (bits + 7) / 8
+}
+
+// huffmanEncode appends s Huffman coded to block.
+func huffmanEncode(block []byte, s string) []byte {
+	var acc uint64
+	bits := 0
+
+	for i := 0; i < len(s); i++ {
+		length := int(huffmanCodeLen[s[i]])
+		acc = acc<<length | uint64(huffmanCodes[s[i]])
+		bits += length
+
+		for bits >= 8 {
+			bits -= 8
+			block = append(block, byte(acc>>bits))
+		}
+	}
+
+	if bits > 0 {
+		// Pad with ones, the start of EOS.
+		acc = acc<<(8-bits) | (1<<(8-bits) - 1)
+		block = append(block, byte(acc))
+	}
+
+	return block
+}
@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+	"github.com/johndosdos/http-from-tcp/internal/server"
+)
+
+// Compress compresses the response body written by next with gzip or
+// deflate, whichever the client prefers according to its Accept-Encoding
+// header.
+func Compress(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		encoding := ""
+
+		// Responses to HEAD have no body to compress.
+		if req.RequestLine.Method != "HEAD" {
+			encoding = response.NegotiateEncoding(req.Headers.Get("accept-encoding"))
+		}
+
+		w.Compress(encoding, response.DefaultMinCompressSize)
+		next(w, req)
+	}
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+	"github.com/johndosdos/http-from-tcp/internal/server"
+)
+
+// Longest X-Request-Id taken from clients. Anything longer is replaced.
+const maxRequestIDLen = 128
+
+type requestIDKey struct{}
+
+// RequestID gives each request an ID, stored in its context for
+// RequestIDFromContext. The ID in the request's X-Request-Id header is used
+// if there is one, so that requests can be followed across servers. IDs
+// made of anything but letters, digits, '.', '_' and '-' could smuggle
+// text into logs and headers, so they are replaced, as are missing ones,
+// with a random ID. It's set in the header, so the proxy passes it on
+// upstream.
+func RequestID(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		id := req.Headers.Get("x-request-id")
+		if !validRequestID(id) {
+			id = rand.Text()
+			req.Headers.Replace("x-request-id", id)
+		}
+
+		ctx := context.WithValue(req.Context(), requestIDKey{}, id)
+		next(w, req.WithContext(ctx))
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+
+	for _, c := range []byte(id) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// RequestIDFromContext returns the ID RequestID gave the request ctx
+// belongs to, or "" if there's none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Timeout gives next d to handle each request, after which the request's
+// context is done. It's up to next to notice and give up.
+func Timeout(d time.Duration, next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), d)
+		defer cancel()
+
+		next(w, req.WithContext(ctx))
+	}
+}
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newRequest parses raw the way the server does.
+func newRequest(t *testing.T, raw string) *request.Request {
+	t.Helper()
+
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	return req
+}
+
+// idOf runs req through RequestID and returns the ID the next handler saw.
+func idOf(req *request.Request) string {
+	var id string
+	RequestID(func(w *response.Writer, req *request.Request) {
+		id = RequestIDFromContext(req.Context())
+	})(nil, req)
+
+	return id
+}
+
+func TestRequestID(t *testing.T) {
+	// Test: the client's ID is passed on
+	req := newRequest(t, "GET / HTTP/1.1\r\nHost: x\r\nX-Request-Id: abc-123_4.5\r\n\r\n")
+	assert.Equal(t, "abc-123_4.5", idOf(req))
+	assert.Equal(t, "abc-123_4.5", req.Headers.Get("x-request-id"))
+
+	// Test: an ID is generated and set in the header for the upstream
+	req = newRequest(t, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	id := idOf(req)
+	assert.NotEmpty(t, id)
+	assert.Equal(t, id, req.Headers.Get("x-request-id"))
+	assert.NotEqual(t, id, idOf(newRequest(t, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")))
+
+	// Test: unsafe or overlong IDs are replaced
+	for _, bad := range []string{"a b", "a\x01b", "id;evil=1", "<script>", strings.Repeat("a", maxRequestIDLen+1)} {
+		req = newRequest(t, "GET / HTTP/1.1\r\nHost: x\r\nX-Request-Id: "+bad+"\r\n\r\n")
+		id := idOf(req)
+		assert.NotEqual(t, bad, id)
+		assert.True(t, validRequestID(id), id)
+		assert.Equal(t, id, req.Headers.Get("x-request-id"))
+	}
+
+	// Test: no ID outside RequestID
+	assert.Empty(t, RequestIDFromContext(context.Background()))
+}
+
+func TestTimeout(t *testing.T) {
+	// Test: the context is done after the timeout
+	req := newRequest(t, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	var err error
+	Timeout(20*time.Millisecond, func(w *response.Writer, req *request.Request) {
+		_, ok := req.Context().Deadline()
+		assert.True(t, ok)
+
+		select {
+		case <-req.Context().Done():
+			err = req.Context().Err()
+		case <-time.After(time.Second):
+		}
+	})(nil, req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Test: cancelling the request's own context still gets through
+	ctx, cancel := context.WithCancel(context.Background())
+	req = newRequest(t, "GET / HTTP/1.1\r\nHost: x\r\n\r\n").WithContext(ctx)
+	err = nil
+	Timeout(time.Hour, func(w *response.Writer, req *request.Request) {
+		cancel()
+		<-req.Context().Done()
+		err = req.Context().Err()
+	})(nil, req)
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/request"
+)
+
+// Upstream is one of the servers a proxy forwards requests to.
+type Upstream struct {
+	// URL is prefixed to the path of every request sent to the upstream.
+	URL *url.URL
+
+	// Requests in flight.
+	active atomic.Int64
+	// Set by the active health checks.
+	unhealthy atomic.Bool
+	// Consecutive failed requests, for passive ejection.
+	failures atomic.Int64
+	// Unix nanoseconds until which the upstream is ejected.
+	ejectedUntil atomic.Int64
+}
+
+func newUpstream(target string) (*Upstream, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream url %v: %w", target, err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid upstream url %v: scheme must be http or https", target)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream url %v: missing host", target)
+	}
+
+	return &Upstream{URL: u}, nil
+}
+
+// Available reports whether the upstream should get requests, i.e. it passes
+// its health checks and hasn't been ejected for failing requests.
+func (u *Upstream) Available() bool {
+	return !u.unhealthy.Load() && time.Now().UnixNano() >= u.ejectedUntil.Load()
+}
+
+// ActiveRequests returns the number of requests in flight to the upstream.
+func (u *Upstream) ActiveRequests() int64 {
+	return u.active.Load()
+}
+
+// Balancer picks the upstream a request is forwarded to.
+type Balancer interface {
+	// Pick returns one of upstreams for req. upstreams is never empty and
+	// only holds upstreams that are available.
+	Pick(upstreams []*Upstream, req *request.Request) *Upstream
+}
+
+// RoundRobin hands requests to each upstream in turn.
+type RoundRobin struct {
+	next atomic.Uint64
+}
+
+func (rr *RoundRobin) Pick(upstreams []*Upstream, req *request.Request) *Upstream {
+	n := rr.next.Add(1) - 1
+	return upstreams[n%uint64(len(upstreams))]
+}
+
+// LeastConnections hands requests to the upstream with the fewest requests
+// in flight, which suits requests that vary a lot in how long they take.
+type LeastConnections struct {
+	// Breaks ties so that idle upstreams share the load.
+	tieBreaker RoundRobin
+}
+
+func (lc *LeastConnections) Pick(upstreams []*Upstream, req *request.Request) *Upstream {
+	var least []*Upstream
+	leastActive := int64(-1)
+
+	for _, u := range upstreams {
+		active := u.ActiveRequests()
+
+		switch {
+		case leastActive < 0 || active < leastActive:
+			least = append(least[:0], u)
+			leastActive = active
+		case active == leastActive:
+			least = append(least, u)
+		}
+	}
+
+	return lc.tieBreaker.Pick(least, req)
+}
+
+// Number of points each upstream gets on the hash ring. More points spread
+// keys more evenly.
+const DefaultReplicas = 100
+
+// ConsistentHash sends all requests with the same value of a header to the
+// same upstream, e.g. to keep a session on one instance. Upstreams are
+// placed on a hash ring, so when one goes away only the keys it owned move
+// to other upstreams.
+type ConsistentHash struct {
+	// Header whose value is hashed. Requests without it are hashed on the
+	// client's IP address instead.
+	Header string
+	// Replicas is the number of points each upstream gets on the ring.
+	Replicas int
+
+	mu sync.Mutex
+	// The ring is rebuilt whenever the set of available upstreams changes.
+	ringKey string
+	ring    []ringPoint
+}
+
+type ringPoint struct {
+	hash     uint32
+	upstream *Upstream
+}
+
+// NewConsistentHash returns a balancer hashing on the value of header.
+func NewConsistentHash(header string) *ConsistentHash {
+	return &ConsistentHash{
+		Header:   header,
+		Replicas: DefaultReplicas,
+	}
+}
+
+func (ch *ConsistentHash) Pick(upstreams []*Upstream, req *request.Request) *Upstream {
+	key := req.Headers.Get(ch.Header)
+	if key == "" {
+		key = clientIP(req)
+	}
+
+	ring := ch.ringFor(upstreams)
+	hash := crc32.ChecksumIEEE([]byte(key))
+
+	// The first point clockwise from the key's hash owns the key.
+	i := sort.Search(len(ring), func(i int) bool {
+		return ring[i].hash >= hash
+	})
+	if i == len(ring) {
+		i = 0
+	}
+
+	return ring[i].upstream
+}
+
+func (ch *ConsistentHash) ringFor(upstreams []*Upstream) []ringPoint {
+	names := make([]string, len(upstreams))
+	for i, u := range upstreams {
+		names[i] = u.URL.String()
+	}
+	ringKey := strings.Join(names, " ")
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ring := ch.ring; ring != nil && ch.ringKey == ringKey {
+		return ring
+	}
+
+	replicas := ch.Replicas
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+
+	// Points only depend on the upstream's URL, so every upstream keeps
+	// its place on the ring when others come and go.
+	ring := make([]ringPoint, 0, len(upstreams)*replicas)
+	for _, u := range upstreams {
+		for i := range replicas {
+			ring = append(ring, ringPoint{
+				hash:     crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + "-" + u.URL.String())),
+				upstream: u,
+			})
+		}
+	}
+
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+
+	ch.ring = ring
+	ch.ringKey = ringKey
+
+	return ring
+}
+
+func clientIP(req *request.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return ip
+}
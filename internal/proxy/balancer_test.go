@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/conntest"
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubUpstream is a local stand-in for an upstream instance that answers
+// with its own name and can be made to fail.
+type stubUpstream struct {
+	*httptest.Server
+	name    string
+	failing atomic.Bool
+	hits    atomic.Int64
+}
+
+func newStubUpstream(t *testing.T, name string) *stubUpstream {
+	t.Helper()
+
+	s := &stubUpstream{name: name}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if r.URL.Path == "/healthz" {
+			return
+		}
+
+		s.hits.Add(1)
+		io.WriteString(w, s.name)
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func upstreamsOf(t *testing.T, stubs ...*stubUpstream) []*Upstream {
+	t.Helper()
+
+	var upstreams []*Upstream
+	for _, s := range stubs {
+		u, err := newUpstream(s.URL)
+		require.NoError(t, err)
+		upstreams = append(upstreams, u)
+	}
+
+	return upstreams
+}
+
+func get(t *testing.T, p *ReverseProxy, raw string) (int, string) {
+	t.Helper()
+
+	resp := serve(t, p.Handle, raw)
+	return resp.StatusCode, conntest.ReadBody(t, resp.Body)
+}
+
+func TestRoundRobin(t *testing.T) {
+	a, b, c := newStubUpstream(t, "a"), newStubUpstream(t, "b"), newStubUpstream(t, "c")
+	p, err := NewLoadBalancedProxy([]string{a.URL, b.URL, c.URL}, &RoundRobin{})
+	require.NoError(t, err)
+
+	// Test: each upstream gets its turn
+	var names []string
+	for range 6 {
+		_, body := get(t, p, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		names = append(names, body)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a", "b", "c"}, names)
+}
+
+func TestLeastConnections(t *testing.T) {
+	upstreams := upstreamsOf(t, newStubUpstream(t, "a"), newStubUpstream(t, "b"), newStubUpstream(t, "c"))
+	lc := &LeastConnections{}
+	req := &request.Request{Headers: headers.NewHeaders()}
+
+	// Test: the upstream with the fewest requests in flight is picked
+	upstreams[0].active.Store(5)
+	upstreams[1].active.Store(2)
+	upstreams[2].active.Store(7)
+	assert.Same(t, upstreams[1], lc.Pick(upstreams, req))
+
+	// Test: ties are shared
+	upstreams[0].active.Store(2)
+	first := lc.Pick(upstreams, req)
+	second := lc.Pick(upstreams, req)
+	assert.NotSame(t, first, second)
+	assert.NotSame(t, upstreams[2], first)
+	assert.NotSame(t, upstreams[2], second)
+}
+
+func TestConsistentHash(t *testing.T) {
+	upstreams := upstreamsOf(t, newStubUpstream(t, "a"), newStubUpstream(t, "b"), newStubUpstream(t, "c"), newStubUpstream(t, "d"))
+	ch := NewConsistentHash("X-Session")
+
+	requestFor := func(session string) *request.Request {
+		return &request.Request{Headers: headers.Headers{"x-session": session}}
+	}
+
+	// Test: the same key always goes to the same upstream
+	owners := map[string]*Upstream{}
+	for i := range 200 {
+		session := fmt.Sprintf("session-%d", i)
+		owners[session] = ch.Pick(upstreams, requestFor(session))
+		assert.Same(t, owners[session], ch.Pick(upstreams, requestFor(session)))
+	}
+
+	// Test: keys are spread across upstreams
+	counts := map[*Upstream]int{}
+	for _, u := range owners {
+		counts[u]++
+	}
+	assert.Len(t, counts, 4)
+
+	// Test: only the keys of a removed upstream move
+	removed := upstreams[1]
+	remaining := []*Upstream{upstreams[0], upstreams[2], upstreams[3]}
+	for session, owner := range owners {
+		newOwner := ch.Pick(remaining, requestFor(session))
+		if owner != removed {
+			assert.Same(t, owner, newOwner)
+		} else {
+			assert.NotSame(t, removed, newOwner)
+		}
+	}
+
+	// Test: requests without the header are hashed on the client address
+	req := &request.Request{Headers: headers.NewHeaders(), RemoteAddr: "192.0.2.1:1234"}
+	other := &request.Request{Headers: headers.NewHeaders(), RemoteAddr: "192.0.2.1:5678"}
+	assert.Same(t, ch.Pick(upstreams, req), ch.Pick(upstreams, other))
+}
+
+func TestPassiveEjection(t *testing.T) {
+	a, b := newStubUpstream(t, "a"), newStubUpstream(t, "b")
+	p, err := NewLoadBalancedProxy([]string{a.URL, b.URL}, &RoundRobin{})
+	require.NoError(t, err)
+	p.MaxFails = 2
+	p.EjectDuration = time.Hour
+
+	// Test: an upstream is ejected after consecutive failures
+	b.failing.Store(true)
+	for range 4 {
+		get(t, p, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	}
+	assert.False(t, p.Upstreams[1].Available())
+
+	a.hits.Store(0)
+	for range 4 {
+		status, body := get(t, p, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "a", body)
+	}
+	assert.Equal(t, int64(4), a.hits.Load())
+
+	// Test: no upstream left
+	a.failing.Store(true)
+	for range 2 {
+		get(t, p, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	}
+	status, _ := get(t, p, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 503, status)
+}
+
+func TestActiveHealthChecks(t *testing.T) {
+	a, b := newStubUpstream(t, "a"), newStubUpstream(t, "b")
+	p, err := NewLoadBalancedProxy([]string{a.URL, b.URL}, &RoundRobin{})
+	require.NoError(t, err)
+	defer p.Close()
+
+	b.failing.Store(true)
+	p.StartHealthChecks(HealthCheck{
+		Path:     "/healthz",
+		Interval: 10 * time.Millisecond,
+		Timeout:  time.Second,
+	})
+
+	// Test: failing upstream is taken out
+	assert.Eventually(t, func() bool {
+		return !p.Upstreams[1].Available()
+	}, time.Second, 5*time.Millisecond)
+	assert.True(t, p.Upstreams[0].Available())
+
+	// Test: recovered upstream is put back
+	b.failing.Store(false)
+	assert.Eventually(t, func() bool {
+		return p.Upstreams[1].Available()
+	}, time.Second, 5*time.Millisecond)
+
+	// Test: zero Interval and Timeout fall back to the defaults
+	zero, err := NewReverseProxy(b.URL)
+	require.NoError(t, err)
+	defer zero.Close()
+	b.failing.Store(true)
+	zero.StartHealthChecks(HealthCheck{Path: "/healthz"})
+	assert.Eventually(t, func() bool {
+		return !zero.Upstreams[0].Available()
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestHealthChecksClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	// The upstream keeps conns alive and tells when the client closes one.
+	checked := make(chan struct{}, 1)
+	closed := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				br := bufio.NewReader(conn)
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil {
+						closed <- struct{}{}
+						return
+					}
+					if line == "\r\n" {
+						io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+						checked <- struct{}{}
+					}
+				}
+			}()
+		}
+	}()
+
+	p, err := NewReverseProxy("http://" + ln.Addr().String())
+	require.NoError(t, err)
+	p.StartHealthChecks(HealthCheck{
+		Path:     "/healthz",
+		Interval: time.Hour,
+		Timeout:  time.Second,
+	})
+	<-checked
+
+	// Test: the conns of the checks are closed along with the proxy
+	require.NoError(t, p.Close())
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("health check conn left open")
+	}
+}
@@ -0,0 +1,523 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/client"
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+)
+
+// Default limit on the size of a single cached response.
+const DefaultMaxEntrySize int64 = 1 << 20
+
+// Debug header telling whether the response came from the cache.
+const cacheStatusHeader = "X-Cache"
+
+// Values of the X-Cache header.
+const (
+	// The response was served from the cache.
+	cacheHit = "HIT"
+	// The response came from the upstream.
+	cacheMiss = "MISS"
+	// The cached response was served after the upstream confirmed it is
+	// still valid.
+	cacheRevalidated = "REVALIDATED"
+)
+
+// Cache is an in-memory shared cache of the upstream responses, refer to
+// RFC 9111. Once the cached responses take up more than MaxSize bytes, the
+// least recently used ones are evicted.
+type Cache struct {
+	// MaxSize is the limit on the total size of the cached responses.
+	MaxSize int64
+	// MaxEntrySize is the limit on the size of a single response. Bigger
+	// responses are relayed without being cached.
+	MaxEntrySize int64
+
+	mu sync.Mutex
+	// Cached responses, most recently used first.
+	lru *list.List
+	// Cached responses by cache key. There is one for each combination of
+	// the request headers the upstream varies on.
+	entries map[string][]*cacheEntry
+	size    int64
+
+	now func() time.Time
+}
+
+// NewCache returns a cache holding up to maxSize bytes of responses.
+func NewCache(maxSize int64) *Cache {
+	return &Cache{
+		MaxSize:      maxSize,
+		MaxEntrySize: min(DefaultMaxEntrySize, maxSize),
+		lru:          list.New(),
+		entries:      make(map[string][]*cacheEntry),
+		now:          time.Now,
+	}
+}
+
+// cacheEntry is a cached response. Entries are never modified once they are
+// in the cache, revalidating one replaces it.
+type cacheEntry struct {
+	key string
+	// The request headers the upstream varies on, by lowercase name.
+	vary map[string]string
+
+	statusCode int
+	header     headers.Headers
+	body       []byte
+	cc         cacheControl
+
+	// When we sent the request and got the response.
+	requestTime  time.Time
+	responseTime time.Time
+
+	size int64
+	elem *list.Element
+}
+
+func newCacheEntry(key string, req *request.Request, resp *client.Response, body []byte, requestTime, responseTime time.Time) *cacheEntry {
+	vary := make(map[string]string)
+	for _, name := range varyNames(resp.Headers) {
+		vary[name] = normalizeVaryValue(req.Headers.Get(name))
+	}
+
+	header := maps.Clone(resp.Headers)
+	removeHopByHopHeaders(header)
+	header.Del("Content-Length")
+
+	e := &cacheEntry{
+		key:          key,
+		vary:         vary,
+		statusCode:   resp.StatusCode,
+		header:       header,
+		body:         body,
+		requestTime:  requestTime,
+		responseTime: responseTime,
+	}
+	e.update()
+
+	return e
+}
+
+// update recomputes what is derived from the header.
+func (e *cacheEntry) update() {
+	e.cc = parseCacheControl(e.header.Get("Cache-Control"))
+
+	e.size = int64(len(e.key) + len(e.body))
+	for key, value := range e.header {
+		e.size += int64(len(key) + len(value))
+	}
+}
+
+// matches reports whether the entry was cached for a request with the same
+// values of the headers the upstream varies on. Refer to RFC 9111 4.1.
+func (e *cacheEntry) matches(req *request.Request) bool {
+	for name, value := range e.vary {
+		if normalizeVaryValue(req.Headers.Get(name)) != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validators returns the conditional headers revalidating the entry, or nil
+// if it can't be revalidated. Refer to RFC 9111 4.3.1.
+func (e *cacheEntry) validators() headers.Headers {
+	h := headers.NewHeaders()
+	if etag := e.header.Get("ETag"); etag != "" {
+		h.Set("If-None-Match", etag)
+	}
+	if lastModified := e.header.Get("Last-Modified"); lastModified != "" {
+		h.Set("If-Modified-Since", lastModified)
+	}
+
+	if len(h) == 0 {
+		return nil
+	}
+
+	return h
+}
+
+// revalidated returns a copy of the entry with the header updated from the
+// upstream's 304 response. Refer to RFC 9111 4.3.4.
+func (e *cacheEntry) revalidated(h headers.Headers, requestTime, responseTime time.Time) *cacheEntry {
+	updated := *e
+	updated.header = maps.Clone(e.header)
+	updated.requestTime = requestTime
+	updated.responseTime = responseTime
+	updated.elem = nil
+
+	h = maps.Clone(h)
+	removeHopByHopHeaders(h)
+	h.Del("Content-Length")
+
+	for key, value := range h {
+		updated.header.Replace(key, value)
+	}
+	updated.update()
+
+	return &updated
+}
+
+// response returns the entry as a response to relay to the client.
+func (e *cacheEntry) response(now time.Time, cacheStatus string) *client.Response {
+	h := maps.Clone(e.header)
+	h.Replace("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+	h.Replace(cacheStatusHeader, cacheStatus)
+
+	return &client.Response{
+		StatusCode:    e.statusCode,
+		Headers:       h,
+		ContentLength: int64(len(e.body)),
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+	}
+}
+
+// Headers of the 200 response that a 304 repeats. Refer to RFC 9110 15.4.5.
+var notModifiedHeaders = []string{
+	"Cache-Control",
+	"Content-Location",
+	"Date",
+	"ETag",
+	"Expires",
+	"Vary",
+	"Age",
+	cacheStatusHeader,
+}
+
+// notModified reports whether the conditional headers of req say the client
+// has the entry already. Refer to RFC 9111 4.3.2 and RFC 9110 13.2.2.
+func (e *cacheEntry) notModified(req *request.Request) bool {
+	// Conditions only apply to successful responses.
+	if e.statusCode != 200 {
+		return false
+	}
+
+	if ifNoneMatch := req.Headers.Get("if-none-match"); ifNoneMatch != "" {
+		return matchesETag(ifNoneMatch, e.header.Get("ETag"))
+	}
+
+	ifModifiedSince, err := http.ParseTime(req.Headers.Get("if-modified-since"))
+	if err != nil {
+		return false
+	}
+
+	// Without Last-Modified, the response is as old as it says it is.
+	lastModified, err := http.ParseTime(e.header.Get("Last-Modified"))
+	if err != nil {
+		lastModified = e.date()
+	}
+
+	return !lastModified.After(ifModifiedSince)
+}
+
+// notModifiedResponse returns the 304 answering a request the entry
+// matches the conditions of.
+func (e *cacheEntry) notModifiedResponse(now time.Time, cacheStatus string) *client.Response {
+	full := e.response(now, cacheStatus)
+
+	h := headers.NewHeaders()
+	for _, name := range notModifiedHeaders {
+		if value := full.Headers.Get(name); value != "" {
+			h.Set(name, value)
+		}
+	}
+
+	return &client.Response{
+		StatusCode:    304,
+		Headers:       h,
+		ContentLength: -1,
+		Body:          http.NoBody,
+	}
+}
+
+// matchesETag reports whether etag is in the comma-separated list of an
+// If-None-Match header, which compares entity tags weakly. Refer to RFC 9110
+// 13.1.2.
+func matchesETag(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+
+		if etag != "" && strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookup returns the entry stored for key that matches req, or nil.
+func (c *Cache) lookup(key string, req *request.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := c.entries[key]
+
+	// Prefer the most recent match.
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.matches(req) {
+			c.lru.MoveToFront(e.elem)
+			return e
+		}
+	}
+
+	return nil
+}
+
+// store adds e to the cache, replacing the entry it is a newer version of,
+// and evicts the least recently used entries if the cache is full.
+func (c *Cache) store(e *cacheEntry) {
+	if e.size > c.MaxEntrySize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, old := range c.entries[e.key] {
+		if maps.Equal(old.vary, e.vary) {
+			c.remove(old)
+			break
+		}
+	}
+
+	e.elem = c.lru.PushFront(e)
+	c.entries[e.key] = append(c.entries[e.key], e)
+	c.size += e.size
+
+	for c.size > c.MaxSize {
+		c.remove(c.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+// invalidate removes all entries stored for key.
+func (c *Cache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range c.entries[key] {
+		c.lru.Remove(e.elem)
+		c.size -= e.size
+	}
+	delete(c.entries, key)
+}
+
+// remove must be called with mu held.
+func (c *Cache) remove(e *cacheEntry) {
+	c.lru.Remove(e.elem)
+	c.size -= e.size
+
+	entries := c.entries[e.key]
+	for i, other := range entries {
+		if other == e {
+			entries = append(entries[:i], entries[i+1:]...)
+			break
+		}
+	}
+
+	if len(entries) == 0 {
+		delete(c.entries, e.key)
+	} else {
+		c.entries[e.key] = entries
+	}
+}
+
+// storable reports whether resp to req may be cached. Refer to RFC 9111 3.
+func storable(req *request.Request, reqCC cacheControl, resp *client.Response) bool {
+	if req.RequestLine.Method != "GET" {
+		return false
+	}
+
+	switch resp.StatusCode {
+	// Partial responses would have to be combined, which we don't do.
+	case 206, 304:
+		return false
+	}
+
+	if resp.StatusCode < 200 {
+		return false
+	}
+
+	cc := parseCacheControl(resp.Headers.Get("Cache-Control"))
+
+	// We are a shared cache, so responses meant for a single user are off
+	// limits too.
+	if reqCC.has("no-store") || cc.has("no-store") || cc.has("private") {
+		return false
+	}
+
+	// Refer to RFC 9111 3.5.
+	if req.Headers.Get("authorization") != "" &&
+		!cc.has("must-revalidate") && !cc.has("public") && !cc.has("s-maxage") {
+		return false
+	}
+
+	// Vary: * never matches another request.
+	for _, name := range varyNames(resp.Headers) {
+		if name == "*" {
+			return false
+		}
+	}
+
+	explicit := cc.has("max-age") || cc.has("s-maxage") || resp.Headers.Get("Expires") != ""
+	if !explicit && !cc.has("public") && !heuristicallyCacheable(resp.StatusCode) {
+		return false
+	}
+
+	// Without validators the entry is useless once it's stale.
+	return explicit || resp.Headers.Get("ETag") != "" || resp.Headers.Get("Last-Modified") != ""
+}
+
+// varyNames returns the lowercase names of the request headers listed in
+// the Vary header.
+func varyNames(h headers.Headers) []string {
+	var names []string
+	for _, name := range strings.Split(h.Get("Vary"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// normalizeVaryValue collapses the whitespace of a header value, so values
+// differing only in whitespace match.
+func normalizeVaryValue(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// cacheKey returns the key of the responses to req, its effective URI.
+func cacheKey(req *request.Request) string {
+	return req.Headers.Get("host") + req.RequestLine.RequestTarget
+}
+
+// isSafeMethod reports whether method doesn't change the upstream's state.
+// Refer to RFC 9110 9.2.1.
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+
+	return false
+}
+
+// handleCached serves req from the cache if it can, and forwards it to an
+// upstream otherwise.
+func (p *ReverseProxy) handleCached(w *response.Writer, req *request.Request) {
+	c := p.Cache
+	key := cacheKey(req)
+	method := req.RequestLine.Method
+
+	if method != "GET" && method != "HEAD" {
+		resp, ok := p.forward(w, req, nil)
+		if !ok {
+			return
+		}
+		defer resp.Body.Close()
+
+		// The cached responses are likely out of date after a successful
+		// unsafe request. Refer to RFC 9111 4.4.
+		if !isSafeMethod(method) && resp.StatusCode < 400 {
+			c.invalidate(key)
+		}
+
+		p.relay(w, req, resp)
+		return
+	}
+
+	reqCC := requestCacheControl(req)
+
+	// HEAD requests are answered from the cached GET responses.
+	entry := c.lookup(key, req)
+	if entry != nil && entry.satisfies(reqCC, c.now()) {
+		p.serveEntry(w, req, entry, c.now(), cacheHit)
+		return
+	}
+
+	// Refer to RFC 9111 5.2.1.7.
+	if reqCC.has("only-if-cached") {
+		writeError(w, response.StatusGatewayTimeout, "gateway timeout")
+		return
+	}
+
+	// Our validators replace the client's, whose conditions are evaluated
+	// against what the upstream answers.
+	var validators headers.Headers
+	if entry != nil {
+		validators = entry.validators()
+	}
+
+	requestTime := c.now()
+	resp, ok := p.forward(w, req, validators)
+	if !ok {
+		return
+	}
+	defer resp.Body.Close()
+	responseTime := c.now()
+
+	if validators != nil && resp.StatusCode == 304 {
+		updated := entry.revalidated(resp.Headers, requestTime, responseTime)
+		c.store(updated)
+
+		p.serveEntry(w, req, updated, responseTime, cacheRevalidated)
+		return
+	}
+
+	if storable(req, reqCC, resp) && resp.ContentLength <= c.MaxEntrySize {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, c.MaxEntrySize+1))
+		if err != nil {
+			log.Printf("failed to read upstream body: %v", err)
+			writeError(w, response.StatusBadGateway, "bad gateway")
+			return
+		}
+
+		if int64(len(body)) <= c.MaxEntrySize {
+			e := newCacheEntry(key, req, resp, body, requestTime, responseTime)
+			c.store(e)
+
+			p.serveEntry(w, req, e, responseTime, cacheMiss)
+			return
+		}
+
+		// Too big to cache, relay what has been read along with the rest.
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	}
+
+	resp.Headers.Replace(cacheStatusHeader, cacheMiss)
+	p.relay(w, req, resp)
+}
+
+// serveEntry answers req with e, or with 304 if the client has e already.
+func (p *ReverseProxy) serveEntry(w *response.Writer, req *request.Request, e *cacheEntry, now time.Time, cacheStatus string) {
+	if e.notModified(req) {
+		p.relay(w, req, e.notModifiedResponse(now, cacheStatus))
+		return
+	}
+
+	p.relay(w, req, e.response(now, cacheStatus))
+}
@@ -0,0 +1,274 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/conntest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	// The upstream dates its responses with the cache's clock, so moving the
+	// clock ages them.
+	var nowNano atomic.Int64
+	nowNano.Store(time.Now().UnixNano())
+	now := func() time.Time { return time.Unix(0, nowNano.Load()) }
+	advance := func(d time.Duration) { nowNano.Add(int64(d)) }
+
+	lastModified := now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+
+	var hits atomic.Int32
+	var lastIfNoneMatch atomic.Value
+	lastIfNoneMatch.Store("")
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		lastIfNoneMatch.Store(r.Header.Get("If-None-Match"))
+		w.Header().Set("Date", now().UTC().Format(http.TimeFormat))
+
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			io.WriteString(w, "fresh body")
+		case "/dated":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Last-Modified", lastModified)
+			io.WriteString(w, "dated body")
+		case "/expires":
+			w.Header().Set("Expires", now().Add(time.Minute).UTC().Format(http.TimeFormat))
+			io.WriteString(w, "expires body")
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+			io.WriteString(w, "secret")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+			io.WriteString(w, "mine")
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			io.WriteString(w, "hello in "+r.Header.Get("Accept-Language"))
+		case "/cookies":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+			w.Header().Add("Set-Cookie", "b=2")
+			io.WriteString(w, "cookies")
+		case "/big":
+			w.Header().Set("Cache-Control", "max-age=60")
+			io.WriteString(w, strings.Repeat("x", 400))
+		default:
+			w.Header().Set("Cache-Control", "max-age=60")
+			io.WriteString(w, r.Method+" "+r.URL.Path)
+		}
+	}))
+	defer upstream.Close()
+
+	p, err := NewReverseProxy(upstream.URL)
+	require.NoError(t, err)
+	p.Cache = NewCache(1 << 20)
+
+	p.Cache.now = now
+
+	get := func(target string, extra ...string) *http.Response {
+		raw := "GET " + target + " HTTP/1.1\r\nHost: example.com\r\n" + strings.Join(extra, "") + "\r\n"
+		return serve(t, p.Handle, raw)
+	}
+
+	// Test: miss, then hit
+	resp := get("/fresh")
+	assert.Equal(t, cacheMiss, resp.Header.Get("X-Cache"))
+	assert.Equal(t, "fresh body", conntest.ReadBody(t, resp.Body))
+	resp = get("/fresh")
+	assert.Equal(t, cacheHit, resp.Header.Get("X-Cache"))
+	assert.Equal(t, "fresh body", conntest.ReadBody(t, resp.Body))
+	assert.Equal(t, int32(1), hits.Load())
+
+	// Test: Age grows while the response sits in the cache
+	advance(10 * time.Second)
+	resp = get("/fresh")
+	assert.Equal(t, cacheHit, resp.Header.Get("X-Cache"))
+	assert.Equal(t, "10", resp.Header.Get("Age"))
+
+	// Test: HEAD is answered from the cached GET response
+	resp = serve(t, p.Handle, "HEAD /fresh HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, cacheHit, resp.Header.Get("X-Cache"))
+	assert.Equal(t, int32(1), hits.Load())
+
+	// Test: stale responses are revalidated with their ETag
+	advance(time.Minute)
+	resp = get("/fresh")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, cacheRevalidated, resp.Header.Get("X-Cache"))
+	assert.Equal(t, "fresh body", conntest.ReadBody(t, resp.Body))
+	assert.Equal(t, `"v1"`, lastIfNoneMatch.Load())
+	assert.Equal(t, int32(2), hits.Load())
+
+	// Test: revalidation makes the response fresh again
+	resp = get("/fresh")
+	assert.Equal(t, cacheHit, resp.Header.Get("X-Cache"))
+	assert.Equal(t, int32(2), hits.Load())
+
+	// Test: the client asks for revalidation
+	resp = get("/fresh", "Cache-Control: no-cache\r\n")
+	assert.Equal(t, cacheRevalidated, resp.Header.Get("X-Cache"))
+	resp = get("/fresh", "Pragma: no-cache\r\n")
+	assert.Equal(t, cacheRevalidated, resp.Header.Get("X-Cache"))
+	assert.Equal(t, int32(4), hits.Load())
+
+	// Test: the client accepts responses of a limited age only
+	advance(30 * time.Second)
+	resp = get("/fresh", "Cache-Control: max-age=10\r\n")
+	assert.Equal(t, cacheRevalidated, resp.Header.Get("X-Cache"))
+
+	// Test: fresh hits answer the client's conditional requests themselves
+	hits.Store(0)
+	resp = get("/fresh", "If-None-Match: \"v0\", W/\"v1\"\r\n")
+	assert.Equal(t, 304, resp.StatusCode)
+	assert.Equal(t, cacheHit, resp.Header.Get("X-Cache"))
+	assert.Equal(t, `"v1"`, resp.Header.Get("ETag"))
+	assert.Empty(t, conntest.ReadBody(t, resp.Body))
+	resp = get("/fresh", "If-None-Match: \"v0\"\r\n")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "fresh body", conntest.ReadBody(t, resp.Body))
+	resp = get("/fresh", "If-Modified-Since: "+now().UTC().Format(http.TimeFormat)+"\r\n")
+	assert.Equal(t, 304, resp.StatusCode)
+	assert.Equal(t, int32(0), hits.Load())
+
+	// Test: If-Modified-Since is checked against Last-Modified
+	get("/dated")
+	resp = get("/dated", "If-Modified-Since: "+lastModified+"\r\n")
+	assert.Equal(t, 304, resp.StatusCode)
+	resp = get("/dated", "If-Modified-Since: "+now().Add(-2*time.Hour).UTC().Format(http.TimeFormat)+"\r\n")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "dated body", conntest.ReadBody(t, resp.Body))
+	assert.Equal(t, int32(1), hits.Load())
+
+	// Test: after revalidating with our validators, the client's conditions
+	// are evaluated against the entry
+	advance(time.Minute)
+	resp = get("/fresh", "If-None-Match: \"v1\"\r\n")
+	assert.Equal(t, 304, resp.StatusCode)
+	assert.Equal(t, cacheRevalidated, resp.Header.Get("X-Cache"))
+	assert.Equal(t, `"v1"`, lastIfNoneMatch.Load())
+	advance(time.Minute)
+	resp = get("/fresh", "If-None-Match: \"v0\"\r\n")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, cacheRevalidated, resp.Header.Get("X-Cache"))
+	assert.Equal(t, "fresh body", conntest.ReadBody(t, resp.Body))
+	assert.Equal(t, `"v1"`, lastIfNoneMatch.Load())
+	assert.Equal(t, int32(3), hits.Load())
+
+	// Test: freshness from Expires
+	resp = get("/expires")
+	assert.Equal(t, cacheMiss, resp.Header.Get("X-Cache"))
+	resp = get("/expires")
+	assert.Equal(t, cacheHit, resp.Header.Get("X-Cache"))
+	assert.Equal(t, "expires body", conntest.ReadBody(t, resp.Body))
+
+	// Test: no-store and private responses aren't cached
+	hits.Store(0)
+	for _, target := range []string{"/no-store", "/private"} {
+		get(target)
+		resp = get(target)
+		assert.Equal(t, cacheMiss, resp.Header.Get("X-Cache"))
+	}
+	assert.Equal(t, int32(4), hits.Load())
+
+	// Test: one response per value of the headers the upstream varies on
+	hits.Store(0)
+	resp = get("/vary", "Accept-Language: en\r\n")
+	assert.Equal(t, "hello in en", conntest.ReadBody(t, resp.Body))
+	resp = get("/vary", "Accept-Language: fr\r\n")
+	assert.Equal(t, cacheMiss, resp.Header.Get("X-Cache"))
+	assert.Equal(t, "hello in fr", conntest.ReadBody(t, resp.Body))
+	resp = get("/vary", "Accept-Language: en\r\n")
+	assert.Equal(t, cacheHit, resp.Header.Get("X-Cache"))
+	assert.Equal(t, "hello in en", conntest.ReadBody(t, resp.Body))
+	assert.Equal(t, int32(2), hits.Load())
+
+	// Test: Set-Cookie lines are relayed and replayed one by one
+	cookies := []string{"a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", "b=2"}
+	resp = get("/cookies")
+	assert.Equal(t, cacheMiss, resp.Header.Get("X-Cache"))
+	assert.Equal(t, cookies, resp.Header.Values("Set-Cookie"))
+	resp = get("/cookies")
+	assert.Equal(t, cacheHit, resp.Header.Get("X-Cache"))
+	assert.Equal(t, cookies, resp.Header.Values("Set-Cookie"))
+
+	// Test: only-if-cached without a cached response
+	resp = get("/uncached", "Cache-Control: only-if-cached\r\n")
+	assert.Equal(t, 504, resp.StatusCode)
+
+	// Test: unsafe requests invalidate the cached responses
+	resp = get("/resource")
+	assert.Equal(t, cacheMiss, resp.Header.Get("X-Cache"))
+	resp = serve(t, p.Handle, "DELETE /resource HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, "DELETE /resource", conntest.ReadBody(t, resp.Body))
+	resp = get("/resource")
+	assert.Equal(t, cacheMiss, resp.Header.Get("X-Cache"))
+
+	// Test: responses over MaxEntrySize are relayed but not cached
+	p.Cache.MaxEntrySize = 100
+	resp = get("/big")
+	assert.Equal(t, strings.Repeat("x", 400), conntest.ReadBody(t, resp.Body))
+	resp = get("/big")
+	assert.Equal(t, cacheMiss, resp.Header.Get("X-Cache"))
+}
+
+func TestCacheEviction(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, strings.Repeat("x", 400))
+	}))
+	defer upstream.Close()
+
+	p, err := NewReverseProxy(upstream.URL)
+	require.NoError(t, err)
+	// Room for two responses, not three.
+	p.Cache = NewCache(1500)
+
+	get := func(target string) string {
+		resp := serve(t, p.Handle, "GET "+target+" HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		conntest.ReadBody(t, resp.Body)
+		return resp.Header.Get("X-Cache")
+	}
+
+	assert.Equal(t, cacheMiss, get("/a"))
+	assert.Equal(t, cacheMiss, get("/b"))
+	assert.Equal(t, cacheHit, get("/a"))
+
+	// Test: the least recently used response is evicted
+	assert.Equal(t, cacheMiss, get("/c"))
+	assert.Equal(t, cacheHit, get("/a"))
+	assert.Equal(t, cacheHit, get("/c"))
+	assert.Equal(t, cacheMiss, get("/b"))
+}
+
+func TestParseCacheControl(t *testing.T) {
+	cc := parseCacheControl(`public, Max-Age=60, no-cache="Set-Cookie, Foo", s-maxage=abc`)
+	assert.True(t, cc.has("public"))
+	assert.Equal(t, "Set-Cookie, Foo", cc["no-cache"])
+
+	maxAge, ok := cc.seconds("max-age")
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, maxAge)
+
+	// Test: invalid values count as zero
+	sMaxAge, ok := cc.seconds("s-maxage")
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), sMaxAge)
+
+	_, ok = cc.seconds("min-fresh")
+	assert.False(t, ok)
+}
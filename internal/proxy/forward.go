@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/client"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+)
+
+// Defaults of the forward proxy.
+const (
+	DefaultDialTimeout = 10 * time.Second
+	DefaultIdleTimeout = 2 * time.Minute
+)
+
+// Ports clients may reach through the forward proxy by default.
+var DefaultAllowedPorts = []int{80, 443}
+
+// Sent to the client once the tunnel of a CONNECT request is open. There are
+// no headers, a 2xx response to CONNECT can't have a body.
+const connectionEstablished = "HTTP/1.1 200 Connection Established\r\n\r\n"
+
+// ForwardProxy makes requests on behalf of clients configured to use it as
+// their proxy. Plain HTTP requests come in absolute-form, e.g.
+// "GET http://example.com/ HTTP/1.1", and everything else, usually HTTPS, is
+// tunneled through CONNECT requests. Refer to RFC 9112 3.2.2 and RFC 9110
+// 9.3.6.
+type ForwardProxy struct {
+	// AllowedPorts are the destination ports clients may reach. Requests to
+	// other ports are refused with 403.
+	AllowedPorts []int
+	// DialTimeout is how long to wait for the connection of a tunnel. Zero
+	// means DefaultDialTimeout.
+	DialTimeout time.Duration
+	// IdleTimeout closes tunnels without traffic in either direction for
+	// that long. Zero means DefaultIdleTimeout.
+	IdleTimeout time.Duration
+	// Client sends the absolute-form requests.
+	Client *client.Client
+}
+
+// NewForwardProxy returns a forward proxy allowing the DefaultAllowedPorts.
+func NewForwardProxy() *ForwardProxy {
+	c := client.New()
+	c.DialTimeout = DefaultDialTimeout
+	c.ResponseHeaderTimeout = DefaultTimeout
+
+	return &ForwardProxy{
+		AllowedPorts: slices.Clone(DefaultAllowedPorts),
+		DialTimeout:  DefaultDialTimeout,
+		IdleTimeout:  DefaultIdleTimeout,
+		Client:       c,
+	}
+}
+
+// Handle is a server.Handler serving absolute-form and CONNECT requests.
+func (p *ForwardProxy) Handle(w *response.Writer, req *request.Request) {
+	if req.RequestLine.Method == "CONNECT" {
+		p.handleConnect(w, req)
+		return
+	}
+
+	target, err := url.Parse(req.RequestLine.RequestTarget)
+	if err != nil || !target.IsAbs() || target.Host == "" {
+		writeError(w, response.StatusBadRequest, "request target must be an absolute URI")
+		return
+	}
+
+	if target.Scheme != "http" && target.Scheme != "https" {
+		writeError(w, response.StatusBadRequest, "unsupported scheme")
+		return
+	}
+
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if !p.allowed(port) {
+		writeError(w, response.StatusForbidden, "destination port not allowed")
+		return
+	}
+
+	outReq, err := newOutboundRequest(req, target.String())
+	if err != nil {
+		log.Printf("failed to create request: %v", err)
+		writeError(w, response.StatusBadRequest, "bad request")
+		return
+	}
+
+	resp, err := p.Client.Do(outReq)
+	if err != nil {
+		log.Printf("failed to make request to %v: %v", outReq.URL, err)
+		writeUpstreamError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	err = relayResponse(w, req, resp, false)
+	if err != nil {
+		log.Printf("failed to relay response from %v: %v", outReq.URL, err)
+	}
+}
+
+// handleConnect opens a tunnel to the authority-form target of req, e.g.
+// "CONNECT example.com:443 HTTP/1.1", and relays bytes both ways until
+// either side is done.
+func (p *ForwardProxy) handleConnect(w *response.Writer, req *request.Request) {
+	target := req.RequestLine.RequestTarget
+
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || host == "" {
+		writeError(w, response.StatusBadRequest, "CONNECT target must be host:port")
+		return
+	}
+
+	if !p.allowed(port) {
+		writeError(w, response.StatusForbidden, "destination port not allowed")
+		return
+	}
+
+	dialer := &net.Dialer{Timeout: p.dialTimeout()}
+	upstream, err := dialer.DialContext(req.Context(), "tcp", target)
+	if err != nil {
+		log.Printf("failed to connect to %v: %v", target, err)
+		writeUpstreamError(w, err)
+		return
+	}
+	defer upstream.Close()
+
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		log.Printf("failed to hijack connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, connectionEstablished)
+	if err != nil {
+		log.Printf("failed to write response to conn: %v", err)
+		return
+	}
+
+	// Clients may start talking to the target, e.g. send their TLS
+	// ClientHello, without waiting for our response.
+	if len(buffered) > 0 {
+		_, err = upstream.Write(buffered)
+		if err != nil {
+			log.Printf("failed to write to %v: %v", target, err)
+			return
+		}
+	}
+
+	t := &tunnel{idleTimeout: p.idleTimeout()}
+	t.touch()
+
+	errs := make(chan error, 2)
+	go func() { errs <- t.pipe(upstream, conn) }()
+	go func() { errs <- t.pipe(conn, upstream) }()
+
+	for range 2 {
+		err := <-errs
+		if err != nil {
+			// Unblock the other direction.
+			conn.Close()
+			upstream.Close()
+		}
+	}
+}
+
+func (p *ForwardProxy) dialTimeout() time.Duration {
+	if p.DialTimeout <= 0 {
+		return DefaultDialTimeout
+	}
+
+	return p.DialTimeout
+}
+
+func (p *ForwardProxy) idleTimeout() time.Duration {
+	if p.IdleTimeout <= 0 {
+		return DefaultIdleTimeout
+	}
+
+	return p.IdleTimeout
+}
+
+func (p *ForwardProxy) allowed(port string) bool {
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+
+	return slices.Contains(p.AllowedPorts, n)
+}
+
+// tunnel tracks the traffic through both directions of a tunnel. A direction
+// that has nothing to read isn't idle as long as the other one is busy,
+// e.g. during a long download.
+type tunnel struct {
+	idleTimeout time.Duration
+	lastActive  atomic.Int64
+}
+
+func (t *tunnel) touch() {
+	t.lastActive.Store(time.Now().UnixNano())
+}
+
+func (t *tunnel) idle() bool {
+	return time.Since(time.Unix(0, t.lastActive.Load())) >= t.idleTimeout
+}
+
+// pipe copies src to dst until src is done, then closes the writing side of
+// dst so the peer sees the end of the stream.
+func (t *tunnel) pipe(dst, src net.Conn) error {
+	buf := make([]byte, chunkSize)
+
+	for {
+		src.SetReadDeadline(time.Now().Add(t.idleTimeout))
+
+		n, err := src.Read(buf)
+		if n > 0 {
+			t.touch()
+
+			dst.SetWriteDeadline(time.Now().Add(t.idleTimeout))
+			_, writeErr := dst.Write(buf[:n])
+			if writeErr != nil {
+				return writeErr
+			}
+			t.touch()
+		}
+
+		if err != nil {
+			if isTimeout(err) && !t.idle() {
+				continue
+			}
+
+			if !errors.Is(err, io.EOF) {
+				return err
+			}
+
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+				return cw.CloseWrite()
+			}
+			return nil
+		}
+	}
+}
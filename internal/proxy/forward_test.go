@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/conntest"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connect sends a CONNECT request for target, plus early data, through p
+// and returns the client side of the tunnel.
+func connect(t *testing.T, p *ForwardProxy, target, early string) (*http.Response, *bufio.Reader, net.Conn) {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+
+	go func() {
+		defer serverConn.Close()
+
+		br := bufio.NewReader(serverConn)
+		req, err := request.RequestHeadersFromReader(br)
+		if err != nil {
+			return
+		}
+
+		w := response.NewWriter(serverConn)
+		w.SetReader(br)
+		p.Handle(&w, req)
+		w.Finish()
+	}()
+
+	go io.WriteString(clientConn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n"+early)
+
+	br := bufio.NewReader(clientConn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	require.NoError(t, err)
+
+	return resp, br, clientConn
+}
+
+func listenEcho(t *testing.T) (string, int) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ln.Addr().String(), ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestForwardProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Path", r.URL.RequestURI())
+		w.Header().Set("X-Proxy-Connection", r.Header.Get("Proxy-Connection"))
+		io.WriteString(w, "hello from "+r.Host)
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	p := NewForwardProxy()
+	p.AllowedPorts = []int{port}
+
+	// Test: absolute-form request
+	resp := serve(t, p.Handle, "GET "+upstream.URL+"/path?q=1 HTTP/1.1\r\nHost: "+u.Host+"\r\nProxy-Connection: keep-alive\r\n\r\n")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "/path?q=1", resp.Header.Get("X-Path"))
+	assert.Equal(t, "", resp.Header.Get("X-Proxy-Connection"))
+	assert.Equal(t, "hello from "+u.Host, conntest.ReadBody(t, resp.Body))
+
+	// Test: origin-form request
+	resp = serve(t, p.Handle, "GET /path HTTP/1.1\r\nHost: "+u.Host+"\r\n\r\n")
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// Test: port not on the allowlist
+	resp = serve(t, p.Handle, "GET http://127.0.0.1:1/ HTTP/1.1\r\nHost: 127.0.0.1:1\r\n\r\n")
+	assert.Equal(t, 403, resp.StatusCode)
+
+	// Test: unsupported scheme
+	resp = serve(t, p.Handle, "GET ftp://"+u.Host+"/ HTTP/1.1\r\nHost: "+u.Host+"\r\n\r\n")
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestForwardProxyConnect(t *testing.T) {
+	addr, port := listenEcho(t)
+
+	p := NewForwardProxy()
+	p.AllowedPorts = []int{port}
+
+	// Test: bytes flow both ways, including those sent right behind the
+	// request
+	resp, br, conn := connect(t, p, addr, "ping")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "200 Connection Established", resp.Status)
+
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(br, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	_, err = io.WriteString(conn, "pong")
+	require.NoError(t, err)
+	_, err = io.ReadFull(br, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "pong", string(buf))
+	conn.Close()
+
+	// Test: a proxy without timeouts set falls back to the defaults instead
+	// of closing tunnels right away
+	literal := &ForwardProxy{AllowedPorts: []int{port}}
+	resp, br, conn = connect(t, literal, addr, "")
+	assert.Equal(t, 200, resp.StatusCode)
+	time.Sleep(10 * time.Millisecond)
+	_, err = io.WriteString(conn, "ping")
+	require.NoError(t, err)
+	_, err = io.ReadFull(br, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+	conn.Close()
+
+	// Test: port not on the allowlist
+	resp, _, _ = connect(t, p, "127.0.0.1:1", "")
+	assert.Equal(t, 403, resp.StatusCode)
+
+	// Test: target that isn't host:port
+	resp, _, _ = connect(t, p, "example.com", "")
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// Test: unreachable target
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddr := ln.Addr().String()
+	ln.Close()
+	p.AllowedPorts = append(p.AllowedPorts, ln.Addr().(*net.TCPAddr).Port)
+	resp, _, _ = connect(t, p, closedAddr, "")
+	assert.Equal(t, 502, resp.StatusCode)
+
+	// Test: idle tunnels are closed
+	p.IdleTimeout = 50 * time.Millisecond
+	resp, br, _ = connect(t, p, addr, "")
+	assert.Equal(t, 200, resp.StatusCode)
+
+	start := time.Now()
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
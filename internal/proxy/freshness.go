@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/request"
+)
+
+// Largest delta-seconds value we keep. Refer to RFC 9111 1.2.2.
+const maxDeltaSeconds = 1 << 31
+
+// Upper bound of the freshness lifetime guessed from Last-Modified. Refer to
+// RFC 9111 4.2.2.
+const maxHeuristicLifetime = 24 * time.Hour
+
+// cacheControl maps the Cache-Control directives to their arguments, which
+// are empty for directives without one.
+type cacheControl map[string]string
+
+// parseCacheControl parses the directives of a Cache-Control field value.
+// Commas inside quoted arguments, e.g. no-cache="Set-Cookie, Foo", don't
+// separate directives.
+func parseCacheControl(value string) cacheControl {
+	var parts []string
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '"':
+			inQuotes = !inQuotes
+		case value[i] == ',' && !inQuotes:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	parts = append(parts, value[start:])
+
+	cc := cacheControl{}
+	for _, part := range parts {
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		// Duplicate directives are invalid, stick with the first one.
+		if _, ok := cc[name]; ok {
+			continue
+		}
+		cc[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+	}
+
+	return cc
+}
+
+// requestCacheControl returns the directives of req. Pragma: no-cache is
+// only honored without a Cache-Control header. Refer to RFC 9111 5.4.
+func requestCacheControl(req *request.Request) cacheControl {
+	value := req.Headers.Get("cache-control")
+	if value == "" && strings.Contains(strings.ToLower(req.Headers.Get("pragma")), "no-cache") {
+		return cacheControl{"no-cache": ""}
+	}
+
+	return parseCacheControl(value)
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns the delta-seconds argument of directive. Invalid
+// arguments count as zero, which errs on the side of a stale response.
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	value, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		var numErr *strconv.NumError
+		if !errors.As(err, &numErr) || numErr.Err != strconv.ErrRange {
+			return 0, true
+		}
+		n = maxDeltaSeconds
+	}
+	n = min(n, maxDeltaSeconds)
+
+	return time.Duration(n) * time.Second, true
+}
+
+// heuristicallyCacheable reports whether responses with statusCode may be
+// cached without explicit freshness information. Refer to RFC 9110 15.1.
+func heuristicallyCacheable(statusCode int) bool {
+	switch statusCode {
+	case 200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501:
+		return true
+	}
+
+	return false
+}
+
+// date returns the time the response was generated, which is when we got it
+// if the upstream didn't say.
+func (e *cacheEntry) date() time.Time {
+	date, err := http.ParseTime(e.header.Get("Date"))
+	if err != nil {
+		return e.responseTime
+	}
+
+	return date
+}
+
+// freshnessLifetime returns how long the response is fresh after it was
+// generated. Refer to RFC 9111 4.2.1.
+func (e *cacheEntry) freshnessLifetime() time.Duration {
+	// We are a shared cache, so s-maxage takes precedence.
+	if lifetime, ok := e.cc.seconds("s-maxage"); ok {
+		return lifetime
+	}
+
+	if lifetime, ok := e.cc.seconds("max-age"); ok {
+		return lifetime
+	}
+
+	if expires := e.header.Get("Expires"); expires != "" {
+		// Invalid dates, e.g. "0", mean the response has already expired.
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+
+		return t.Sub(e.date())
+	}
+
+	if !heuristicallyCacheable(e.statusCode) && !e.cc.has("public") {
+		return 0
+	}
+
+	// Guess 10% of the time since the last modification.
+	lastModified, err := http.ParseTime(e.header.Get("Last-Modified"))
+	if err != nil {
+		return 0
+	}
+
+	return min(max(e.date().Sub(lastModified)/10, 0), maxHeuristicLifetime)
+}
+
+// age returns the current age of the response, including the time it spent
+// in upstream caches and in flight. Refer to RFC 9111 4.2.3.
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparentAge := max(e.responseTime.Sub(e.date()), 0)
+
+	ageValue := time.Duration(0)
+	if n, err := strconv.ParseUint(e.header.Get("Age"), 10, 32); err == nil {
+		ageValue = time.Duration(n) * time.Second
+	}
+
+	responseDelay := e.responseTime.Sub(e.requestTime)
+	correctedInitialAge := max(apparentAge, ageValue+responseDelay)
+	residentTime := now.Sub(e.responseTime)
+
+	return correctedInitialAge + residentTime
+}
+
+// satisfies reports whether the entry may be served for a request with the
+// directives reqCC without revalidating it first. Refer to RFC 9111 4.2 and
+// 5.2.1.
+func (e *cacheEntry) satisfies(reqCC cacheControl, now time.Time) bool {
+	if e.cc.has("no-cache") || reqCC.has("no-cache") {
+		return false
+	}
+
+	age := e.age(now)
+	lifetime := e.freshnessLifetime()
+
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+
+	// The client wants the response to stay fresh for a while longer.
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok {
+		age += minFresh
+	}
+
+	if age < lifetime {
+		return true
+	}
+
+	// Stale responses can only be served if the client is fine with that
+	// and the upstream didn't forbid it. s-maxage implies proxy-revalidate.
+	if e.cc.has("must-revalidate") || e.cc.has("proxy-revalidate") || e.cc.has("s-maxage") {
+		return false
+	}
+
+	maxStale, ok := reqCC["max-stale"]
+	if !ok {
+		return false
+	}
+	if maxStale == "" {
+		return true
+	}
+
+	limit, _ := reqCC.seconds("max-stale")
+	return age-lifetime <= limit
+}
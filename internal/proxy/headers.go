@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+)
+
+// Hop-by-hop headers describe a single connection, so a proxy must not pass
+// them on. Refer to RFC 9110 7.6.1.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders deletes the hop-by-hop headers from h, including the
+// ones the sender listed in its Connection header.
+func removeHopByHopHeaders(h headers.Headers) {
+	for _, name := range strings.Split(h.Get("Connection"), ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			h.Del(name)
+		}
+	}
+
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// addForwardedHeaders tells the upstream who the request came from, both
+// with the de facto X-Forwarded-* headers and the standard Forwarded header
+// of RFC 7239. The X-Forwarded-For and Forwarded lists set by proxies in
+// front of us are kept and ours are appended to them.
+func addForwardedHeaders(h headers.Headers, req *request.Request) {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	host := req.Headers.Get("host")
+
+	clientIP := clientIP(req)
+
+	if clientIP != "" {
+		if prior := h.Get("X-Forwarded-For"); prior != "" {
+			h.Replace("X-Forwarded-For", prior+", "+clientIP)
+		} else {
+			h.Replace("X-Forwarded-For", clientIP)
+		}
+	}
+
+	// Unlike the lists above, these only have room for one value. Any
+	// client could set them, so they're always ours.
+	h.Replace("X-Forwarded-Proto", proto)
+	if host != "" {
+		h.Replace("X-Forwarded-Host", host)
+	} else {
+		h.Del("X-Forwarded-Host")
+	}
+
+	var element []string
+	if clientIP != "" {
+		element = append(element, "for="+forwardedNode(clientIP))
+	}
+	if host != "" {
+		element = append(element, "host="+quoteForwarded(host))
+	}
+	element = append(element, "proto="+proto)
+
+	forwarded := strings.Join(element, ";")
+	if prior := h.Get("Forwarded"); prior != "" {
+		forwarded = prior + ", " + forwarded
+	}
+	h.Replace("Forwarded", forwarded)
+}
+
+// forwardedNode formats an IP address as a Forwarded node. IPv6 addresses
+// have to be bracketed and quoted. Refer to RFC 7239 6.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+
+	return ip
+}
+
+// quoteForwarded quotes a Forwarded value unless it is a plain token.
+func quoteForwarded(value string) string {
+	for _, char := range value {
+		if !isTokenChar(char) {
+			return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+		}
+	}
+
+	return value
+}
+
+func isTokenChar(char rune) bool {
+	const allowed = "!#$%&'*+-.^_`|~"
+
+	return ('A' <= char && char <= 'Z') ||
+		('a' <= char && char <= 'z') ||
+		('0' <= char && char <= '9') ||
+		strings.ContainsRune(allowed, char)
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/client"
+)
+
+// Defaults for passive ejection.
+const (
+	DefaultMaxFails      = 3
+	DefaultEjectDuration = 30 * time.Second
+)
+
+// Defaults for the active health checks.
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 5 * time.Second
+)
+
+// HealthCheck configures the active health checks.
+type HealthCheck struct {
+	// Path requested on each upstream, e.g. "/healthz". Any 2xx or 3xx
+	// response counts as healthy.
+	Path string
+	// Interval between two checks of the same upstream. Zero means
+	// DefaultHealthCheckInterval.
+	Interval time.Duration
+	// Timeout of each check. Upstreams that don't answer in time are
+	// unhealthy. Zero means DefaultHealthCheckTimeout.
+	Timeout time.Duration
+}
+
+// StartHealthChecks checks every upstream according to hc until Close is
+// called, which also closes the conns used for the checks. Unhealthy
+// upstreams get no requests until they pass a check again.
+func (p *ReverseProxy) StartHealthChecks(hc HealthCheck) {
+	if hc.Interval <= 0 {
+		hc.Interval = DefaultHealthCheckInterval
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = DefaultHealthCheckTimeout
+	}
+
+	// Each check gets Timeout to connect and Timeout to answer.
+	c := client.New()
+	c.DialTimeout = hc.Timeout
+	c.ResponseHeaderTimeout = hc.Timeout
+	c.TLSConfig = p.Client.TLSConfig
+
+	var wg sync.WaitGroup
+	for _, u := range p.Upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ticker := time.NewTicker(hc.Interval)
+			defer ticker.Stop()
+
+			for {
+				p.checkHealth(c, u, hc.Path)
+
+				select {
+				case <-p.done:
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+
+	// Don't leave the conns of the checks open once they've stopped.
+	go func() {
+		wg.Wait()
+		c.CloseIdleConnections()
+	}()
+}
+
+func (p *ReverseProxy) checkHealth(c *client.Client, u *Upstream, path string) {
+	target := *u.URL
+	target.Path = singleJoiningSlash(u.URL.Path, path)
+	target.RawQuery = ""
+
+	healthy := false
+
+	req, err := client.NewRequest("GET", target.String(), nil)
+	if err != nil {
+		log.Printf("failed to create health check request: %v", err)
+		return
+	}
+
+	resp, err := c.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		healthy = resp.StatusCode >= 200 && resp.StatusCode < 400
+	}
+
+	wasUnhealthy := u.unhealthy.Swap(!healthy)
+
+	switch {
+	case healthy && wasUnhealthy:
+		log.Printf("upstream %v passed its health check", u.URL)
+	case !healthy && !wasUnhealthy:
+		if err != nil {
+			log.Printf("upstream %v failed its health check: %v", u.URL, err)
+		} else {
+			log.Printf("upstream %v failed its health check: status %d", u.URL, resp.StatusCode)
+		}
+	}
+}
+
+// reportResult records the outcome of a request for passive ejection. After
+// MaxFails failures in a row the upstream is ejected for EjectDuration. Once
+// it is back, a single failure ejects it again until a request succeeds.
+func (p *ReverseProxy) reportResult(u *Upstream, ok bool) {
+	if ok {
+		u.failures.Store(0)
+		return
+	}
+
+	if p.MaxFails <= 0 {
+		return
+	}
+
+	failures := u.failures.Add(1)
+	if failures < int64(p.MaxFails) {
+		return
+	}
+
+	u.ejectedUntil.Store(time.Now().Add(p.EjectDuration).UnixNano())
+	log.Printf("upstream %v ejected for %v after %d failed requests", u.URL, p.EjectDuration, failures)
+}
+
+// isUpstreamFailure reports whether the status code means the upstream
+// couldn't handle the request, as opposed to the request being bad.
+func isUpstreamFailure(statusCode int) bool {
+	switch statusCode {
+	case 502, 503, 504:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,456 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/client"
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+)
+
+// How long to wait for the upstream to start responding.
+const DefaultTimeout = 30 * time.Second
+
+// Size of the reads from the upstream body when relaying it chunked.
+const chunkSize = 32 * 1024
+
+// ReverseProxy forwards requests to upstream servers and relays their
+// responses back to the client.
+type ReverseProxy struct {
+	// Upstreams the requests are balanced across.
+	Upstreams []*Upstream
+	// Balancer picks the upstream of each request.
+	Balancer Balancer
+	// StripPrefix is removed from the request path before it is forwarded,
+	// e.g. to serve the upstream under a sub-path.
+	StripPrefix string
+	// Client sends the requests to the upstream.
+	Client *client.Client
+	// MaxFails is the number of failed requests in a row after which an
+	// upstream is ejected for EjectDuration. Zero disables ejection.
+	MaxFails      int
+	EjectDuration time.Duration
+	// Cache stores the upstream responses, if set. See Cache.
+	Cache *Cache
+	// ChecksumTrailers adds X-Content-SHA256 and X-Content-Length trailers
+	// to responses relayed chunked, so that clients can check they got the
+	// whole body.
+	ChecksumTrailers bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewReverseProxy returns a proxy forwarding requests to target, e.g.
+// "https://httpbin.org".
+func NewReverseProxy(target string) (*ReverseProxy, error) {
+	return NewLoadBalancedProxy([]string{target}, &RoundRobin{})
+}
+
+// NewLoadBalancedProxy returns a proxy balancing requests across targets.
+func NewLoadBalancedProxy(targets []string, balancer Balancer) (*ReverseProxy, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("at least one upstream is required")
+	}
+
+	upstreams := make([]*Upstream, 0, len(targets))
+	for _, target := range targets {
+		u, err := newUpstream(target)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, u)
+	}
+
+	c := client.New()
+	c.ResponseHeaderTimeout = DefaultTimeout
+
+	return &ReverseProxy{
+		Upstreams:     upstreams,
+		Balancer:      balancer,
+		Client:        c,
+		MaxFails:      DefaultMaxFails,
+		EjectDuration: DefaultEjectDuration,
+		done:          make(chan struct{}),
+	}, nil
+}
+
+// Close stops the health checks.
+func (p *ReverseProxy) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+
+	return nil
+}
+
+// Handle is a server.Handler forwarding req to one of the upstreams.
+func (p *ReverseProxy) Handle(w *response.Writer, req *request.Request) {
+	if p.Cache != nil {
+		p.handleCached(w, req)
+		return
+	}
+
+	resp, ok := p.forward(w, req, nil)
+	if !ok {
+		return
+	}
+	defer resp.Body.Close()
+
+	p.relay(w, req, resp)
+}
+
+// forward sends req to one of the upstreams, with the extra headers set on
+// top of the client's. If that fails, the error response is written to w and
+// ok is false.
+func (p *ReverseProxy) forward(w *response.Writer, req *request.Request, extra headers.Headers) (*client.Response, bool) {
+	upstream := p.pick(req)
+	if upstream == nil {
+		log.Printf("no upstream available for %v", req.RequestLine.RequestTarget)
+		writeError(w, response.StatusServiceUnavailable, "service unavailable")
+		return nil, false
+	}
+
+	outReq, err := p.outboundRequest(req, upstream)
+	if err != nil {
+		log.Printf("failed to create upstream request: %v", err)
+		writeError(w, response.StatusBadRequest, "bad request")
+		return nil, false
+	}
+
+	for key, value := range extra {
+		outReq.Headers.Replace(key, value)
+	}
+
+	upstream.active.Add(1)
+
+	resp, err := p.Client.Do(outReq)
+	if err != nil {
+		upstream.active.Add(-1)
+
+		// Nobody is waiting for the response, which is no fault of the
+		// upstream's.
+		if req.Context().Err() != nil {
+			log.Printf("client went away before %v answered", outReq.URL)
+			return nil, false
+		}
+
+		log.Printf("failed to make request to %v: %v", outReq.URL, err)
+		p.reportResult(upstream, false)
+		writeUpstreamError(w, err)
+		return nil, false
+	}
+
+	p.reportResult(upstream, !isUpstreamFailure(resp.StatusCode))
+
+	// The request is in flight until its body has been relayed.
+	resp.Body = &upstreamBody{
+		ReadCloser: resp.Body,
+		release:    func() { upstream.active.Add(-1) },
+	}
+
+	return resp, true
+}
+
+func (p *ReverseProxy) relay(w *response.Writer, req *request.Request, resp *client.Response) {
+	err := relayResponse(w, req, resp, p.ChecksumTrailers)
+	if err != nil {
+		log.Printf("failed to relay response to %v: %v", req.RequestLine.RequestTarget, err)
+	}
+}
+
+// upstreamBody calls release once the body is closed.
+type upstreamBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *upstreamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// pick returns the upstream for req, or nil if none is available.
+func (p *ReverseProxy) pick(req *request.Request) *Upstream {
+	available := make([]*Upstream, 0, len(p.Upstreams))
+	for _, u := range p.Upstreams {
+		if u.Available() {
+			available = append(available, u)
+		}
+	}
+
+	if len(available) == 0 {
+		return nil
+	}
+
+	return p.Balancer.Pick(available, req)
+}
+
+func (p *ReverseProxy) outboundRequest(req *request.Request, upstream *Upstream) (*client.Request, error) {
+	reqPath, rawQuery, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+	if p.StripPrefix != "" {
+		reqPath = stripPathPrefix(reqPath, p.StripPrefix)
+	}
+
+	// The request path is still escaped. Keep it as the client sent it, so
+	// that e.g. an escaped slash doesn't turn into a path separator.
+	unescaped, err := url.PathUnescape(reqPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unescape path: %v", err)
+	}
+
+	u := *upstream.URL
+	u.Path = singleJoiningSlash(upstream.URL.Path, unescaped)
+	u.RawPath = singleJoiningSlash(upstream.URL.EscapedPath(), reqPath)
+	// Keep the upstream's query, if any, ahead of the request's.
+	switch {
+	case upstream.URL.RawQuery == "":
+		u.RawQuery = rawQuery
+	case rawQuery != "":
+		u.RawQuery = upstream.URL.RawQuery + "&" + rawQuery
+	}
+
+	outReq, err := newOutboundRequest(req, u.String())
+	if err != nil {
+		return nil, err
+	}
+
+	addForwardedHeaders(outReq.Headers, req)
+
+	// Name the upstream in the Host header, not us.
+	outReq.Host = upstream.URL.Host
+
+	return outReq, nil
+}
+
+// newOutboundRequest returns a request for target with the method, headers
+// and body of req, minus the headers that are only meant for us.
+func newOutboundRequest(req *request.Request, target string) (*client.Request, error) {
+	var body io.Reader
+	contentLength := int64(0)
+	if cl := req.Headers.Get("content-length"); cl != "" {
+		contentLength, _ = strconv.ParseInt(cl, 10, 64)
+	}
+	if contentLength > 0 {
+		// Stream the body to the upstream as we read it off the conn.
+		body = req.BodyReader()
+	}
+
+	outReq, err := client.NewRequest(req.RequestLine.Method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	outReq.ContentLength = contentLength
+	// Give up on the upstream once the client goes away.
+	outReq.Context = req.Context()
+
+	for key, value := range req.Headers {
+		switch strings.ToLower(key) {
+		// The upstream gets its own Host, and the framing is up to the
+		// client making the request.
+		case "host", "content-length":
+			continue
+		}
+
+		outReq.Headers.Set(key, value)
+	}
+
+	removeHopByHopHeaders(outReq.Headers)
+
+	return outReq, nil
+}
+
+func relayResponse(w *response.Writer, req *request.Request, resp *client.Response, checksum bool) error {
+	err := w.WriteStatusLine(strconv.Itoa(resp.StatusCode))
+	if err != nil {
+		return fmt.Errorf("failed to write status line to conn: %v", err)
+	}
+
+	// The trailers the upstream announced to us, read before the Trailer
+	// header goes with the other hop-by-hop headers.
+	announced := resp.Headers.Get("trailer")
+
+	// The upstream's connection handling and framing are none of the
+	// client's business, we set our own below. Copying them would also
+	// have Set join the upstream's values with ours, e.g. into
+	// "Transfer-Encoding: chunked, chunked".
+	h := maps.Clone(resp.Headers)
+	removeHopByHopHeaders(h)
+	h.Del("Content-Length")
+
+	hasBody := req.RequestLine.Method != "HEAD" &&
+		resp.StatusCode != 204 &&
+		resp.StatusCode != 304
+
+	// Relay fixed-length bodies as they are. Anything else is sent chunked,
+	// since we're closing the conn after the response anyway, but the
+	// client shouldn't have to rely on that.
+	chunked := hasBody && resp.ContentLength < 0
+	if resp.ContentLength >= 0 {
+		h.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	} else if chunked {
+		h.Set("Transfer-Encoding", "chunked")
+
+		if announced != "" {
+			h.Set("Trailer", announced)
+		}
+		if checksum {
+			h.Set("Trailer", "X-Content-SHA256, X-Content-Length")
+		}
+	}
+
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return fmt.Errorf("failed to write headers to conn: %v", err)
+	}
+
+	if !hasBody {
+		return nil
+	}
+
+	if !chunked {
+		_, err = io.Copy(w, resp.Body)
+		if err != nil {
+			return fmt.Errorf("failed to write body to conn: %v", err)
+		}
+		return nil
+	}
+
+	data := make([]byte, chunkSize)
+
+	// Keep track of the whole body for the checksum trailers.
+	hasher := sha256.New()
+	var bodyLen int64
+
+	for {
+		readBytes, err := resp.Body.Read(data)
+		if readBytes > 0 {
+			_, err := w.WriteChunkedBody(data[:readBytes])
+			if err != nil {
+				return fmt.Errorf("failed to write chunked data: %v", err)
+			}
+
+			if checksum {
+				hasher.Write(data[:readBytes])
+				bodyLen += int64(readBytes)
+			}
+
+			// Push each chunk to the client as soon as it arrives from the
+			// upstream instead of waiting for the buffer to fill up.
+			err = w.Flush()
+			if err != nil {
+				return fmt.Errorf("failed to flush chunked data: %v", err)
+			}
+		}
+
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return fmt.Errorf("failed to read upstream body: %v", err)
+		}
+	}
+
+	_, err = w.WriteChunkedBodyDone()
+	if err != nil {
+		return fmt.Errorf("failed to write last chunked data: %v", err)
+	}
+
+	// Trailers are only known once the body has been read.
+	trailers := resp.Trailers
+	if checksum {
+		trailers = headers.NewHeaders()
+		maps.Copy(trailers, resp.Trailers)
+		trailers.Replace("X-Content-SHA256", fmt.Sprintf("%x", hasher.Sum(nil)))
+		trailers.Replace("X-Content-Length", strconv.FormatInt(bodyLen, 10))
+	}
+
+	err = w.WriteTrailers(trailers)
+	if err != nil {
+		return fmt.Errorf("failed to write trailers: %v", err)
+	}
+
+	return nil
+}
+
+func writeError(w *response.Writer, statusCode, message string) {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(message)))
+
+	err := w.WriteStatusLine(statusCode)
+	if err != nil {
+		log.Printf("failed to write status line to conn: %v", err)
+		return
+	}
+
+	err = w.WriteHeaders(h)
+	if err != nil {
+		log.Printf("failed to write headers to conn: %v", err)
+		return
+	}
+
+	_, err = w.WriteBody([]byte(message))
+	if err != nil {
+		log.Printf("failed to write body to conn: %v", err)
+	}
+}
+
+// writeUpstreamError answers the client after we failed to reach the
+// upstream.
+func writeUpstreamError(w *response.Writer, err error) {
+	if errors.Is(err, context.DeadlineExceeded) || isTimeout(err) {
+		writeError(w, response.StatusGatewayTimeout, "gateway timeout")
+	} else {
+		writeError(w, response.StatusBadGateway, "bad gateway")
+	}
+}
+
+func isTimeout(err error) bool {
+	var timeoutErr interface{ Timeout() bool }
+	return errors.As(err, &timeoutErr) && timeoutErr.Timeout()
+}
+
+// stripPathPrefix removes prefix from path if it covers whole segments of
+// it, so that "/api" is stripped from "/api/users" but not from "/apix".
+func stripPathPrefix(path, prefix string) string {
+	rest, ok := strings.CutPrefix(path, prefix)
+	if !ok {
+		return path
+	}
+
+	if rest == "" || rest[0] == '/' || strings.HasSuffix(prefix, "/") {
+		return rest
+	}
+
+	return path
+}
+
+func singleJoiningSlash(a, b string) string {
+	aSlash := strings.HasSuffix(a, "/")
+	bSlash := strings.HasPrefix(b, "/")
+
+	switch {
+	case aSlash && bSlash:
+		return a + b[1:]
+	case !aSlash && !bSlash:
+		return a + "/" + b
+	}
+
+	return a + b
+}
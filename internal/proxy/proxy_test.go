@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/johndosdos/http-from-tcp/internal/conntest"
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+	"github.com/johndosdos/http-from-tcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve parses raw as a request off one end of a pipe, the way the server
+// does, and returns the response handler wrote to the other end.
+func serve(t *testing.T, handler server.Handler, raw string) *http.Response {
+	t.Helper()
+
+	return conntest.Response(t, raw, func(conn net.Conn) {
+		req, err := request.RequestHeadersFromReader(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		req.RemoteAddr = "192.0.2.1:51234"
+
+		w := response.NewWriter(conn)
+		handler(&w, req)
+		w.Finish()
+	})
+}
+
+func TestReverseProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Path", r.URL.RequestURI())
+		w.Header().Set("X-Host", r.Host)
+		w.Header().Set("X-Token", r.Header.Get("X-Token"))
+
+		switch r.URL.Path {
+		case "/api/created":
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, string(body))
+		case "/api/stream":
+			w.Header().Set("Trailer", "X-Checksum")
+			io.WriteString(w, "part one, ")
+			w.(http.Flusher).Flush()
+			io.WriteString(w, "part two")
+			w.Header().Set("X-Checksum", "abc123")
+		default:
+			w.Header().Set("Content-Length", "2")
+			io.WriteString(w, "ok")
+		}
+	}))
+	defer upstream.Close()
+
+	p, err := NewReverseProxy(upstream.URL + "/api")
+	require.NoError(t, err)
+	p.StripPrefix = "/proxy"
+
+	// Test: method, path, query, headers and body are forwarded
+	resp := serve(t, p.Handle, "POST /proxy/created?a=1 HTTP/1.1\r\n"+
+		"Host: localhost:42069\r\n"+
+		"X-Token: Secret-Value\r\n"+
+		"Content-Length: 11\r\n"+
+		"\r\n"+
+		"hello world")
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, "POST", resp.Header.Get("X-Method"))
+	assert.Equal(t, "/api/created?a=1", resp.Header.Get("X-Path"))
+	assert.Equal(t, "Secret-Value", resp.Header.Get("X-Token"))
+	assert.Equal(t, "hello world", conntest.ReadBody(t, resp.Body))
+
+	// Test: Host is rewritten to the upstream
+	assert.Equal(t, strings.TrimPrefix(upstream.URL, "http://"), resp.Header.Get("X-Host"))
+
+	// Test: fixed-length response
+	resp = serve(t, p.Handle, "GET /proxy/plain HTTP/1.1\r\nHost: localhost:42069\r\n\r\n")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, int64(2), resp.ContentLength)
+	assert.Equal(t, "ok", conntest.ReadBody(t, resp.Body))
+
+	// Test: chunked response with trailers
+	resp = serve(t, p.Handle, "GET /proxy/stream HTTP/1.1\r\nHost: localhost:42069\r\n\r\n")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(t, "part one, part two", conntest.ReadBody(t, resp.Body))
+	assert.Equal(t, "abc123", resp.Trailer.Get("X-Checksum"))
+
+	// Test: checksum trailers on chunked responses
+	p.ChecksumTrailers = true
+	resp = serve(t, p.Handle, "GET /proxy/stream HTTP/1.1\r\nHost: localhost:42069\r\n\r\n")
+	body := conntest.ReadBody(t, resp.Body)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte(body))), resp.Trailer.Get("X-Content-SHA256"))
+	assert.Equal(t, "18", resp.Trailer.Get("X-Content-Length"))
+	assert.Equal(t, "abc123", resp.Trailer.Get("X-Checksum"))
+	p.ChecksumTrailers = false
+
+	// Test: the upstream's query is kept, joined with the request's only
+	// if there is one
+	withQuery, err := NewReverseProxy(upstream.URL + "/api?key=1")
+	require.NoError(t, err)
+	resp = serve(t, withQuery.Handle, "GET /plain?a=1 HTTP/1.1\r\nHost: localhost:42069\r\n\r\n")
+	assert.Equal(t, "/api/plain?key=1&a=1", resp.Header.Get("X-Path"))
+	resp = serve(t, withQuery.Handle, "GET /plain HTTP/1.1\r\nHost: localhost:42069\r\n\r\n")
+	assert.Equal(t, "/api/plain?key=1", resp.Header.Get("X-Path"))
+
+	// Test: an escaped path is forwarded as it is, not escaped twice
+	resp = serve(t, p.Handle, "GET /proxy/foo%20bar/a%2Fb?q=%26 HTTP/1.1\r\nHost: localhost:42069\r\n\r\n")
+	assert.Equal(t, "/api/foo%20bar/a%2Fb?q=%26", resp.Header.Get("X-Path"))
+
+	// Test: the prefix is only stripped off whole path segments
+	resp = serve(t, p.Handle, "GET /proxyx HTTP/1.1\r\nHost: localhost:42069\r\n\r\n")
+	assert.Equal(t, "/api/proxyx", resp.Header.Get("X-Path"))
+	resp = serve(t, p.Handle, "GET /proxy?a=1 HTTP/1.1\r\nHost: localhost:42069\r\n\r\n")
+	assert.Equal(t, "/api/?a=1", resp.Header.Get("X-Path"))
+
+	// Test: unreachable upstream
+	down, err := NewReverseProxy("http://127.0.0.1:1")
+	require.NoError(t, err)
+	resp = serve(t, down.Handle, "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n")
+	assert.Equal(t, 502, resp.StatusCode)
+
+	// Test: invalid upstream url
+	_, err = NewReverseProxy("ftp://example.com")
+	require.Error(t, err)
+}
+
+func TestReverseProxyHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded", "X-Private", "Keep-Alive", "Proxy-Authorization"} {
+			w.Header().Set("Seen-"+name, r.Header.Get(name))
+		}
+
+		w.Header().Set("Connection", "X-Upstream-Secret")
+		w.Header().Set("X-Upstream-Secret", "leaked")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		io.WriteString(w, "part one, ")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "part two")
+	}))
+	defer upstream.Close()
+
+	p, err := NewReverseProxy(upstream.URL)
+	require.NoError(t, err)
+
+	resp := serve(t, p.Handle, "GET / HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"Connection: keep-alive, X-Private\r\n"+
+		"X-Private: do-not-forward\r\n"+
+		"Keep-Alive: timeout=5\r\n"+
+		"Proxy-Authorization: Basic Zm9vOmJhcg==\r\n"+
+		"X-Forwarded-For: 198.51.100.7\r\n"+
+		"X-Forwarded-Proto: https\r\n"+
+		"X-Forwarded-Host: admin.internal\r\n"+
+		"\r\n")
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Test: hop-by-hop headers aren't forwarded to the upstream
+	assert.Empty(t, resp.Header.Get("Seen-X-Private"))
+	assert.Empty(t, resp.Header.Get("Seen-Keep-Alive"))
+	assert.Empty(t, resp.Header.Get("Seen-Proxy-Authorization"))
+
+	// Test: forwarding headers are added, and spoofed proto and host are
+	// replaced
+	assert.Equal(t, "198.51.100.7, 192.0.2.1", resp.Header.Get("Seen-X-Forwarded-For"))
+	assert.Equal(t, "http", resp.Header.Get("Seen-X-Forwarded-Proto"))
+	assert.Equal(t, "example.com", resp.Header.Get("Seen-X-Forwarded-Host"))
+	assert.Equal(t, "for=192.0.2.1;host=example.com;proto=http", resp.Header.Get("Seen-Forwarded"))
+
+	// Test: hop-by-hop headers aren't relayed to the client
+	assert.Empty(t, resp.Header.Get("X-Upstream-Secret"))
+	assert.Empty(t, resp.Header.Get("Keep-Alive"))
+
+	// Test: the body is chunked once
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(t, "part one, part two", conntest.ReadBody(t, resp.Body))
+}
+
+func TestForwardedNode(t *testing.T) {
+	assert.Equal(t, "192.0.2.1", forwardedNode("192.0.2.1"))
+	assert.Equal(t, `"[2001:db8::1]"`, forwardedNode("2001:db8::1"))
+	assert.Equal(t, `"example.com:8080"`, quoteForwarded("example.com:8080"))
+}
+
+func TestAddForwardedHeaders(t *testing.T) {
+	req := &request.Request{
+		Headers:    headers.NewHeaders(),
+		RemoteAddr: "192.0.2.1:1234",
+	}
+	req.Headers.Set("Host", "example.com")
+
+	// Test: requests over TLS are forwarded as https
+	req.TLS = &tls.ConnectionState{}
+	h := headers.NewHeaders()
+	addForwardedHeaders(h, req)
+	assert.Equal(t, "https", h.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "for=192.0.2.1;host=example.com;proto=https", h.Get("Forwarded"))
+
+	// Test: proto and host sent by the client are replaced with ours
+	req.TLS = nil
+	h = headers.NewHeaders()
+	h.Set("X-Forwarded-Proto", "https")
+	h.Set("X-Forwarded-Host", "admin.internal")
+	addForwardedHeaders(h, req)
+	assert.Equal(t, "http", h.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "example.com", h.Get("X-Forwarded-Host"))
+
+	// Test: with no Host of ours, the client's X-Forwarded-Host is dropped
+	req.Headers.Del("Host")
+	h = headers.NewHeaders()
+	h.Set("X-Forwarded-Host", "admin.internal")
+	addForwardedHeaders(h, req)
+	assert.Empty(t, h.Get("X-Forwarded-Host"))
+}
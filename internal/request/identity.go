@@ -0,0 +1,36 @@
+package request
+
+import (
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+)
+
+// ClientIdentity is who the client proved to be with its TLS certificate.
+type ClientIdentity struct {
+	Subject pkix.Name
+	// The subject alternative names of the certificate.
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+}
+
+// ClientIdentity returns the identity in the certificate the client
+// authenticated with, or nil if the client didn't send one or it wasn't
+// verified against the server's client CAs.
+func (r *Request) ClientIdentity() *ClientIdentity {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	leaf := r.TLS.VerifiedChains[0][0]
+
+	return &ClientIdentity{
+		Subject:        leaf.Subject,
+		DNSNames:       leaf.DNSNames,
+		EmailAddresses: leaf.EmailAddresses,
+		IPAddresses:    leaf.IPAddresses,
+		URIs:           leaf.URIs,
+	}
+}
@@ -1,7 +1,10 @@
 package request
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -17,6 +20,18 @@ type Request struct {
 	Headers     headers.Headers
 	Body        []byte
 	State       State
+	// RemoteAddr is the address of the client, set by the server.
+	RemoteAddr string
+	// TLS is the state of the TLS connection the request came over, or nil
+	// for plain connections. Set by the server.
+	TLS *tls.ConnectionState
+
+	// Where the rest of the body is read from when it wasn't read along with
+	// the headers. See ReadBody.
+	reader         *bufio.Reader
+	beforeBodyRead func() error
+
+	ctx context.Context
 }
 
 type RequestLine struct {
@@ -37,7 +52,9 @@ const (
 const NUM_PARTS_REQ_LINE int = 3
 const HTTP_VERSION_DIGIT string = "1.1"
 
-const BUFFER_SIZE int = 8
+// Size of the buffer requests are read into. This also caps the length of
+// the request line and of each field line.
+const BUFFER_SIZE int = 8192
 
 func (r *Request) Parse(data []byte) (int, error) {
 	switch r.State {
@@ -72,10 +89,9 @@ func (r *Request) Parse(data []byte) (int, error) {
 			totalBytesParsed += bytesParsed
 		}
 
-		if len(r.Body) == 0 {
-			r.State = DONE
-		} else {
-			r.State = REQUEST_STATE_PARSING_BODY
+		err := r.finishHeaders()
+		if err != nil {
+			return 0, err
 		}
 
 		return totalBytesParsed, nil
@@ -115,65 +131,285 @@ func (r *Request) Parse(data []byte) (int, error) {
 }
 
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	request := &Request{
+	request := newRequest()
+
+	// Parse straight out of the bufio.Reader's buffer and only discard what
+	// has been parsed. Whatever the client sent past the end of the request
+	// stays buffered in br, so a caller that passes its own bufio.Reader
+	// doesn't lose it.
+	br, ok := reader.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReaderSize(reader, BUFFER_SIZE)
+	}
+
+	err := request.parseFrom(br, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check for body length and content-length mismatch.
+	contentLength := request.Headers.Get("content-length")
+	if contentLength != "" {
+		contentLengthInt, err := strconv.Atoi(contentLength)
+		bodyLen := len(request.Body)
+
+		if err != nil || contentLengthInt < 0 {
+			return nil, fmt.Errorf("invalid content-length: %v", err)
+		}
+
+		if bodyLen < contentLengthInt {
+			return nil, fmt.Errorf("body length and content-length mismatch: expected %d, got %d", contentLengthInt, bodyLen)
+		}
+	}
+
+	return request, nil
+}
+
+// RequestHeadersFromReader parses the request line and headers but leaves
+// the body in br. The body is read by ReadBody.
+func RequestHeadersFromReader(br *bufio.Reader) (*Request, error) {
+	request := newRequest()
+
+	err := request.parseFrom(br, true)
+	if err != nil {
+		return nil, err
+	}
+
+	request.reader = br
+
+	return request, nil
+}
+
+// ReadBody reads the rest of the body into Body, if it hasn't been read yet,
+// and returns it.
+func (r *Request) ReadBody() ([]byte, error) {
+	if r.State == DONE {
+		return r.Body, nil
+	}
+
+	if r.reader == nil {
+		return nil, errors.New("request body can't be read")
+	}
+
+	if r.beforeBodyRead != nil {
+		fn := r.beforeBodyRead
+		r.beforeBodyRead = nil
+
+		err := fn()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := r.parseFrom(r.reader, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.Body, nil
+}
+
+// BodyReader returns a reader for the body. If the body hasn't been read
+// yet, it is streamed from the connection instead of being read into Body,
+// which is left empty.
+func (r *Request) BodyReader() io.Reader {
+	if r.State == DONE || r.reader == nil {
+		return bytes.NewReader(r.Body)
+	}
+
+	contentLength, _ := strconv.Atoi(r.Headers.Get("content-length"))
+
+	return &bodyReader{
+		request:   r,
+		remaining: contentLength - len(r.Body),
+		buffered:  r.Body,
+	}
+}
+
+// bodyReader streams the part of the body that is still on the connection,
+// after whatever the parser already put into Body.
+type bodyReader struct {
+	request   *Request
+	remaining int
+	buffered  []byte
+}
+
+func (br *bodyReader) Read(p []byte) (int, error) {
+	if len(br.buffered) > 0 {
+		n := copy(p, br.buffered)
+		br.buffered = br.buffered[n:]
+		return n, nil
+	}
+
+	r := br.request
+	if r.State == DONE || br.remaining == 0 {
+		return 0, io.EOF
+	}
+
+	if r.beforeBodyRead != nil {
+		fn := r.beforeBodyRead
+		r.beforeBodyRead = nil
+
+		err := fn()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if len(p) > br.remaining {
+		p = p[:br.remaining]
+	}
+
+	n, err := r.reader.Read(p)
+	br.remaining -= n
+
+	if br.remaining == 0 {
+		r.State = DONE
+		return n, nil
+	}
+
+	if errors.Is(err, io.EOF) {
+		return n, io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+// SetBeforeBodyRead sets a function called right before the body is read
+// for the first time. If it returns an error the body is not read. The
+// server uses it to send 100 Continue.
+func (r *Request) SetBeforeBodyRead(fn func() error) {
+	r.beforeBodyRead = fn
+}
+
+// Context returns the request's context. For requests read by the server,
+// it's derived from Server.BaseContext and cancelled once the client goes
+// away or the server stops waiting for handlers, so that handlers can give
+// up on work nobody is waiting for. It's never nil.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+
+	return r.ctx
+}
+
+// SetContext sets the context returned by Context. The server uses it to
+// tie requests to their connection.
+func (r *Request) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx,
+// for middleware to pass on deadlines and request-scoped values. ctx must
+// be derived from r's context, so it's still cancelled when the client goes
+// away or the server stops.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("request: nil context")
+	}
+
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// ExpectsContinue reports whether the client waits for 100 Continue before
+// sending the body. Refer to RFC 9110 10.1.1.
+func (r *Request) ExpectsContinue() bool {
+	return strings.EqualFold(r.Headers.Get("expect"), "100-continue") && r.State != DONE
+}
+
+func newRequest() *Request {
+	return &Request{
 		State:   INITIALIZED,
 		Headers: headers.NewHeaders(),
 		Body:    make([]byte, 0),
 	}
+}
 
-	buffer := make([]byte, BUFFER_SIZE)
-	// Track how many bytes have we read from the io.Reader (request data) into
-	// the buffer
-	bytesInBuffer := 0
-
+// parseFrom feeds the data in br to the parser until the request is done, or
+// until the headers are done if headersOnly is set.
+func (r *Request) parseFrom(br *bufio.Reader, headersOnly bool) error {
 	for {
-		bytesParsed, err := request.Parse(buffer[:bytesInBuffer])
-		if err != nil {
-			return nil, fmt.Errorf("unable to parse request data: %w", err)
+		if r.State == DONE || (headersOnly && r.State == REQUEST_STATE_PARSING_BODY) {
+			return nil
 		}
 
-		copy(buffer[0:], buffer[bytesParsed:bytesInBuffer])
-		bytesInBuffer -= bytesParsed
+		// Track how many bytes we have read from the io.Reader (request
+		// data) into the buffer
+		bytesInBuffer := br.Buffered()
 
-		if request.State == DONE {
-			break
+		data, err := br.Peek(bytesInBuffer)
+		if err != nil {
+			return fmt.Errorf("unable to read request data: %w", err)
 		}
 
-		if bytesInBuffer == cap(buffer) {
-			newBuffer := make([]byte, cap(buffer)*2)
-			copy(newBuffer, buffer[:bytesInBuffer])
-			buffer = newBuffer
+		bytesParsed, err := r.Parse(data)
+		if err != nil {
+			return fmt.Errorf("unable to parse request data: %w", err)
 		}
 
-		bytesRead, err := reader.Read(buffer[bytesInBuffer:])
+		_, err = br.Discard(bytesParsed)
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				if request.State != DONE {
-					return nil, fmt.Errorf("incomplete request, in %v state, read %v bytes.", request.State, bytesRead)
-				}
-				break
-			}
+			return fmt.Errorf("unable to read request data: %w", err)
 		}
 
-		bytesInBuffer += bytesRead
-	}
+		if bytesParsed > 0 {
+			continue
+		}
 
-	// Check for body length and content-length mismatch.
-	contentLength := request.Headers.Get("content-length")
-	if contentLength != "" {
-		contentLengthInt, err := strconv.Atoi(contentLength)
-		bodyLen := len(request.Body)
+		// The parser needs more data than the buffer can hold, i.e. a
+		// single line is too long.
+		if bytesInBuffer == br.Size() {
+			return fmt.Errorf("request line or header line exceeds %d bytes", br.Size())
+		}
 
-		if err != nil || contentLengthInt < 0 {
-			return nil, fmt.Errorf("invalid content-length: %v", err)
+		// Block until at least one more byte arrives.
+		_, err = br.Peek(bytesInBuffer + 1)
+		if err == nil {
+			continue
 		}
 
-		if bodyLen < contentLengthInt {
-			return nil, fmt.Errorf("body length and content-length mismatch: expected %d, got %d", contentLengthInt, bodyLen)
+		if !errors.Is(err, io.EOF) {
+			return fmt.Errorf("unable to read request data: %w", err)
 		}
+
+		// Be lenient with clients that stop sending after the last complete
+		// header line without the empty line that ends the headers.
+		if r.State == REQUEST_STATE_PARSING_HEADERS && bytesInBuffer == 0 {
+			err = r.finishHeaders()
+			if err != nil {
+				return fmt.Errorf("unable to parse request data: %w", err)
+			}
+			continue
+		}
+
+		return fmt.Errorf("incomplete request, in %v state, read %v bytes.", r.State, bytesInBuffer)
+	}
+}
+
+// finishHeaders moves the parser on from the headers, to the body if
+// Content-Length says there is one.
+func (r *Request) finishHeaders() error {
+	contentLength := r.Headers.Get("content-length")
+	if contentLength == "" {
+		r.State = DONE
+		return nil
 	}
 
-	return request, nil
+	contentLengthInt, err := strconv.Atoi(contentLength)
+	if err != nil || contentLengthInt < 0 {
+		return fmt.Errorf("invalid Content-Length: %v", contentLength)
+	}
+
+	if contentLengthInt == 0 {
+		r.State = DONE
+	} else {
+		r.State = REQUEST_STATE_PARSING_BODY
+	}
+
+	return nil
 }
 
 func parseRequestLine(requestData []byte) (*RequestLine, int, error) {
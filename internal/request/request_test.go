@@ -1,6 +1,9 @@
 package request
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"io"
 	"testing"
 
@@ -114,6 +117,16 @@ func TestRequestFromReader_Headers(t *testing.T) {
 	assert.Equal(t, "curl/7.81.0", req.Headers["user-agent"])
 	assert.Equal(t, "*/*", req.Headers["accept"])
 
+	// Test: header values keep their case
+	reader = &chunkReader{
+		data:            "GET /events HTTP/1.1\r\nHost: localhost:42069\r\nLast-Event-ID: Msg-42\r\nIf-None-Match: \"XyZ\"\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	req, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "Msg-42", req.Headers.Get("Last-Event-ID"))
+	assert.Equal(t, `"XyZ"`, req.Headers.Get("If-None-Match"))
+
 	// Test: missing end of headers
 	reader = &chunkReader{
 		data:            "GET /coffee HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n",
@@ -188,7 +201,8 @@ func TestRequestBody(t *testing.T) {
 	require.NotNil(t, req)
 	assert.Equal(t, "0", req.Headers.Get("content-length"))
 
-	// Test: No content-length but body exists
+	// Test: No content-length means no body, whatever follows is left
+	// unread (RFC 9112 6.3)
 	reader = &chunkReader{
 		data: "POST /submit HTTP/1.1\r\n" +
 			"Host: localhost:42069\r\n" +
@@ -197,6 +211,88 @@ func TestRequestBody(t *testing.T) {
 		numBytesPerRead: 3,
 	}
 	req, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, req)
+	assert.Empty(t, req.Body)
+}
+
+func TestRequestExpectContinue(t *testing.T) {
+	// Test: body is left unread until asked for
+	br := bufio.NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 13\r\n" +
+			"Expect: 100-continue\r\n" +
+			"\r\n" +
+			"hello world!\n",
+		numBytesPerRead: 3,
+	})
+	req, err := RequestHeadersFromReader(br)
+	require.NoError(t, err)
+	require.NotNil(t, req)
+	assert.True(t, req.ExpectsContinue())
+	assert.Empty(t, req.Body)
+
+	continued := false
+	req.SetBeforeBodyRead(func() error {
+		continued = true
+		return nil
+	})
+	body, err := req.ReadBody()
+	require.NoError(t, err)
+	assert.True(t, continued)
+	assert.Equal(t, "hello world!\n", string(body))
+
+	// Test: body isn't read if the hook fails
+	br = bufio.NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Content-Length: 13\r\n" +
+			"Expect: 100-continue\r\n" +
+			"\r\n" +
+			"hello world!\n",
+		numBytesPerRead: 3,
+	})
+	req, err = RequestHeadersFromReader(br)
+	require.NoError(t, err)
+	req.SetBeforeBodyRead(func() error {
+		return errors.New("already rejected")
+	})
+	_, err = req.ReadBody()
 	require.Error(t, err)
-	require.Nil(t, req)
+	assert.Empty(t, req.Body)
+
+	// Test: no body, nothing to wait for
+	br = bufio.NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Content-Length: 0\r\n" +
+			"Expect: 100-continue\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	})
+	req, err = RequestHeadersFromReader(br)
+	require.NoError(t, err)
+	assert.False(t, req.ExpectsContinue())
+}
+
+type ctxKey struct{}
+
+func TestRequestContext(t *testing.T) {
+	r, err := RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+
+	// Test: never nil
+	assert.Equal(t, context.Background(), r.Context())
+
+	// Test: WithContext changes the context of a copy only
+	ctx := context.WithValue(context.Background(), ctxKey{}, "value")
+	r2 := r.WithContext(ctx)
+	assert.Equal(t, "value", r2.Context().Value(ctxKey{}))
+	assert.Nil(t, r.Context().Value(ctxKey{}))
+	assert.Equal(t, r.RequestLine, r2.RequestLine)
+
+	// Test: nil contexts are refused
+	assert.Panics(t, func() { r.WithContext(nil) })
 }
@@ -9,15 +9,34 @@ import (
 )
 
 func (w *Writer) WriteBody(data []byte) (int, error) {
-	if w.State != stateWrittenHeaders {
+	if w.State != stateWrittenHeaders && w.State != stateWrittenBody {
 		return 0, errors.New("headers must be written before writing body")
 	}
 
 	w.State = stateWrittenBody
+
+	if w.compressor != nil {
+		return w.compressor.write(w, data)
+	}
+
 	return w.Writer.Write(data)
 }
 
+// Write lets the writer be used as an io.Writer for the body, e.g. with
+// io.Copy.
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.WriteBody(p)
+}
+
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if w.compressor != nil {
+		return w.compressor.write(w, p)
+	}
+
+	return w.writeChunk(p)
+}
+
+func (w *Writer) writeChunk(p []byte) (int, error) {
 	// Refer to RFC 9112 7.1
 	totalBytesWritten := 0
 
@@ -31,9 +50,16 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 
 	totalBytesWritten += n
 
-	// Followed by the chunk data
-	chunkData := append(p, '\r', '\n')
-	n, err = w.Writer.Write(chunkData)
+	// Followed by the chunk data. The writes are buffered, so there is no
+	// need to copy p just to append the CRLF to it.
+	n, err = w.Writer.Write(p)
+	if err != nil {
+		return 0, err
+	}
+
+	totalBytesWritten += n
+
+	n, err = io.WriteString(w.Writer, "\r\n")
 	if err != nil {
 		return 0, err
 	}
@@ -42,6 +68,15 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 }
 
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	// Whatever is still held by the compressor has to go out before the
+	// last chunk.
+	if w.compressor != nil {
+		err := w.compressor.close(w)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	// Write the final chunked data section
 	totalBytesWritten := 0
 
@@ -57,17 +92,5 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 }
 
 func (w *Writer) WriteTrailers(h headers.Headers) error {
-	crlf := []byte("\r\n")
-
-	for k, v := range h {
-		headerLine := fmt.Sprintf("%v: %v\r\n", k, v)
-		_, err := w.Writer.Write([]byte(headerLine))
-		if err != nil {
-			return err
-		}
-	}
-
-	// Write CRLF to end the trailers section
-	_, err := w.Writer.Write(crlf)
-	return err
+	return w.writeFieldLines(h)
 }
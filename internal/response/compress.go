@@ -0,0 +1,397 @@
+package response
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+)
+
+// Content codings supported by the compression layer.
+const (
+	EncodingGzip    string = "gzip"
+	EncodingDeflate string = "deflate"
+)
+
+// Bodies smaller than this are sent as is. Compressing them costs more than
+// it saves.
+const DefaultMinCompressSize int = 1024
+
+// Content types that are already compressed. Compressing them again only
+// wastes CPU.
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/pdf",
+	"application/octet-stream",
+}
+
+var (
+	gzipWriterPool = sync.Pool{
+		New: func() any {
+			return gzip.NewWriter(nil)
+		},
+	}
+	flateWriterPool = sync.Pool{
+		New: func() any {
+			fw, _ := flate.NewWriter(nil, flate.DefaultCompression)
+			return fw
+		},
+	}
+)
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+type compressor struct {
+	encoding string
+	minSize  int
+
+	// Header block held back until we know whether the body is big enough
+	// to compress. nil once the headers have been written.
+	headers headers.Headers
+	// Body bytes received while the decision is still pending.
+	buf bytes.Buffer
+	// Whether the handler frames the body with chunked encoding itself.
+	chunked bool
+
+	enc    encoder
+	closed bool
+}
+
+// Compress installs a compression layer on the writer. Body data written
+// afterwards is compressed with the given content coding, provided the
+// response is worth compressing. An empty encoding leaves the body untouched
+// but still marks the response as varying on Accept-Encoding.
+//
+// Compress must be called before the headers are written.
+func (w *Writer) Compress(encoding string, minSize int) {
+	w.compressor = &compressor{
+		encoding: encoding,
+		minSize:  minSize,
+	}
+}
+
+// NegotiateEncoding picks the preferred content coding we support from the
+// value of an Accept-Encoding header. It returns an empty string if the
+// response should not be compressed. Refer to RFC 9110 12.5.3.
+func NegotiateEncoding(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	qualities := map[string]float64{}
+	wildcard := -1.0
+
+	for _, member := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(member, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				parsed = 0
+			}
+			q = parsed
+		}
+
+		if coding == "*" {
+			wildcard = q
+			continue
+		}
+		qualities[coding] = q
+	}
+
+	best := ""
+	bestQ := 0.0
+
+	// Ties go to gzip since it is listed first.
+	for _, coding := range []string{EncodingGzip, EncodingDeflate} {
+		q, ok := qualities[coding]
+		if !ok {
+			q = wildcard
+		}
+
+		if q > bestQ {
+			best = coding
+			bestQ = q
+		}
+	}
+
+	return best
+}
+
+func (c *compressor) writeHeaders(w *Writer, h headers.Headers) error {
+	// The response depends on Accept-Encoding whether we compress it or not.
+	// Vary: * covers it already.
+	if vary := h.Get("vary"); vary != "*" && !hasToken(vary, "accept-encoding") {
+		if vary != "" {
+			vary += ", "
+		}
+		h.Replace("Vary", vary+"Accept-Encoding")
+	}
+
+	// Needed either way, chunked bodies written as is still need framing.
+	c.chunked = strings.EqualFold(h.Get("transfer-encoding"), "chunked")
+
+	if !c.shouldCompress(w, h) {
+		return w.writeFieldLines(h)
+	}
+
+	c.headers = h
+
+	// With a known length we don't need to wait for the body to decide.
+	if h.Get("content-length") != "" {
+		return c.start(w)
+	}
+
+	return nil
+}
+
+func (c *compressor) shouldCompress(w *Writer, h headers.Headers) bool {
+	if c.encoding == "" {
+		return false
+	}
+
+	// No body, or a body describing something other than the full
+	// representation.
+	switch {
+	case strings.HasPrefix(w.statusCode, "1"),
+		w.statusCode == "204",
+		w.statusCode == "206",
+		w.statusCode == "304":
+		return false
+	}
+
+	// Already encoded by the handler.
+	if h.Get("content-encoding") != "" {
+		return false
+	}
+
+	contentType := strings.ToLower(h.Get("content-type"))
+	for _, t := range incompressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return false
+		}
+	}
+
+	if contentLength := h.Get("content-length"); contentLength != "" {
+		n, err := strconv.Atoi(contentLength)
+		if err != nil || n < c.minSize {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *compressor) write(w *Writer, p []byte) (int, error) {
+	if c.enc != nil {
+		return c.enc.Write(p)
+	}
+
+	// Decided against compressing.
+	if c.headers == nil {
+		return c.writeRaw(w, p)
+	}
+
+	c.buf.Write(p)
+	if c.buf.Len() < c.minSize {
+		return len(p), nil
+	}
+
+	err := c.start(w)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// start writes the pending headers rewritten for the compressed body and
+// sends everything buffered so far through the encoder.
+func (c *compressor) start(w *Writer) error {
+	h := c.headers
+	c.headers = nil
+
+	// The compressed length is unknown up front, so the body is always sent
+	// chunked.
+	h.Del("Content-Length")
+	h.Del("Transfer-Encoding")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Content-Encoding", c.encoding)
+
+	// The compressed body is another representation, which mustn't share
+	// the strong validator of the identity one. It's still the same
+	// content, so a weak one will do. Refer to RFC 9110 8.8.3.
+	if etag := h.Get("etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Replace("ETag", "W/"+etag)
+	}
+
+	err := w.writeFieldLines(h)
+	if err != nil {
+		return err
+	}
+
+	sink := chunkWriter{w: w}
+
+	switch c.encoding {
+	case EncodingGzip:
+		gw := gzipWriterPool.Get().(*gzip.Writer)
+		gw.Reset(sink)
+		c.enc = gw
+	case EncodingDeflate:
+		fw := flateWriterPool.Get().(*flate.Writer)
+		fw.Reset(sink)
+		c.enc = fw
+	}
+
+	_, err = c.enc.Write(c.buf.Bytes())
+	c.buf.Reset()
+	return err
+}
+
+// skip writes the pending headers untouched followed by the buffered body.
+func (c *compressor) skip(w *Writer) error {
+	h := c.headers
+	c.headers = nil
+
+	err := w.writeFieldLines(h)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.writeRaw(w, c.buf.Bytes())
+	c.buf.Reset()
+	return err
+}
+
+func (c *compressor) writeRaw(w *Writer, p []byte) (int, error) {
+	if c.chunked {
+		// A zero-size chunk would end the body early.
+		if len(p) == 0 {
+			return 0, nil
+		}
+
+		_, err := w.writeChunk(p)
+		if err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	return w.Writer.Write(p)
+}
+
+func (c *compressor) flush(w *Writer) error {
+	// A streaming handler wants its data out now, so stop waiting for more
+	// of the body.
+	if c.headers != nil {
+		err := c.start(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.enc != nil {
+		return c.enc.Flush()
+	}
+
+	return nil
+}
+
+// close finishes the body. It is called when the handler ends the chunked
+// body, or when the handler returns.
+func (c *compressor) close(w *Writer) error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	if c.headers != nil {
+		return c.skip(w)
+	}
+
+	if c.enc == nil {
+		return nil
+	}
+
+	err := c.enc.Close()
+
+	switch enc := c.enc.(type) {
+	case *gzip.Writer:
+		enc.Reset(nil)
+		gzipWriterPool.Put(enc)
+	case *flate.Writer:
+		enc.Reset(nil)
+		flateWriterPool.Put(enc)
+	}
+	c.enc = nil
+
+	if err != nil {
+		return err
+	}
+
+	// We switched a fixed-length body to chunked, so we have to end it.
+	// Handlers that already write chunked end the body themselves.
+	if !c.chunked {
+		_, err = io.WriteString(w.Writer, "0\r\n\r\n")
+	}
+
+	return err
+}
+
+// chunkWriter frames the encoder output as chunks.
+type chunkWriter struct {
+	w *Writer
+}
+
+func (cw chunkWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	_, err := cw.w.writeChunk(p)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// hasToken reports whether the comma-separated list contains token, ignoring
+// case.
+func hasToken(list, token string) bool {
+	for _, element := range strings.Split(list, ",") {
+		if strings.EqualFold(strings.TrimSpace(element), token) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,194 @@
+package response
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/johndosdos/http-from-tcp/internal/conntest"
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	// Test: no Accept-Encoding
+	assert.Equal(t, "", NegotiateEncoding(""))
+
+	// Test: single coding
+	assert.Equal(t, EncodingDeflate, NegotiateEncoding("deflate"))
+
+	// Test: gzip preferred on ties
+	assert.Equal(t, EncodingGzip, NegotiateEncoding("deflate, gzip"))
+
+	// Test: q-values
+	assert.Equal(t, EncodingDeflate, NegotiateEncoding("gzip;q=0.5, deflate;q=0.8"))
+
+	// Test: explicitly refused coding
+	assert.Equal(t, "", NegotiateEncoding("gzip;q=0, br"))
+
+	// Test: wildcard
+	assert.Equal(t, EncodingDeflate, NegotiateEncoding("gzip;q=0, *"))
+
+	// Test: unsupported codings only
+	assert.Equal(t, "", NegotiateEncoding("br, zstd"))
+}
+
+// writeResponse runs fn against a writer on one end of a pipe and parses
+// the response read from the other end, returning it with its body read. fn
+// runs on the server goroutine, so it returns its errors for the test
+// goroutine to report.
+func writeResponse(t *testing.T, fn func(w *Writer) error) (*http.Response, []byte) {
+	t.Helper()
+
+	errs := make(chan error, 1)
+	resp := conntest.Response(t, "", func(conn net.Conn) {
+		w := NewWriter(conn)
+		err := fn(&w)
+		if finishErr := w.Finish(); err == nil {
+			err = finishErr
+		}
+		errs <- err
+	})
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, <-errs)
+
+	return resp, body
+}
+
+// writeFixed writes a response with headers h and body written in one go.
+func writeFixed(w *Writer, h headers.Headers, body string) error {
+	err := w.WriteStatusLine(StatusOK)
+	if err != nil {
+		return err
+	}
+
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.WriteBody([]byte(body))
+	return err
+}
+
+// writeChunked writes a chunked response with headers h, one chunk per
+// part.
+func writeChunked(w *Writer, h headers.Headers, parts ...string) error {
+	err := w.WriteStatusLine(StatusOK)
+	if err != nil {
+		return err
+	}
+
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return err
+	}
+
+	for _, part := range parts {
+		_, err = w.WriteChunkedBody([]byte(part))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = w.WriteChunkedBodyDone()
+	if err != nil {
+		return err
+	}
+
+	return w.WriteTrailers(headers.NewHeaders())
+}
+
+// gunzip returns the decompressed data.
+func gunzip(t *testing.T, data []byte) string {
+	t.Helper()
+
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	decompressed, err := io.ReadAll(gr)
+	require.NoError(t, err)
+
+	return string(decompressed)
+}
+
+func TestCompress(t *testing.T) {
+	body := strings.Repeat("hello world! ", 200)
+
+	// Test: fixed-length body
+	resp, data := writeResponse(t, func(w *Writer) error {
+		w.Compress(EncodingGzip, DefaultMinCompressSize)
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "text/plain")
+		h.Set("Content-Length", "2600")
+		h.Set("ETag", `"abc"`)
+		return writeFixed(w, h, body)
+	})
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(t, body, gunzip(t, data))
+
+	// Test: the compressed body gets a weak ETag of its own
+	assert.Equal(t, `W/"abc"`, resp.Header.Get("ETag"))
+
+	// Test: chunked body
+	resp, data = writeResponse(t, func(w *Writer) error {
+		w.Compress(EncodingGzip, DefaultMinCompressSize)
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "text/plain")
+		h.Set("Transfer-Encoding", "chunked")
+		return writeChunked(w, h, body, body, body, body)
+	})
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, strings.Repeat(body, 4), gunzip(t, data))
+
+	// Test: chunked body the client doesn't accept compressed keeps its
+	// chunk framing
+	resp, data = writeResponse(t, func(w *Writer) error {
+		w.Compress("", DefaultMinCompressSize)
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "text/plain")
+		h.Set("Transfer-Encoding", "chunked")
+		return writeChunked(w, h, "hello")
+	})
+	assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(t, "hello", string(data))
+
+	// Test: tiny body is sent as is
+	resp, data = writeResponse(t, func(w *Writer) error {
+		w.Compress(EncodingGzip, DefaultMinCompressSize)
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "text/plain")
+		h.Set("ETag", `"abc"`)
+		h.Set("Vary", "accept-encoding")
+		return writeFixed(w, h, "tiny")
+	})
+	assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, `"abc"`, resp.Header.Get("ETag"))
+	assert.Equal(t, "tiny", string(data))
+
+	// Test: Vary already listing Accept-Encoding is left alone
+	assert.Equal(t, []string{"accept-encoding"}, resp.Header.Values("Vary"))
+
+	// Test: already compressed content type
+	resp, data = writeResponse(t, func(w *Writer) error {
+		w.Compress(EncodingGzip, DefaultMinCompressSize)
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "image/png")
+		h.Set("Vary", "Origin")
+		return writeFixed(w, h, body)
+	})
+	assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, body, string(data))
+
+	// Test: Accept-Encoding is added to the other headers Vary lists
+	assert.Equal(t, []string{"Origin, Accept-Encoding"}, resp.Header.Values("Vary"))
+}
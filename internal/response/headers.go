@@ -3,6 +3,7 @@ package response
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/johndosdos/http-from-tcp/internal/headers"
 )
@@ -12,18 +13,32 @@ func (w *Writer) WriteHeaders(headers headers.Headers) error {
 		return errors.New("status line must be written before writing headers")
 	}
 
+	w.State = stateWrittenHeaders
+	w.chunked = strings.EqualFold(headers.Get("transfer-encoding"), "chunked")
+
+	// The compression layer may need to rewrite the headers once it knows
+	// how big the body is, so it decides when they go out.
+	if w.compressor != nil {
+		return w.compressor.writeHeaders(w, headers)
+	}
+
+	return w.writeFieldLines(headers)
+}
+
+func (w *Writer) writeFieldLines(h headers.Headers) error {
 	crlf := []byte("\r\n")
 
-	for k, v := range headers {
-		headerLine := fmt.Sprintf("%v: %v\r\n", k, v)
-		_, err := w.Writer.Write([]byte(headerLine))
-		if err != nil {
-			return err
+	for k := range h {
+		for _, v := range h.Values(k) {
+			headerLine := fmt.Sprintf("%v: %v\r\n", k, v)
+			_, err := w.Writer.Write([]byte(headerLine))
+			if err != nil {
+				return err
+			}
 		}
 	}
 
-	// Write CRLF to end the headers section
+	// Write CRLF to end the field lines section
 	_, err := w.Writer.Write(crlf)
-	w.State = stateWrittenHeaders
 	return err
 }
@@ -0,0 +1,55 @@
+package response
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHijack(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	// The client sent more than the request before we got to parse it.
+	br := bufio.NewReader(strings.NewReader("GET /chat HTTP/1.1\r\nHost: localhost:42069\r\n\r\nHELLO"))
+	req, err := request.RequestFromReader(br)
+	require.NoError(t, err)
+	assert.Equal(t, "/chat", req.RequestLine.RequestTarget)
+
+	w := NewWriter(server)
+	w.SetReader(br)
+
+	go func() {
+		require.NoError(t, w.WriteStatusLine(StatusSwitchingProtocols))
+		require.NoError(t, w.WriteHeaders(map[string]string{"Upgrade": "test"}))
+
+		// Test: status line and headers are flushed before the conn is
+		// handed over
+		conn, buffered, err := w.Hijack()
+		require.NoError(t, err)
+		assert.True(t, w.Hijacked())
+
+		// Test: bytes buffered past the request are handed over
+		assert.Equal(t, "HELLO", string(buffered))
+
+		// Test: the writer can't be hijacked twice
+		_, _, err = w.Hijack()
+		require.Error(t, err)
+
+		// Test: finishing a hijacked writer leaves the conn alone
+		require.NoError(t, w.Finish())
+		_, err = conn.Write([]byte("raw bytes"))
+		require.NoError(t, err)
+		conn.Close()
+	}()
+
+	data, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\n\r\nraw bytes", string(data))
+}
@@ -0,0 +1,69 @@
+package response
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+)
+
+// WriteInformational writes an interim 1xx response with its own header
+// block. Any number of them may precede the final status line. Each one is
+// flushed right away, since the point is for the client to act on it before
+// the final response is ready. Refer to RFC 9110 15.2.
+//
+// 101 Switching Protocols isn't interim, it ends the HTTP exchange, so it is
+// written with WriteStatusLine like any final status.
+func (w *Writer) WriteInformational(statusCode string, h headers.Headers) error {
+	if w.State != stateInit {
+		return errors.New("informational responses must be written before the final status line")
+	}
+
+	if !strings.HasPrefix(statusCode, "1") || len(statusCode) != 3 || statusCode == StatusSwitchingProtocols {
+		return fmt.Errorf("invalid informational status code: %v", statusCode)
+	}
+
+	statusLine := fmt.Sprintf("HTTP/1.1 %v %v\r\n", statusCode, reasonPhrase(statusCode))
+	_, err := w.Writer.Write([]byte(statusLine))
+	if err != nil {
+		return err
+	}
+
+	err = w.writeFieldLines(h)
+	if err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// WriteContinue tells a client that sent Expect: 100-continue to go ahead
+// with the body. It fails once the final status line has been written.
+func (w *Writer) WriteContinue() error {
+	return w.WriteInformational(StatusContinue, headers.NewHeaders())
+}
+
+// WriteEarlyHints sends a 103 Early Hints response with the given Link
+// header values, so the client can start fetching resources the final
+// response will need while the server is still working on it. Refer to
+// RFC 8297.
+func (w *Writer) WriteEarlyHints(links ...string) error {
+	h := headers.NewHeaders()
+	for _, link := range links {
+		h.Set("Link", link)
+	}
+
+	return w.WriteInformational(StatusEarlyHints, h)
+}
+
+// PreloadLink formats a Link header value asking the client to preload the
+// resource at url. as is the kind of resource, e.g. "style" or "script".
+func PreloadLink(url, as string) string {
+	link := fmt.Sprintf("<%s>; rel=preload", url)
+	if as != "" {
+		link += "; as=" + as
+	}
+
+	return link
+}
@@ -0,0 +1,47 @@
+package response
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteInformational(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		w := NewWriter(server)
+
+		// Test: several interim responses before the final one
+		require.NoError(t, w.WriteContinue())
+		require.NoError(t, w.WriteEarlyHints(PreloadLink("/style.css", "style"), PreloadLink("/app.js", "script")))
+
+		// Test: 101 is not an interim response
+		require.Error(t, w.WriteInformational(StatusSwitchingProtocols, headers.NewHeaders()))
+
+		// Test: only 1xx status codes
+		require.Error(t, w.WriteInformational(StatusOK, headers.NewHeaders()))
+
+		require.NoError(t, w.WriteStatusLine(StatusOK))
+		require.NoError(t, w.WriteHeaders(headers.Headers{"Content-Length": "2"}))
+		_, err := w.WriteBody([]byte("ok"))
+		require.NoError(t, err)
+
+		// Test: no interim responses after the final status line
+		require.Error(t, w.WriteContinue())
+
+		w.Finish()
+		server.Close()
+	}()
+
+	data, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n"+
+		"HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload; as=style, </app.js>; rel=preload; as=script\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", string(data))
+}
@@ -0,0 +1,529 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+)
+
+// Response is a response parsed off the wire, the counterpart of
+// request.Request.
+type Response struct {
+	StatusLine StatusLine
+	Headers    headers.Headers
+	Body       []byte
+	// Trailers are the fields sent after a chunked body.
+	Trailers headers.Headers
+	// Interim are the 1xx responses received before this one, e.g.
+	// 103 Early Hints.
+	Interim []InterimResponse
+	// ContentLength is the length of the body, or -1 if it isn't known
+	// until the body has been read.
+	ContentLength int64
+
+	state parserState
+	// Method of the request this is the response to. Responses to HEAD
+	// never have a body.
+	method string
+	// Bytes left in the body or the current chunk.
+	remaining int64
+	// Where the rest of the body is read from when it wasn't read along with
+	// the headers. See BodyReader.
+	reader *bufio.Reader
+}
+
+type StatusLine struct {
+	HttpVersion  string
+	StatusCode   string
+	ReasonPhrase string
+}
+
+// InterimResponse is a 1xx response preceding the final one.
+type InterimResponse struct {
+	StatusLine StatusLine
+	Headers    headers.Headers
+}
+
+type parserState int
+
+const (
+	stateParsingStatusLine parserState = iota
+	stateParsingHeaders
+	stateParsingBody
+	stateParsingChunkSize
+	stateParsingChunkData
+	stateParsingChunkEnd
+	stateParsingTrailers
+	stateParsingBodyUntilClose
+	stateParsingDone
+)
+
+// Limit on the interim responses before the final one.
+const maxInterimResponses = 10
+
+// Size of the buffer responses are read into. This also caps the length of
+// the status line and of each field line.
+const parserBufferSize = 8192
+
+// Parse parses as much of data as it can in the current state and returns
+// the number of bytes it consumed. Zero means more data is needed.
+func (r *Response) Parse(data []byte) (int, error) {
+	n, body, err := r.parse(data)
+	r.Body = append(r.Body, body...)
+
+	return n, err
+}
+
+// parse is Parse without collecting the body, which is returned instead.
+func (r *Response) parse(data []byte) (int, []byte, error) {
+	switch r.state {
+	case stateParsingStatusLine:
+		line, n := nextLine(data)
+		if n == 0 {
+			return 0, nil, nil
+		}
+
+		statusLine, err := parseStatusLine(line)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		r.StatusLine = *statusLine
+		r.state = stateParsingHeaders
+		return n, nil, nil
+	case stateParsingHeaders:
+		n, done, err := parseFields(r.Headers, data)
+		if err != nil || !done {
+			return n, nil, err
+		}
+
+		err = r.finishHeaders()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		return n, nil, nil
+	case stateParsingBody, stateParsingChunkData:
+		n := int(min(int64(len(data)), r.remaining))
+		r.remaining -= int64(n)
+
+		if r.remaining == 0 {
+			if r.state == stateParsingBody {
+				r.state = stateParsingDone
+			} else {
+				r.state = stateParsingChunkEnd
+			}
+		}
+
+		return n, data[:n], nil
+	case stateParsingChunkSize:
+		line, n := nextLine(data)
+		if n == 0 {
+			return 0, nil, nil
+		}
+
+		size, err := parseChunkSize(line)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if size == 0 {
+			r.state = stateParsingTrailers
+		} else {
+			r.remaining = size
+			r.state = stateParsingChunkData
+		}
+
+		return n, nil, nil
+	case stateParsingChunkEnd:
+		if len(data) < 2 {
+			return 0, nil, nil
+		}
+
+		// Every chunk ends with a CRLF.
+		if !bytes.HasPrefix(data, []byte("\r\n")) {
+			return 0, nil, errors.New("chunk data longer than its size")
+		}
+
+		r.state = stateParsingChunkSize
+		return 2, nil, nil
+	case stateParsingTrailers:
+		n, done, err := parseFields(r.Trailers, data)
+		if err != nil || !done {
+			return n, nil, err
+		}
+
+		r.state = stateParsingDone
+		return n, nil, nil
+	case stateParsingBodyUntilClose:
+		return len(data), data, nil
+	case stateParsingDone:
+		return 0, nil, errors.New("error: trying to read data in 'done' state")
+	}
+
+	return 0, nil, fmt.Errorf("error: parser encountered unknown state: %v", r.state)
+}
+
+// ResponseFromReader parses the response to a request with method, including
+// its body. Bodies without a length are read until the end of reader.
+func ResponseFromReader(reader io.Reader, method string) (*Response, error) {
+	response := NewResponse(method)
+
+	// Parse straight out of the bufio.Reader's buffer and only discard what
+	// has been parsed, so whatever follows the response stays in br.
+	br, ok := reader.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReaderSize(reader, parserBufferSize)
+	}
+
+	err := response.parseFrom(br, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// ResponseHeadersFromReader parses the status line and headers of the
+// response to a request with method, skipping interim responses, but leaves
+// the body in br. The body is read through BodyReader.
+func ResponseHeadersFromReader(br *bufio.Reader, method string) (*Response, error) {
+	response := NewResponse(method)
+
+	err := response.parseFrom(br, true)
+	if err != nil {
+		return nil, err
+	}
+
+	response.reader = br
+
+	return response, nil
+}
+
+// BodyReader returns a reader for the body. If the body hasn't been read
+// yet, it is streamed from the connection instead of being read into Body,
+// which is left empty. The trailers are parsed once it returns io.EOF.
+func (r *Response) BodyReader() io.Reader {
+	if r.state == stateParsingDone || r.reader == nil {
+		return bytes.NewReader(r.Body)
+	}
+
+	return &bodyReader{response: r}
+}
+
+// DelimitedByClose reports whether the body ends when the connection does,
+// which leaves the connection unusable for another response.
+func (r *Response) DelimitedByClose() bool {
+	return r.state == stateParsingBodyUntilClose
+}
+
+type bodyReader struct {
+	response *Response
+}
+
+func (br *bodyReader) Read(p []byte) (int, error) {
+	r := br.response
+
+	for {
+		if r.state == stateParsingDone {
+			return 0, io.EOF
+		}
+
+		bytesInBuffer := r.reader.Buffered()
+
+		data, err := r.reader.Peek(bytesInBuffer)
+		if err != nil {
+			return 0, err
+		}
+
+		// Don't consume more of the body than fits in p.
+		if r.inBodyData() && len(data) > len(p) {
+			data = data[:len(p)]
+		}
+
+		bytesParsed, body, err := r.parse(data)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = r.reader.Discard(bytesParsed)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(body) > 0 {
+			return copy(p, body), nil
+		}
+
+		if bytesParsed > 0 {
+			continue
+		}
+
+		err = r.fill(bytesInBuffer)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// HeadersDone reports whether the status line and headers of the final
+// response have been parsed.
+func (r *Response) HeadersDone() bool {
+	return r.state > stateParsingHeaders
+}
+
+// Done reports whether the whole response has been parsed, including the
+// body and trailers.
+func (r *Response) Done() bool {
+	return r.state == stateParsingDone
+}
+
+func (r *Response) inBodyData() bool {
+	switch r.state {
+	case stateParsingBody, stateParsingChunkData, stateParsingBodyUntilClose:
+		return true
+	}
+
+	return false
+}
+
+// NewResponse returns an empty response to a request with method, for
+// parsing a response fed piece by piece to Parse.
+func NewResponse(method string) *Response {
+	return &Response{
+		Headers:       headers.NewHeaders(),
+		Body:          make([]byte, 0),
+		Trailers:      headers.NewHeaders(),
+		ContentLength: -1,
+		state:         stateParsingStatusLine,
+		method:        method,
+	}
+}
+
+// parseFrom feeds the data in br to the parser until the response is done,
+// or until the headers are done if headersOnly is set.
+func (r *Response) parseFrom(br *bufio.Reader, headersOnly bool) error {
+	r.reader = br
+
+	for {
+		if r.state == stateParsingDone || (headersOnly && r.state > stateParsingHeaders) {
+			return nil
+		}
+
+		bytesInBuffer := br.Buffered()
+
+		data, err := br.Peek(bytesInBuffer)
+		if err != nil {
+			return fmt.Errorf("unable to read response data: %w", err)
+		}
+
+		bytesParsed, err := r.Parse(data)
+		if err != nil {
+			return fmt.Errorf("unable to parse response data: %w", err)
+		}
+
+		_, err = br.Discard(bytesParsed)
+		if err != nil {
+			return fmt.Errorf("unable to read response data: %w", err)
+		}
+
+		if bytesParsed > 0 {
+			continue
+		}
+
+		err = r.fill(bytesInBuffer)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// fill blocks until more than bytesInBuffer bytes are buffered. At the end
+// of a body delimited by the end of the connection, the response is done.
+func (r *Response) fill(bytesInBuffer int) error {
+	// The parser needs more data than the buffer can hold, i.e. a single
+	// line is too long.
+	if bytesInBuffer == r.reader.Size() {
+		return fmt.Errorf("status line or header line exceeds %d bytes", r.reader.Size())
+	}
+
+	_, err := r.reader.Peek(bytesInBuffer + 1)
+	if err == nil {
+		return nil
+	}
+
+	if !errors.Is(err, io.EOF) {
+		return fmt.Errorf("unable to read response data: %w", err)
+	}
+
+	if r.state == stateParsingBodyUntilClose && bytesInBuffer == 0 {
+		r.state = stateParsingDone
+		return nil
+	}
+
+	return fmt.Errorf("incomplete response, in %v state, read %v bytes: %w", r.state, bytesInBuffer, io.ErrUnexpectedEOF)
+}
+
+// finishHeaders moves the parser on from the headers, according to the
+// framing of the response. Refer to RFC 9112 6.3.
+func (r *Response) finishHeaders() error {
+	statusCode := r.StatusLine.StatusCode
+
+	// Interim responses are followed by another response.
+	if statusCode[0] == '1' && statusCode != StatusSwitchingProtocols {
+		if len(r.Interim) == maxInterimResponses {
+			return fmt.Errorf("more than %d interim responses", maxInterimResponses)
+		}
+
+		r.Interim = append(r.Interim, InterimResponse{
+			StatusLine: r.StatusLine,
+			Headers:    r.Headers,
+		})
+		r.StatusLine = StatusLine{}
+		r.Headers = headers.NewHeaders()
+		r.state = stateParsingStatusLine
+		return nil
+	}
+
+	switch {
+	case statusCode == StatusSwitchingProtocols:
+		// The connection speaks another protocol from now on.
+		r.ContentLength = 0
+		r.state = stateParsingDone
+		return nil
+	case r.method == "HEAD" || statusCode == StatusNoContent || statusCode == StatusNotModified:
+		// The headers describe the body that would have been sent.
+		if contentLength, err := parseContentLength(r.Headers.Get("content-length")); err == nil {
+			r.ContentLength = contentLength
+		}
+		r.state = stateParsingDone
+		return nil
+	}
+
+	if te := r.Headers.Get("transfer-encoding"); te != "" {
+		codings := strings.Split(te, ",")
+		if strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			r.state = stateParsingChunkSize
+		} else {
+			r.state = stateParsingBodyUntilClose
+		}
+		return nil
+	}
+
+	if value := r.Headers.Get("content-length"); value != "" {
+		contentLength, err := parseContentLength(value)
+		if err != nil {
+			return err
+		}
+
+		r.ContentLength = contentLength
+		r.remaining = contentLength
+		r.state = stateParsingBody
+		if contentLength == 0 {
+			r.state = stateParsingDone
+		}
+		return nil
+	}
+
+	r.state = stateParsingBodyUntilClose
+	return nil
+}
+
+// parseStatusLine parses e.g. "HTTP/1.1 200 OK". The reason phrase may be
+// empty. Refer to RFC 9112 4.
+func parseStatusLine(line []byte) (*StatusLine, error) {
+	version, rest, ok := bytes.Cut(line, []byte(" "))
+	if !ok {
+		return nil, fmt.Errorf("invalid status line: %q", line)
+	}
+
+	httpVersion, ok := bytes.CutPrefix(version, []byte("HTTP/"))
+	if !ok || (string(httpVersion) != "1.1" && string(httpVersion) != "1.0") {
+		return nil, fmt.Errorf("invalid HTTP version: %q", version)
+	}
+
+	statusCode, reasonPhrase, _ := bytes.Cut(rest, []byte(" "))
+	if len(statusCode) != 3 {
+		return nil, fmt.Errorf("invalid status code: %q", statusCode)
+	}
+	for _, char := range statusCode {
+		if char < '0' || char > '9' {
+			return nil, fmt.Errorf("invalid status code: %q", statusCode)
+		}
+	}
+
+	return &StatusLine{
+		HttpVersion:  string(httpVersion),
+		StatusCode:   string(statusCode),
+		ReasonPhrase: string(reasonPhrase),
+	}, nil
+}
+
+// parseFields feeds field lines in data to h until the empty line that ends
+// them.
+func parseFields(h headers.Headers, data []byte) (int, bool, error) {
+	totalBytesParsed := 0
+
+	for {
+		bytesParsed, done, err := h.Parse(data[totalBytesParsed:])
+		if err != nil {
+			return 0, false, err
+		}
+
+		totalBytesParsed += bytesParsed
+
+		if done || bytesParsed == 0 {
+			return totalBytesParsed, done, nil
+		}
+	}
+}
+
+// parseChunkSize parses the size line of a chunk. Chunk extensions carry
+// nothing we care about. Refer to RFC 9112 7.1.
+func parseChunkSize(line []byte) (int64, error) {
+	sizeField, _, _ := bytes.Cut(line, []byte(";"))
+
+	size, err := strconv.ParseInt(string(bytes.TrimSpace(sizeField)), 16, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid chunk size: %q", line)
+	}
+
+	return size, nil
+}
+
+// parseContentLength parses a Content-Length value. Repeated equal values,
+// e.g. "5, 5", are accepted. Refer to RFC 9110 8.6.
+func parseContentLength(value string) (int64, error) {
+	values := strings.Split(value, ",")
+
+	contentLength, err := strconv.ParseInt(strings.TrimSpace(values[0]), 10, 64)
+	if err != nil || contentLength < 0 {
+		return 0, fmt.Errorf("invalid Content-Length: %q", value)
+	}
+
+	for _, other := range values[1:] {
+		if strings.TrimSpace(other) != strings.TrimSpace(values[0]) {
+			return 0, fmt.Errorf("invalid Content-Length: %q", value)
+		}
+	}
+
+	return contentLength, nil
+}
+
+// nextLine returns the line at the start of data without its CRLF, and the
+// number of bytes up to and including the CRLF. Zero means the line is
+// incomplete.
+func nextLine(data []byte) ([]byte, int) {
+	idx := bytes.Index(data, []byte("\r\n"))
+	if idx == -1 {
+		return nil, 0
+	}
+
+	return data[:idx], idx + 2
+}
@@ -0,0 +1,230 @@
+package response
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type chunkReader struct {
+	data            string
+	numBytesPerRead int
+	pos             int
+}
+
+// Read reads up to len(p) or numBytesPerRead bytes from the string per call,
+// simulating a network connection delivering the data in pieces.
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	if cr.pos >= len(cr.data) {
+		return 0, io.EOF
+	}
+	endIndex := min(cr.pos+cr.numBytesPerRead, len(cr.data))
+	n = copy(p, cr.data[cr.pos:endIndex])
+	cr.pos += n
+	return n, nil
+}
+
+func TestResponseFromReader(t *testing.T) {
+	// Test: status line, headers and content-length body
+	reader := &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 13\r\n\r\nhello, world!",
+		numBytesPerRead: 3,
+	}
+	r, err := ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "1.1", r.StatusLine.HttpVersion)
+	assert.Equal(t, "200", r.StatusLine.StatusCode)
+	assert.Equal(t, "OK", r.StatusLine.ReasonPhrase)
+	assert.Equal(t, "text/plain", r.Headers.Get("content-type"))
+	assert.Equal(t, int64(13), r.ContentLength)
+	assert.Equal(t, "hello, world!", string(r.Body))
+
+	// Test: empty reason phrase
+	reader = &chunkReader{
+		data:            "HTTP/1.0 404 \r\nContent-Length: 0\r\n\r\n",
+		numBytesPerRead: 1,
+	}
+	r, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.StatusLine.HttpVersion)
+	assert.Equal(t, "404", r.StatusLine.StatusCode)
+	assert.Equal(t, "", r.StatusLine.ReasonPhrase)
+	assert.Empty(t, r.Body)
+
+	// Test: chunked body with extensions and trailers
+	reader = &chunkReader{
+		data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n" +
+			"6;name=value\r\nhello,\r\n7\r\n world!\r\n0\r\nX-Checksum: abc123\r\n\r\n",
+		numBytesPerRead: 2,
+	}
+	r, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), r.ContentLength)
+	assert.Equal(t, "hello, world!", string(r.Body))
+	assert.Equal(t, "abc123", r.Trailers.Get("x-checksum"))
+
+	// Test: each Set-Cookie is kept as it was sent
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nSet-Cookie: a=1; Path=/\r\nSet-Cookie: b=2, c\r\nContent-Length: 0\r\n\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a=1; Path=/", "b=2, c"}, r.Headers.Values("set-cookie"))
+
+	// Test: body delimited by the end of the connection
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nuntil the end",
+		numBytesPerRead: 4,
+	}
+	r, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "until the end", string(r.Body))
+
+	// Test: transfer coding other than chunked is read until the end
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip\r\n\r\ncompressed",
+		numBytesPerRead: 4,
+	}
+	r, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "compressed", string(r.Body))
+
+	// Test: interim responses are collected
+	reader = &chunkReader{
+		data: "HTTP/1.1 100 Continue\r\n\r\n" +
+			"HTTP/1.1 103 Early Hints\r\nLink: </style.css>\r\n\r\n" +
+			"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+		numBytesPerRead: 5,
+	}
+	r, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "200", r.StatusLine.StatusCode)
+	assert.Equal(t, "", r.Headers.Get("link"))
+	assert.Equal(t, "ok", string(r.Body))
+	require.Len(t, r.Interim, 2)
+	assert.Equal(t, "100", r.Interim[0].StatusLine.StatusCode)
+	assert.Equal(t, "103", r.Interim[1].StatusLine.StatusCode)
+	assert.Equal(t, "</style.css>", r.Interim[1].Headers.Get("link"))
+
+	// Test: responses without a body
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = ResponseFromReader(reader, "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), r.ContentLength)
+	assert.Empty(t, r.Body)
+
+	reader = &chunkReader{
+		data:            "HTTP/1.1 304 Not Modified\r\nETag: \"v1\"\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+
+	reader = &chunkReader{
+		data:            "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "101", r.StatusLine.StatusCode)
+	assert.Empty(t, r.Interim)
+
+	// Test: repeated equal content lengths
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nContent-Length: 2\r\n\r\nok",
+		numBytesPerRead: 3,
+	}
+	r, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(r.Body))
+
+	// Test: conflicting content lengths
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nContent-Length: 3\r\n\r\nok",
+		numBytesPerRead: 3,
+	}
+	_, err = ResponseFromReader(reader, "GET")
+	assert.Error(t, err)
+
+	// Test: truncated body
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort",
+		numBytesPerRead: 3,
+	}
+	_, err = ResponseFromReader(reader, "GET")
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: malformed status lines
+	for _, statusLine := range []string{"HTTP/1.1 OK", "HTTP/2 200 OK", "HTTP/1.1 2000 OK", "200 OK"} {
+		reader = &chunkReader{
+			data:            statusLine + "\r\n\r\n",
+			numBytesPerRead: 3,
+		}
+		_, err = ResponseFromReader(reader, "GET")
+		assert.Error(t, err, statusLine)
+	}
+
+	// Test: too many interim responses
+	reader = &chunkReader{
+		data:            strings.Repeat("HTTP/1.1 100 Continue\r\n\r\n", maxInterimResponses+1),
+		numBytesPerRead: 10,
+	}
+	_, err = ResponseFromReader(reader, "GET")
+	assert.Error(t, err)
+}
+
+func TestResponseBodyReader(t *testing.T) {
+	// Test: chunked body is streamed, leaving the next response in the reader
+	br := bufio.NewReader(&chunkReader{
+		data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\nX-Checksum: abc123\r\n\r\n" +
+			"HTTP/1.1 204 No Content\r\n\r\n",
+		numBytesPerRead: 7,
+	})
+	r, err := ResponseHeadersFromReader(br, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "", r.Trailers.Get("x-checksum"))
+
+	body, err := io.ReadAll(r.BodyReader())
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.Empty(t, r.Body)
+	assert.Equal(t, "abc123", r.Trailers.Get("x-checksum"))
+	assert.False(t, r.DelimitedByClose())
+
+	r, err = ResponseHeadersFromReader(br, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "204", r.StatusLine.StatusCode)
+
+	// Test: reads are limited to the size of the buffer
+	br = bufio.NewReader(&chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n0123456789",
+		numBytesPerRead: 100,
+	})
+	r, err = ResponseHeadersFromReader(br, "GET")
+	require.NoError(t, err)
+	p := make([]byte, 4)
+	n, err := r.BodyReader().Read(p)
+	require.NoError(t, err)
+	assert.Equal(t, "0123", string(p[:n]))
+
+	// Test: body delimited by the end of the connection
+	br = bufio.NewReader(&chunkReader{
+		data:            "HTTP/1.1 200 OK\r\n\r\nuntil the end",
+		numBytesPerRead: 3,
+	})
+	r, err = ResponseHeadersFromReader(br, "GET")
+	require.NoError(t, err)
+	assert.True(t, r.DelimitedByClose())
+	body, err = io.ReadAll(r.BodyReader())
+	require.NoError(t, err)
+	assert.Equal(t, "until the end", string(body))
+}
@@ -0,0 +1,80 @@
+package response
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// ReadFrom implements io.ReaderFrom so that io.Copy into the writer can hand
+// the body straight to the conn. When the conn is a *net.TCPConn and r is an
+// *os.File (or an *io.LimitedReader wrapping one), the kernel copies the file
+// to the socket with sendfile and the data never passes through user space.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if w.State != stateWrittenHeaders && w.State != stateWrittenBody {
+		return 0, errors.New("headers must be written before writing body")
+	}
+
+	w.State = stateWrittenBody
+
+	rf, ok := w.conn.(io.ReaderFrom)
+	if !ok || !w.canBypassBuffer() {
+		return io.Copy(bodyWriter{w}, r)
+	}
+
+	// The status line and headers are still sitting in the buffer and have
+	// to go out before the body.
+	err := w.Flush()
+	if err != nil {
+		return 0, err
+	}
+
+	return rf.ReadFrom(r)
+}
+
+// WriteFile writes n bytes of f starting at offset as the body, using
+// sendfile when possible.
+func (w *Writer) WriteFile(f *os.File, offset, n int64) (int64, error) {
+	_, err := f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	return w.ReadFrom(io.LimitReader(f, n))
+}
+
+// canBypassBuffer reports whether body data can be written to the conn as
+// is, i.e. nothing is transforming the body on its way out.
+func (w *Writer) canBypassBuffer() bool {
+	// Chunked bodies need every chunk framed.
+	if w.bw == nil || w.chunked {
+		return false
+	}
+
+	c := w.compressor
+	if c == nil {
+		return true
+	}
+
+	// The compressor has settled on sending the body untouched.
+	return c.headers == nil && c.enc == nil
+}
+
+// bodyWriter hides ReadFrom so io.Copy doesn't call back into it. Chunked
+// bodies are written as one chunk per write.
+type bodyWriter struct {
+	w *Writer
+}
+
+func (bw bodyWriter) Write(p []byte) (int, error) {
+	if bw.w.chunked {
+		// The count includes the framing, which io.Copy doesn't expect.
+		_, err := bw.w.WriteChunkedBody(p)
+		if err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	return bw.w.WriteBody(p)
+}
@@ -0,0 +1,205 @@
+package response
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/johndosdos/http-from-tcp/internal/conntest"
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sendfileConn counts the bodies handed to the ReadFrom of the TCP conn,
+// which is where sendfile happens.
+type sendfileConn struct {
+	*net.TCPConn
+	readFroms int
+}
+
+func (c *sendfileConn) ReadFrom(r io.Reader) (int64, error) {
+	c.readFroms++
+	return c.TCPConn.ReadFrom(r)
+}
+
+// writeTCPResponse is like writeResponse but over a real TCP connection so
+// that the sendfile path can be taken. fn runs on the server goroutine, so it
+// returns its errors for the test goroutine to report. It returns the
+// response with its body read, and whether the body went through sendfile.
+func writeTCPResponse(t *testing.T, fn func(w *Writer) error) (*http.Response, []byte, bool) {
+	t.Helper()
+
+	var conn *sendfileConn
+	errs := make(chan error, 1)
+	resp := conntest.TCPResponse(t, "", func(c net.Conn) {
+		conn = &sendfileConn{TCPConn: c.(*net.TCPConn)}
+		w := NewWriter(conn)
+		err := fn(&w)
+		if finishErr := w.Finish(); err == nil {
+			err = finishErr
+		}
+		errs <- err
+	})
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, <-errs)
+
+	return resp, body, conn.readFroms > 0
+}
+
+func TestWriteFile(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	path := filepath.Join(t.TempDir(), "data.txt")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+
+	// Test: whole file
+	_, body, sendfile := writeTCPResponse(t, func(w *Writer) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		h := headers.NewHeaders()
+		h.Set("Content-Length", "10000")
+		err = w.WriteStatusLine(StatusOK)
+		if err != nil {
+			return err
+		}
+		err = w.WriteHeaders(h)
+		if err != nil {
+			return err
+		}
+		_, err = w.WriteFile(f, 0, 10000)
+		return err
+	})
+	assert.Equal(t, content, string(body))
+	assert.True(t, sendfile)
+
+	// Test: section of the file
+	_, body, sendfile = writeTCPResponse(t, func(w *Writer) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		h := headers.NewHeaders()
+		h.Set("Content-Length", "5")
+		err = w.WriteStatusLine(StatusOK)
+		if err != nil {
+			return err
+		}
+		err = w.WriteHeaders(h)
+		if err != nil {
+			return err
+		}
+		_, err = w.WriteFile(f, 13, 5)
+		return err
+	})
+	assert.Equal(t, "34567", string(body))
+	assert.True(t, sendfile)
+
+	// Test: compression declined, the body is still sent with sendfile
+	_, body, sendfile = writeTCPResponse(t, func(w *Writer) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		w.Compress("", DefaultMinCompressSize)
+		h := headers.NewHeaders()
+		h.Set("Content-Length", "10000")
+		err = w.WriteStatusLine(StatusOK)
+		if err != nil {
+			return err
+		}
+		err = w.WriteHeaders(h)
+		if err != nil {
+			return err
+		}
+		_, err = w.WriteFile(f, 0, 10000)
+		return err
+	})
+	assert.Equal(t, content, string(body))
+	assert.True(t, sendfile)
+
+	// Test: chunked body is framed rather than sent with sendfile, with or
+	// without compression declined
+	for _, compress := range []bool{false, true} {
+		resp, body, sendfile := writeTCPResponse(t, func(w *Writer) error {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			if compress {
+				w.Compress("", DefaultMinCompressSize)
+			}
+			h := headers.NewHeaders()
+			h.Set("Content-Type", "image/png")
+			h.Set("Transfer-Encoding", "chunked")
+			err = w.WriteStatusLine(StatusOK)
+			if err != nil {
+				return err
+			}
+			err = w.WriteHeaders(h)
+			if err != nil {
+				return err
+			}
+			_, err = w.ReadFrom(f)
+			if err != nil {
+				return err
+			}
+			_, err = w.WriteChunkedBodyDone()
+			if err != nil {
+				return err
+			}
+			return w.WriteTrailers(headers.NewHeaders())
+		})
+		assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+		assert.Equal(t, content, string(body))
+		assert.False(t, sendfile)
+	}
+
+	// Test: compression still applies
+	resp, body, sendfile := writeTCPResponse(t, func(w *Writer) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		w.Compress(EncodingGzip, DefaultMinCompressSize)
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "text/plain")
+		h.Set("Content-Length", "10000")
+		err = w.WriteStatusLine(StatusOK)
+		if err != nil {
+			return err
+		}
+		err = w.WriteHeaders(h)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, f)
+		return err
+	})
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.False(t, sendfile)
+	gr, err := gzip.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	data, err := io.ReadAll(gr)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(data))
+}
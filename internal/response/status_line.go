@@ -6,9 +6,27 @@ import (
 )
 
 const (
+	StatusContinue            string = "100"
+	StatusSwitchingProtocols  string = "101"
+	StatusEarlyHints          string = "103"
 	StatusOK                  string = "200"
+	StatusNoContent           string = "204"
+	StatusPartialContent      string = "206"
+	StatusMovedPermanently    string = "301"
+	StatusNotModified         string = "304"
 	StatusBadRequest          string = "400"
+	StatusForbidden           string = "403"
+	StatusNotFound            string = "404"
+	StatusMethodNotAllowed    string = "405"
+	StatusPreconditionFailed  string = "412"
+	StatusContentTooLarge     string = "413"
+	StatusRangeNotSatisfiable string = "416"
+	StatusExpectationFailed   string = "417"
+	StatusUpgradeRequired     string = "426"
 	StatusInternalServerError string = "500"
+	StatusBadGateway          string = "502"
+	StatusServiceUnavailable  string = "503"
+	StatusGatewayTimeout      string = "504"
 )
 
 func (w *Writer) WriteStatusLine(statusCode string) error {
@@ -16,21 +34,60 @@ func (w *Writer) WriteStatusLine(statusCode string) error {
 		return errors.New("status line has already been written")
 	}
 
-	reasonPhrase := ""
+	statusLine := fmt.Sprintf("HTTP/1.1 %v %v\r\n", statusCode, reasonPhrase(statusCode))
+	_, err := w.Writer.Write([]byte(statusLine))
+
+	w.State = stateWrittenStatusLine
+	w.statusCode = statusCode
+
+	return err
+}
 
+func reasonPhrase(statusCode string) string {
 	switch statusCode {
+	case StatusContinue:
+		return "Continue"
+	case StatusSwitchingProtocols:
+		return "Switching Protocols"
+	case StatusEarlyHints:
+		return "Early Hints"
 	case StatusOK:
-		reasonPhrase = "OK"
+		return "OK"
+	case StatusNoContent:
+		return "No Content"
+	case StatusPartialContent:
+		return "Partial Content"
+	case StatusMovedPermanently:
+		return "Moved Permanently"
+	case StatusNotModified:
+		return "Not Modified"
 	case StatusBadRequest:
-		reasonPhrase = "Bad Request"
+		return "Bad Request"
+	case StatusForbidden:
+		return "Forbidden"
+	case StatusNotFound:
+		return "Not Found"
+	case StatusMethodNotAllowed:
+		return "Method Not Allowed"
+	case StatusPreconditionFailed:
+		return "Precondition Failed"
+	case StatusContentTooLarge:
+		return "Content Too Large"
+	case StatusRangeNotSatisfiable:
+		return "Range Not Satisfiable"
+	case StatusExpectationFailed:
+		return "Expectation Failed"
+	case StatusUpgradeRequired:
+		return "Upgrade Required"
 	case StatusInternalServerError:
-		reasonPhrase = "Internal Server Error"
+		return "Internal Server Error"
+	case StatusBadGateway:
+		return "Bad Gateway"
+	case StatusServiceUnavailable:
+		return "Service Unavailable"
+	case StatusGatewayTimeout:
+		return "Gateway Timeout"
 	}
 
-	statusLine := fmt.Sprintf("HTTP/1.1 %v %v\r\n", statusCode, reasonPhrase)
-	_, err := w.Writer.Write([]byte(statusLine))
-
-	w.State = stateWrittenStatusLine
-
-	return err
+	return ""
 }
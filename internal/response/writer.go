@@ -1,13 +1,36 @@
 package response
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sync"
 )
 
 type Writer struct {
 	Writer io.Writer
 	State  int
+
+	conn       net.Conn
+	bw         *bufio.Writer
+	br         *bufio.Reader
+	statusCode string
+	compressor *compressor
+	hijacked   bool
+	// Whether the headers announced a chunked body.
+	chunked bool
+
+	beforeHijack func()
+}
+
+// Flusher is implemented by writers that buffer their output. Streaming
+// handlers can call Flush to push whatever has been written so far to the
+// client instead of waiting for the handler to return.
+type Flusher interface {
+	Flush() error
 }
 
 const (
@@ -17,9 +40,140 @@ const (
 	stateWrittenBody
 )
 
+const bufferSize int = 4096
+
+// Buffered writers are reused across connections so that every response
+// doesn't allocate its own buffer.
+var bufioWriterPool = sync.Pool{
+	New: func() any {
+		return bufio.NewWriterSize(nil, bufferSize)
+	},
+}
+
 func NewWriter(w net.Conn) Writer {
+	bw := bufioWriterPool.Get().(*bufio.Writer)
+	bw.Reset(w)
+
 	return Writer{
-		Writer: w,
+		Writer: bw,
 		State:  stateInit,
+		conn:   w,
+		bw:     bw,
+	}
+}
+
+// Flush writes any buffered data to the underlying conn.
+func (w *Writer) Flush() error {
+	if w.bw == nil {
+		return nil
+	}
+
+	if w.compressor != nil {
+		err := w.compressor.flush(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.bw.Flush()
+}
+
+// Finish flushes the remaining buffered data and returns the buffer to the
+// pool. The writer must not be used after calling Finish.
+func (w *Writer) Finish() error {
+	if w.bw == nil {
+		return nil
+	}
+
+	// The conn belongs to whoever hijacked it, including whatever they
+	// left in the buffer.
+	if w.hijacked {
+		w.bw.Reset(nil)
+		bufioWriterPool.Put(w.bw)
+		w.bw = nil
+		return nil
+	}
+
+	var err error
+	if w.compressor != nil {
+		err = w.compressor.close(w)
+		w.compressor = nil
+	}
+
+	if flushErr := w.bw.Flush(); err == nil {
+		err = flushErr
 	}
+
+	w.bw.Reset(nil)
+	bufioWriterPool.Put(w.bw)
+	w.bw = nil
+	w.Writer = w.conn
+
+	return err
+}
+
+// SetReader tells the writer which reader the request was parsed from, so
+// that Hijack can hand over whatever the reader buffered past the request.
+func (w *Writer) SetReader(br *bufio.Reader) {
+	w.br = br
+}
+
+// SetBeforeHijack sets a function called right before the connection is
+// hijacked. The server uses it to stop reading from the conn in the
+// background.
+func (w *Writer) SetBeforeHijack(fn func()) {
+	w.beforeHijack = fn
+}
+
+// Hijack lets the handler take over the connection, e.g. to switch to
+// another protocol after a 101 response. Anything written so far is flushed
+// first. Along with the conn it returns the bytes the client already sent
+// past the request, which were read off the conn but not parsed; they come
+// before anything read from the conn from now on.
+//
+// The server neither writes to nor closes a hijacked conn, so the caller is
+// responsible for closing it.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	if w.hijacked {
+		return nil, nil, errors.New("connection has already been hijacked")
+	}
+
+	if w.bw == nil {
+		return nil, nil, errors.New("response has already been finished")
+	}
+
+	err := w.bw.Flush()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to flush response before hijacking: %v", err)
+	}
+
+	if w.beforeHijack != nil {
+		w.beforeHijack()
+		w.beforeHijack = nil
+	}
+
+	var buffered []byte
+	if w.br != nil && w.br.Buffered() > 0 {
+		// Copy the bytes out, the reader's buffer is reused once the
+		// handler returns.
+		peeked, _ := w.br.Peek(w.br.Buffered())
+		buffered = bytes.Clone(peeked)
+		w.br.Discard(len(peeked))
+	}
+
+	w.hijacked = true
+	w.Writer = io.Discard
+
+	return w.conn, buffered, nil
+}
+
+// Hijacked reports whether the connection has been taken over by the
+// handler.
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
+}
+
+// StatusLineWritten reports whether the final status line has been written.
+func (w *Writer) StatusLineWritten() bool {
+	return w.State != stateInit
 }
@@ -0,0 +1,90 @@
+package response
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingConn records what is written to it.
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func TestWriterBuffering(t *testing.T) {
+	// Test: nothing reaches the conn before Flush
+	conn := &recordingConn{}
+	w := NewWriter(conn)
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "5")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Zero(t, conn.written.Len())
+
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasPrefix(conn.written.String(), "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(conn.written.String(), "\r\n\r\nhello"))
+	require.NoError(t, w.Finish())
+
+	// Test: nor before Finish
+	conn = &recordingConn{}
+	w = NewWriter(conn)
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	assert.Zero(t, conn.written.Len())
+
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n", conn.written.String())
+
+	// Test: Flush on a chunked body sends the chunks written so far
+	conn = &recordingConn{}
+	w = NewWriter(conn)
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasSuffix(conn.written.String(), "\r\n\r\n5\r\nhello\r\n"))
+
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(headers.NewHeaders()))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(conn.written.String(), "5\r\nhello\r\n0\r\n\r\n"))
+}
+
+func TestWriterFinish(t *testing.T) {
+	conn := &recordingConn{}
+	w := NewWriter(conn)
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+
+	// Test: finishing twice returns the buffer to the pool once
+	bw := w.bw
+	require.NoError(t, w.Finish())
+	assert.Nil(t, w.bw)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n", conn.written.String())
+
+	// Had the buffer gone back twice, both writers could get it.
+	w1 := NewWriter(&recordingConn{})
+	w2 := NewWriter(&recordingConn{})
+	assert.False(t, w1.bw == bw && w2.bw == bw)
+	w1.Finish()
+	w2.Finish()
+}
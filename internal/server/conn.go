@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ConnState is a stage in the life of a connection, reported to
+// Server.ConnState.
+type ConnState int
+
+const (
+	// The connection has just been accepted.
+	StateNew ConnState = iota
+	// The client has started sending a request. HTTP/2 connections are
+	// active while they have streams open.
+	StateActive
+	// An HTTP/2 connection has no streams open.
+	StateIdle
+	// A handler has taken over the connection. It's the last state
+	// reported, the server no longer knows what becomes of it.
+	StateHijacked
+	// The connection is closed.
+	StateClosed
+)
+
+func (cs ConnState) String() string {
+	switch cs {
+	case StateNew:
+		return "new"
+	case StateActive:
+		return "active"
+	case StateIdle:
+		return "idle"
+	case StateHijacked:
+		return "hijacked"
+	case StateClosed:
+		return "closed"
+	}
+
+	return "unknown"
+}
+
+func (s *Server) setState(conn net.Conn, state ConnState) {
+	if s.ConnState != nil {
+		s.ConnState(conn, state)
+	}
+}
+
+// watchConn calls cancel once the client on conn goes away, by reading from
+// br while the handler runs. Only call it once the whole request has been
+// read, so that the handler has no reason to read from br.
+//
+// Whatever the client sends in the meantime stays in br. The returned stop
+// function has to be called before anyone reads from br again.
+func watchConn(conn net.Conn, br *bufio.Reader, cancel context.CancelFunc) (stop func()) {
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		_, err := br.Peek(1)
+		// Timeouts are stop's doing. Anything else the client sends, such as
+		// data meant for after a protocol switch, doesn't mean it's gone.
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cancel()
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			// Interrupt the read by setting a deadline in the past.
+			conn.SetReadDeadline(time.Unix(1, 0))
+			<-done
+			conn.SetReadDeadline(time.Time{})
+		})
+	}
+}
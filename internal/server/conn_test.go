@@ -0,0 +1,300 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/http2"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connStates records the states of every conn, in order.
+type connStates struct {
+	mu     sync.Mutex
+	states map[net.Conn][]ConnState
+	closed chan struct{}
+}
+
+func (cs *connStates) record(conn net.Conn, state ConnState) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.states[conn] = append(cs.states[conn], state)
+	if state == StateClosed || state == StateHijacked {
+		cs.closed <- struct{}{}
+	}
+}
+
+// next waits for a conn to be done with and returns its states.
+func (cs *connStates) next(t *testing.T) []ConnState {
+	t.Helper()
+
+	select {
+	case <-cs.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("conn never closed")
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for conn, states := range cs.states {
+		last := states[len(states)-1]
+		if last == StateClosed || last == StateHijacked {
+			delete(cs.states, conn)
+			return states
+		}
+	}
+	return nil
+}
+
+func serveWithStates(t *testing.T, handler Handler) (*Server, *connStates) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	cs := &connStates{
+		states: make(map[net.Conn][]ConnState),
+		closed: make(chan struct{}, 10),
+	}
+	s := NewServer([]net.Listener{listener}, handler)
+	s.ConnState = cs.record
+	go s.Listen()
+	t.Cleanup(func() { s.Close() })
+
+	return s, cs
+}
+
+func TestConnState(t *testing.T) {
+	s, cs := serveWithStates(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/hijack" {
+			conn, _, err := w.Hijack()
+			if err == nil {
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+				conn.Close()
+			}
+			return
+		}
+
+		h2Handler(w, req)
+	})
+	addr := s.Addr().String()
+
+	// Test: HTTP/1.1
+	resp, err := http.Get("http://" + addr + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, []ConnState{StateNew, StateActive, StateClosed}, cs.next(t))
+
+	// Test: hijacked conns aren't reported closed
+	resp, err = http.Get("http://" + addr + "/hijack")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, []ConnState{StateNew, StateActive, StateHijacked}, cs.next(t))
+
+	// Test: conns that never send anything
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, []ConnState{StateNew, StateClosed}, cs.next(t))
+
+	// Test: HTTP/2 conns go idle between streams
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	transport := &http.Transport{Protocols: &protocols}
+	client := &http.Client{Transport: transport}
+	for range 2 {
+		resp, err = client.Get("http://" + addr + "/")
+		require.NoError(t, err)
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	transport.CloseIdleConnections()
+	assert.Equal(t, []ConnState{
+		StateNew, StateActive, StateIdle,
+		StateActive, StateIdle,
+		StateActive, StateIdle,
+		StateClosed,
+	}, cs.next(t))
+
+	// Test: failed TLS handshakes
+	files, _ := writeCert(t, t.TempDir(), "server", "localhost")
+	certs, err := LoadCertificates(files)
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	tlsServer := NewServer([]net.Listener{tls.NewListener(listener, certs.TLSConfig())}, h2Handler)
+	tlsServer.ConnState = cs.record
+	go tlsServer.Listen()
+	defer tlsServer.Close()
+
+	conn, err = net.Dial("tcp", tlsServer.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, []ConnState{StateNew, StateClosed}, cs.next(t))
+}
+
+func TestRequestContext(t *testing.T) {
+	cancelled := make(chan string, 1)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		select {
+		case <-req.Context().Done():
+			cancelled <- req.RequestLine.RequestTarget
+		case <-time.After(5 * time.Second):
+			cancelled <- "never cancelled"
+		}
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: cancelled when the client goes away
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	_, err = io.WriteString(conn, "GET /gone HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	conn.Close()
+	assert.Equal(t, "/gone", <-cancelled)
+
+	// Test: cancelled when an HTTP/2 stream is reset
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, http2.ClientPreface)
+	require.NoError(t, err)
+	require.NoError(t, http2.WriteFrame(conn, http2.Frame{Type: http2.FrameSettings}))
+
+	block := http2.Encoder{}.Encode(nil,
+		http2.HeaderField{Name: ":method", Value: "GET"},
+		http2.HeaderField{Name: ":scheme", Value: "http"},
+		http2.HeaderField{Name: ":path", Value: "/reset"},
+	)
+	require.NoError(t, http2.WriteFrame(conn, http2.Frame{Type: http2.FrameHeaders, Flags: http2.FlagEndHeaders | http2.FlagEndStream, StreamID: 1, Payload: block}))
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, http2.WriteFrame(conn, http2.Frame{Type: http2.FrameRSTStream, StreamID: 1, Payload: http2.RSTStreamPayload(http2.ErrCodeCancel)}))
+	assert.Equal(t, "/reset", <-cancelled)
+
+	// Test: data sent after the request doesn't cancel it
+	s2, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		time.Sleep(50 * time.Millisecond)
+
+		w.WriteStatusLine(response.StatusOK)
+		h := headers.NewHeaders()
+		h.Set("Content-Length", "0")
+		if req.Context().Err() != nil {
+			h.Set("X-Cancelled", "yes")
+		}
+		w.WriteHeaders(h)
+	})
+	require.NoError(t, err)
+	defer s2.Close()
+
+	conn, err = net.Dial("tcp", s2.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\nGET / HTTP/1.1\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Empty(t, resp.Header.Get("X-Cancelled"))
+}
+
+type ctxKey struct{}
+
+func TestBaseContext(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	cancelled := make(chan string, 1)
+	s := NewServer([]net.Listener{listener}, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/value" {
+			w.WriteStatusLine(response.StatusOK)
+			h := headers.NewHeaders()
+			h.Set("Content-Length", "0")
+			h.Set("X-Value", req.Context().Value(ctxKey{}).(string))
+			w.WriteHeaders(h)
+			return
+		}
+
+		select {
+		case <-req.Context().Done():
+			cancelled <- req.RequestLine.RequestTarget
+		case <-time.After(5 * time.Second):
+			cancelled <- "never cancelled"
+		}
+	})
+	s.BaseContext = context.WithValue(context.Background(), ctxKey{}, "from base")
+	go s.Listen()
+
+	// Test: values in the base context reach handlers
+	resp, err := http.Get("http://" + s.Addr().String() + "/value")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "from base", resp.Header.Get("X-Value"))
+
+	// Test: idle HTTP/2 connections are sent GOAWAY on close
+	h2Conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer h2Conn.Close()
+	_, err = io.WriteString(h2Conn, http2.ClientPreface)
+	require.NoError(t, err)
+	require.NoError(t, http2.WriteFrame(h2Conn, http2.Frame{Type: http2.FrameSettings}))
+
+	// Test: in-flight requests are cancelled on close
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET /closed HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+
+	require.NoError(t, s.Close())
+	assert.Equal(t, "/closed", <-cancelled)
+
+	br := bufio.NewReader(h2Conn)
+	var goAway *http2.Frame
+	for goAway == nil || goAway.Type != http2.FrameGoAway {
+		goAway, err = http2.ReadFrame(br, http2.DefaultMaxFrameSize)
+		require.NoError(t, err)
+	}
+	_, code, err := goAway.GoAway()
+	require.NoError(t, err)
+	assert.Equal(t, http2.ErrCodeNo, code)
+
+	// Test: in-flight requests are cancelled once shutdown gives up waiting
+	s2, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		select {
+		case <-req.Context().Done():
+			cancelled <- req.RequestLine.RequestTarget
+		case <-time.After(5 * time.Second):
+			cancelled <- "never cancelled"
+		}
+	})
+	require.NoError(t, err)
+
+	conn, err = net.Dial("tcp", s2.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET /shutdown HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s2.Shutdown(ctx), context.DeadlineExceeded)
+	assert.Equal(t, "/shutdown", <-cancelled)
+}
@@ -0,0 +1,1060 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/http2"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+)
+
+// Settings we announce to HTTP/2 clients.
+const (
+	h2MaxConcurrentStreams uint32 = 250
+	h2MaxHeaderListSize    uint32 = 1 << 20
+)
+
+// Size of the buffers of HTTP/2 connections.
+const h2BufferSize = 16 << 10
+
+// Request bodies are read whole before the handler runs. Bodies larger than
+// h2MaxBodySize are refused with 413, and the connection window bounds how
+// much of all the bodies on a connection is held at once.
+const (
+	h2MaxBodySize    = 8 << 20
+	h2ConnWindowSize = 16 << 20
+)
+
+var errStreamClosed = errors.New("stream closed")
+
+// Headers that only make sense for a single HTTP/1.1 connection, which
+// HTTP/2 messages must not contain. Refer to RFC 9113 8.2.2.
+var h2ConnectionHeaders = []string{
+	"connection",
+	"keep-alive",
+	"proxy-connection",
+	"transfer-encoding",
+	"upgrade",
+}
+
+// h2Conn is an HTTP/2 connection. One goroutine reads the frames while
+// every stream runs the handler in a goroutine of its own.
+type h2Conn struct {
+	server  *Server
+	ctx     context.Context
+	conn    net.Conn
+	br      *bufio.Reader
+	decoder *http2.Decoder
+
+	// Held while writing a frame, or a header block spanning several.
+	wmu sync.Mutex
+	bw  *bufio.Writer
+
+	mu sync.Mutex
+	// Signalled whenever a send window grows or a stream is reset.
+	cond    *sync.Cond
+	streams map[uint32]*h2Stream
+	// Connection-level send window.
+	sendWindow int64
+	// The client's settings.
+	initialWindowSize int64
+	maxFrameSize      uint32
+	closed            bool
+	// Set once GOAWAY has been sent for the server shutting down. The
+	// connection is closed once its streams are done.
+	draining bool
+	// Connection-level receive window.
+	recvWindow int64
+	// Only written by the reading goroutine, with mu held.
+	lastStreamID uint32
+
+	// The rest is only touched by the reading goroutine.
+	handlers sync.WaitGroup
+}
+
+// h2Stream is a request and its response.
+type h2Stream struct {
+	id  uint32
+	req *request.Request
+
+	// Guarded by h2Conn.mu.
+	sendWindow int64
+	reset      bool
+	// Cancels the request's context, once the handler runs.
+	cancel context.CancelFunc
+
+	// Only touched by the reading goroutine until the handler runs.
+	receiving     bool
+	body          bytes.Buffer
+	contentLength int64
+	recvWindow    int64
+	// How much of the connection window the stream holds, given back once
+	// its body is no longer needed.
+	connWindowHeld int64
+}
+
+// serveH2 serves HTTP/2 on conn, reading from br. For connections upgraded
+// from HTTP/1.1, upgradeReq is the request that asked for the upgrade, to be
+// answered on stream 1, and settings are the ones from its HTTP2-Settings
+// header. The requests' contexts are derived from ctx.
+func (s *Server) serveH2(ctx context.Context, conn net.Conn, br *bufio.Reader, upgradeReq *request.Request, settings []http2.Setting) {
+	c := &h2Conn{
+		server:            s,
+		ctx:               ctx,
+		conn:              conn,
+		br:                br,
+		decoder:           http2.NewDecoder(http2.DefaultHeaderTableSize, h2MaxHeaderListSize),
+		bw:                bufio.NewWriterSize(conn, h2BufferSize),
+		streams:           make(map[uint32]*h2Stream),
+		sendWindow:        int64(http2.DefaultInitialWindowSize),
+		initialWindowSize: int64(http2.DefaultInitialWindowSize),
+		maxFrameSize:      http2.DefaultMaxFrameSize,
+		recvWindow:        h2ConnWindowSize,
+	}
+	c.cond = sync.NewCond(&c.mu)
+
+	// Once ctx is done, e.g. the server is closing, interrupt the read so the
+	// connection is closed too.
+	stop := context.AfterFunc(ctx, c.stopReading)
+	defer stop()
+
+	err := c.serve(upgradeReq, settings)
+
+	c.mu.Lock()
+	draining := c.draining
+	c.mu.Unlock()
+
+	var connErr http2.ConnectionError
+	if draining {
+		// GOAWAY has been sent already, and the streams are done.
+	} else if ctx.Err() != nil {
+		c.writeFrame(http2.Frame{
+			Type:    http2.FrameGoAway,
+			Payload: http2.GoAwayPayload(c.lastStreamID, http2.ErrCodeNo, "server shutting down"),
+		})
+	} else if errors.As(err, &connErr) {
+		log.Printf("closing HTTP/2 connection: %v", err)
+		c.writeFrame(http2.Frame{
+			Type:    http2.FrameGoAway,
+			Payload: http2.GoAwayPayload(c.lastStreamID, connErr.Code, connErr.Reason),
+		})
+	} else if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		log.Printf("HTTP/2 connection failed: %v", err)
+	}
+
+	// Unblock the handlers still writing, then wait for them to return.
+	c.mu.Lock()
+	c.closed = true
+	for _, st := range c.streams {
+		st.reset = true
+		if st.cancel != nil {
+			st.cancel()
+		}
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	conn.Close()
+	c.handlers.Wait()
+}
+
+func (c *h2Conn) serve(upgradeReq *request.Request, settings []http2.Setting) error {
+	err := c.applySettings(settings)
+	if err != nil {
+		return err
+	}
+
+	err = c.writeFrame(http2.Frame{
+		Type: http2.FrameSettings,
+		Payload: http2.SettingsPayload(
+			http2.Setting{ID: http2.SettingMaxConcurrentStreams, Value: h2MaxConcurrentStreams},
+			http2.Setting{ID: http2.SettingMaxHeaderListSize, Value: h2MaxHeaderListSize},
+		),
+	})
+	if err != nil {
+		return err
+	}
+
+	// The connection window can only be raised with WINDOW_UPDATE.
+	err = c.writeFrame(http2.Frame{
+		Type:    http2.FrameWindowUpdate,
+		Payload: http2.WindowUpdatePayload(uint32(h2ConnWindowSize - http2.DefaultInitialWindowSize)),
+	})
+	if err != nil {
+		return err
+	}
+
+	c.server.setState(c.conn, StateIdle)
+
+	// The request that asked for the upgrade is answered on stream 1, as if
+	// it had been sent over HTTP/2. Refer to RFC 7540 3.2.
+	if upgradeReq != nil {
+		st := &h2Stream{id: 1, req: upgradeReq, contentLength: -1}
+		c.mu.Lock()
+		c.lastStreamID = 1
+		c.mu.Unlock()
+		c.addStream(st)
+		c.dispatch(st)
+	}
+
+	// Once the server shuts down, let the client finish the streams it
+	// has open, but no more.
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-c.server.done:
+			c.drain()
+		case <-stopped:
+		}
+	}()
+
+	preface := make([]byte, len(http2.ClientPreface))
+	_, err = io.ReadFull(c.br, preface)
+	if err != nil {
+		return err
+	}
+	if string(preface) != http2.ClientPreface {
+		return http2.ConnectionError{Code: http2.ErrCodeProtocol, Reason: "invalid connection preface"}
+	}
+
+	// The preface is followed by the client's settings.
+	first := true
+
+	for {
+		f, err := http2.ReadFrame(c.br, http2.DefaultMaxFrameSize)
+		if err != nil {
+			return err
+		}
+
+		if first && (f.Type != http2.FrameSettings || f.Has(http2.FlagAck)) {
+			return http2.ConnectionError{Code: http2.ErrCodeProtocol, Reason: "connection preface not followed by SETTINGS"}
+		}
+		first = false
+
+		err = c.processFrame(f)
+
+		var streamErr http2.StreamError
+		if errors.As(err, &streamErr) {
+			c.resetStream(streamErr.StreamID, streamErr.Code)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *h2Conn) processFrame(f *http2.Frame) error {
+	switch f.Type {
+	case http2.FrameData:
+		return c.processData(f)
+	case http2.FrameHeaders:
+		return c.processHeaders(f)
+	case http2.FramePriority:
+		if f.StreamID == 0 {
+			return http2.ConnectionError{Code: http2.ErrCodeProtocol, Reason: "PRIORITY on stream 0"}
+		}
+		if len(f.Payload) != 5 {
+			return http2.StreamError{StreamID: f.StreamID, Code: http2.ErrCodeFrameSize, Reason: "PRIORITY payload not 5 bytes"}
+		}
+		// Priorities are only a hint, which we don't take.
+		return nil
+	case http2.FrameRSTStream:
+		return c.processRSTStream(f)
+	case http2.FrameSettings:
+		return c.processSettings(f)
+	case http2.FramePushPromise:
+		return http2.ConnectionError{Code: http2.ErrCodeProtocol, Reason: "PUSH_PROMISE from client"}
+	case http2.FramePing:
+		if f.StreamID != 0 {
+			return http2.ConnectionError{Code: http2.ErrCodeProtocol, Reason: "PING on a stream"}
+		}
+		if len(f.Payload) != 8 {
+			return http2.ConnectionError{Code: http2.ErrCodeFrameSize, Reason: "PING payload not 8 bytes"}
+		}
+		if f.Has(http2.FlagAck) {
+			return nil
+		}
+		return c.writeFrame(http2.Frame{Type: http2.FramePing, Flags: http2.FlagAck, Payload: f.Payload})
+	case http2.FrameGoAway:
+		if f.StreamID != 0 {
+			return http2.ConnectionError{Code: http2.ErrCodeProtocol, Reason: "GOAWAY on a stream"}
+		}
+		// The client won't open any more streams, but those already open
+		// still get their responses. It closes the connection once it's
+		// done with them.
+		_, _, err := f.GoAway()
+		return err
+	case http2.FrameWindowUpdate:
+		return c.processWindowUpdate(f)
+	case http2.FrameContinuation:
+		return http2.ConnectionError{Code: http2.ErrCodeProtocol, Reason: "CONTINUATION without HEADERS"}
+	}
+
+	// Unknown frame types must be ignored. Refer to RFC 9113 4.1.
+	return nil
+}
+
+func (c *h2Conn) processHeaders(f *http2.Frame) error {
+	if f.StreamID == 0 || f.StreamID%2 == 0 {
+		return http2.ConnectionError{Code: http2.ErrCodeProtocol, Reason: fmt.Sprintf("HEADERS on stream %d", f.StreamID)}
+	}
+
+	block, err := c.readHeaderBlock(f)
+	if err != nil {
+		return err
+	}
+
+	// The block has to be decoded even if the stream is refused, to keep
+	// the dynamic table in sync.
+	fields, err := c.decoder.Decode(block)
+	if err != nil {
+		return http2.ConnectionError{Code: http2.ErrCodeCompression, Reason: err.Error()}
+	}
+
+	endStream := f.Has(http2.FlagEndStream)
+
+	c.mu.Lock()
+	st := c.streams[f.StreamID]
+	active := len(c.streams)
+	c.mu.Unlock()
+
+	if st != nil {
+		// Trailers, which have to end the request.
+		if !st.receiving {
+			return http2.StreamError{StreamID: f.StreamID, Code: http2.ErrCodeStreamClosed, Reason: "HEADERS on a half-closed stream"}
+		}
+		if !endStream {
+			return http2.StreamError{StreamID: f.StreamID, Code: http2.ErrCodeProtocol, Reason: "trailers without END_STREAM"}
+		}
+
+		return c.endRequest(st)
+	}
+
+	if f.StreamID <= c.lastStreamID {
+		return http2.ConnectionError{Code: http2.ErrCodeStreamClosed, Reason: fmt.Sprintf("HEADERS on closed stream %d", f.StreamID)}
+	}
+
+	c.mu.Lock()
+	c.lastStreamID = f.StreamID
+	draining := c.draining
+	c.mu.Unlock()
+
+	// The stream crossed our GOAWAY. Refusing it tells the client it's
+	// safe to retry elsewhere. Refer to RFC 9113 6.8.
+	if draining {
+		return http2.StreamError{StreamID: f.StreamID, Code: http2.ErrCodeRefusedStream, Reason: "server shutting down"}
+	}
+
+	if active >= int(h2MaxConcurrentStreams) {
+		return http2.StreamError{StreamID: f.StreamID, Code: http2.ErrCodeRefusedStream, Reason: "too many concurrent streams"}
+	}
+
+	req, err := newH2Request(fields)
+	if err != nil {
+		return http2.StreamError{StreamID: f.StreamID, Code: http2.ErrCodeProtocol, Reason: err.Error()}
+	}
+	req.RemoteAddr = remoteAddr(c.conn)
+
+	st = &h2Stream{
+		id:            f.StreamID,
+		req:           req,
+		receiving:     !endStream,
+		contentLength: -1,
+		recvWindow:    int64(http2.DefaultInitialWindowSize),
+	}
+
+	if value := req.Headers.Get("content-length"); value != "" {
+		st.contentLength, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || st.contentLength < 0 {
+			return http2.StreamError{StreamID: f.StreamID, Code: http2.ErrCodeProtocol, Reason: "invalid content-length"}
+		}
+	}
+
+	// Refuse bodies we know are too large before the client sends them.
+	if st.contentLength > h2MaxBodySize {
+		return c.refuseBody(st)
+	}
+
+	c.addStream(st)
+
+	if endStream {
+		return c.endRequest(st)
+	}
+
+	// The whole body is read before the handler runs, so a client waiting
+	// for 100 Continue can go ahead right away.
+	if strings.EqualFold(req.Headers.Get("expect"), "100-continue") {
+		return c.writeHeaders(st.id, []http2.HeaderField{{Name: ":status", Value: response.StatusContinue}}, false)
+	}
+
+	return nil
+}
+
+// readHeaderBlock reads the CONTINUATION frames following f, up to the end
+// of the header block. Refer to RFC 9113 6.10.
+func (c *h2Conn) readHeaderBlock(f *http2.Frame) ([]byte, error) {
+	fragment, err := f.HeaderBlockFragment()
+	if err != nil {
+		return nil, err
+	}
+
+	block := bytes.Clone(fragment)
+
+	for end := f.Has(http2.FlagEndHeaders); !end; {
+		next, err := http2.ReadFrame(c.br, http2.DefaultMaxFrameSize)
+		if err != nil {
+			return nil, err
+		}
+
+		if next.Type != http2.FrameContinuation || next.StreamID != f.StreamID {
+			return nil, http2.ConnectionError{Code: http2.ErrCodeProtocol, Reason: "header block interrupted"}
+		}
+
+		block = append(block, next.Payload...)
+		if uint32(len(block)) > h2MaxHeaderListSize {
+			return nil, http2.ConnectionError{Code: http2.ErrCodeEnhanceYourCalm, Reason: "header block too large"}
+		}
+
+		end = next.Has(http2.FlagEndHeaders)
+	}
+
+	return block, nil
+}
+
+func (c *h2Conn) processData(f *http2.Frame) error {
+	if f.StreamID == 0 {
+		return http2.ConnectionError{Code: http2.ErrCodeProtocol, Reason: "DATA on stream 0"}
+	}
+
+	// Padding counts against the windows too.
+	size := int64(len(f.Payload))
+
+	c.mu.Lock()
+	if size > c.recvWindow {
+		c.mu.Unlock()
+		return http2.ConnectionError{Code: http2.ErrCodeFlowControl, Reason: "connection window exceeded"}
+	}
+	c.recvWindow -= size
+	st := c.streams[f.StreamID]
+	c.mu.Unlock()
+
+	if st == nil || !st.receiving {
+		// Nobody reads the data, so the connection window is given back
+		// right away.
+		err := c.releaseConnWindow(size)
+		if err != nil {
+			return err
+		}
+
+		if f.StreamID > c.lastStreamID {
+			return http2.ConnectionError{Code: http2.ErrCodeProtocol, Reason: "DATA on idle stream"}
+		}
+		return http2.StreamError{StreamID: f.StreamID, Code: http2.ErrCodeStreamClosed, Reason: "DATA on closed stream"}
+	}
+
+	// The stream holds on to the connection window until the handler is
+	// done with the body, or the stream is dropped.
+	st.connWindowHeld += size
+
+	data, err := f.Data()
+	if err != nil {
+		return err
+	}
+
+	if size > st.recvWindow {
+		return http2.StreamError{StreamID: f.StreamID, Code: http2.ErrCodeFlowControl, Reason: "stream window exceeded"}
+	}
+	st.recvWindow -= size
+
+	st.body.Write(data)
+	if st.contentLength >= 0 && int64(st.body.Len()) > st.contentLength {
+		return http2.StreamError{StreamID: f.StreamID, Code: http2.ErrCodeProtocol, Reason: "body longer than content-length"}
+	}
+	if st.body.Len() > h2MaxBodySize {
+		return c.refuseBody(st)
+	}
+
+	if f.Has(http2.FlagEndStream) {
+		return c.endRequest(st)
+	}
+
+	if size > 0 {
+		st.recvWindow += size
+		return c.writeFrame(http2.Frame{Type: http2.FrameWindowUpdate, StreamID: st.id, Payload: http2.WindowUpdatePayload(uint32(size))})
+	}
+
+	return nil
+}
+
+// refuseBody answers the stream with 413, then asks the client to stop
+// sending the body. Refer to RFC 9113 8.1.
+func (c *h2Conn) refuseBody(st *h2Stream) error {
+	err := c.writeHeaders(st.id, []http2.HeaderField{
+		{Name: ":status", Value: response.StatusContentTooLarge},
+		{Name: "content-length", Value: "0"},
+	}, true)
+	if err != nil {
+		return err
+	}
+
+	return http2.StreamError{StreamID: st.id, Code: http2.ErrCodeNo, Reason: "body too large"}
+}
+
+// releaseConnWindow gives n bytes of the connection window back to the
+// client.
+func (c *h2Conn) releaseConnWindow(n int64) error {
+	if n == 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	c.recvWindow += n
+	c.mu.Unlock()
+
+	return c.writeFrame(http2.Frame{Type: http2.FrameWindowUpdate, Payload: http2.WindowUpdatePayload(uint32(n))})
+}
+
+// endRequest hands the request to the handler once all of it is in.
+func (c *h2Conn) endRequest(st *h2Stream) error {
+	st.receiving = false
+
+	if st.contentLength >= 0 && int64(st.body.Len()) != st.contentLength {
+		return http2.StreamError{StreamID: st.id, Code: http2.ErrCodeProtocol, Reason: "body shorter than content-length"}
+	}
+
+	st.req.Body = st.body.Bytes()
+	// Handlers written for HTTP/1.1 look for the length of the body here.
+	if st.contentLength < 0 && len(st.req.Body) > 0 {
+		st.req.Headers.Set("content-length", strconv.Itoa(len(st.req.Body)))
+	}
+
+	c.dispatch(st)
+	return nil
+}
+
+func (c *h2Conn) processRSTStream(f *http2.Frame) error {
+	if f.StreamID == 0 {
+		return http2.ConnectionError{Code: http2.ErrCodeProtocol, Reason: "RST_STREAM on stream 0"}
+	}
+
+	_, err := f.ErrCode()
+	if err != nil {
+		return err
+	}
+
+	if f.StreamID > c.lastStreamID {
+		return http2.ConnectionError{Code: http2.ErrCodeProtocol, Reason: "RST_STREAM on idle stream"}
+	}
+
+	c.mu.Lock()
+	st := c.streams[f.StreamID]
+	if st == nil {
+		c.mu.Unlock()
+		return nil
+	}
+
+	st.reset = true
+	// The client has given up on the response.
+	if st.cancel != nil {
+		st.cancel()
+	}
+	c.cond.Broadcast()
+
+	// Streams whose handler runs are removed once it returns.
+	var released int64
+	if st.receiving {
+		released = c.deleteStream(st)
+	}
+	c.mu.Unlock()
+
+	return c.releaseConnWindow(released)
+}
+
+func (c *h2Conn) processSettings(f *http2.Frame) error {
+	if f.StreamID != 0 {
+		return http2.ConnectionError{Code: http2.ErrCodeProtocol, Reason: "SETTINGS on a stream"}
+	}
+
+	if f.Has(http2.FlagAck) {
+		if len(f.Payload) != 0 {
+			return http2.ConnectionError{Code: http2.ErrCodeFrameSize, Reason: "SETTINGS ack with a payload"}
+		}
+		return nil
+	}
+
+	settings, err := f.Settings()
+	if err != nil {
+		return err
+	}
+
+	err = c.applySettings(settings)
+	if err != nil {
+		return err
+	}
+
+	return c.writeFrame(http2.Frame{Type: http2.FrameSettings, Flags: http2.FlagAck})
+}
+
+// applySettings applies the client's settings. Those about what the client
+// accepts from us are the only ones that matter, we don't use the dynamic
+// table nor push.
+func (c *h2Conn) applySettings(settings []http2.Setting) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, s := range settings {
+		switch s.ID {
+		case http2.SettingInitialWindowSize:
+			// The change applies to the windows of the open streams too.
+			// Refer to RFC 9113 6.9.2.
+			delta := int64(s.Value) - c.initialWindowSize
+			for _, st := range c.streams {
+				st.sendWindow += delta
+				if st.sendWindow > int64(http2.MaxWindowSize) {
+					return http2.ConnectionError{Code: http2.ErrCodeFlowControl, Reason: "stream window overflow"}
+				}
+			}
+			c.initialWindowSize = int64(s.Value)
+		case http2.SettingMaxFrameSize:
+			c.maxFrameSize = s.Value
+		}
+	}
+
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *h2Conn) processWindowUpdate(f *http2.Frame) error {
+	increment, err := f.WindowIncrement()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f.StreamID == 0 {
+		if increment == 0 {
+			return http2.ConnectionError{Code: http2.ErrCodeProtocol, Reason: "WINDOW_UPDATE with zero increment"}
+		}
+
+		c.sendWindow += int64(increment)
+		if c.sendWindow > int64(http2.MaxWindowSize) {
+			return http2.ConnectionError{Code: http2.ErrCodeFlowControl, Reason: "connection window overflow"}
+		}
+
+		c.cond.Broadcast()
+		return nil
+	}
+
+	if increment == 0 {
+		return http2.StreamError{StreamID: f.StreamID, Code: http2.ErrCodeProtocol, Reason: "WINDOW_UPDATE with zero increment"}
+	}
+
+	st := c.streams[f.StreamID]
+	if st == nil {
+		return nil
+	}
+
+	st.sendWindow += int64(increment)
+	if st.sendWindow > int64(http2.MaxWindowSize) {
+		return http2.StreamError{StreamID: f.StreamID, Code: http2.ErrCodeFlowControl, Reason: "stream window overflow"}
+	}
+
+	c.cond.Broadcast()
+	return nil
+}
+
+// The conn is reported active while it has streams open and idle otherwise.
+// Streams are added and removed with c.mu held, so the states are reported
+// in order.
+
+func (c *h2Conn) addStream(st *h2Stream) {
+	c.mu.Lock()
+	st.sendWindow = c.initialWindowSize
+	c.streams[st.id] = st
+	if len(c.streams) == 1 {
+		c.server.setState(c.conn, StateActive)
+	}
+	c.mu.Unlock()
+}
+
+func (c *h2Conn) removeStream(st *h2Stream) {
+	c.mu.Lock()
+	released := c.deleteStream(st)
+	closed := c.closed
+	c.mu.Unlock()
+
+	if !closed {
+		c.releaseConnWindow(released)
+	}
+}
+
+// deleteStream removes st from the streams, returning how much of the
+// connection window it held for the caller to give back once c.mu is
+// released. c.mu must be held.
+func (c *h2Conn) deleteStream(st *h2Stream) int64 {
+	if c.streams[st.id] != st {
+		return 0
+	}
+
+	delete(c.streams, st.id)
+	if st.cancel != nil {
+		st.cancel()
+	}
+	if len(c.streams) == 0 && !c.closed {
+		c.server.setState(c.conn, StateIdle)
+
+		if c.draining {
+			c.stopReading()
+		}
+	}
+
+	released := st.connWindowHeld
+	st.connWindowHeld = 0
+	return released
+}
+
+// drain sends GOAWAY, so that the client opens no more streams, and closes
+// the connection once the streams already open are done.
+func (c *h2Conn) drain() {
+	c.mu.Lock()
+	c.draining = true
+	lastStreamID := c.lastStreamID
+	idle := len(c.streams) == 0
+	c.mu.Unlock()
+
+	c.writeFrame(http2.Frame{
+		Type:    http2.FrameGoAway,
+		Payload: http2.GoAwayPayload(lastStreamID, http2.ErrCodeNo, "server shutting down"),
+	})
+
+	if idle {
+		c.stopReading()
+	}
+}
+
+// stopReading interrupts the reading goroutine, which then closes the
+// connection.
+func (c *h2Conn) stopReading() {
+	c.conn.SetReadDeadline(time.Unix(1, 0))
+}
+
+// resetStream ends a stream abruptly, telling the client why.
+func (c *h2Conn) resetStream(id uint32, code http2.ErrCode) error {
+	var released int64
+
+	c.mu.Lock()
+	if st := c.streams[id]; st != nil {
+		st.reset = true
+		if st.cancel != nil {
+			st.cancel()
+		}
+		if st.receiving {
+			released = c.deleteStream(st)
+		}
+		c.cond.Broadcast()
+	}
+	c.mu.Unlock()
+
+	err := c.writeFrame(http2.Frame{Type: http2.FrameRSTStream, StreamID: id, Payload: http2.RSTStreamPayload(code)})
+	if err != nil {
+		return err
+	}
+
+	return c.releaseConnWindow(released)
+}
+
+// dispatch runs the handler for the stream's request.
+func (c *h2Conn) dispatch(st *h2Stream) {
+	ctx, cancel := context.WithCancel(c.ctx)
+	st.req.SetContext(ctx)
+	c.mu.Lock()
+	st.cancel = cancel
+	c.mu.Unlock()
+
+	c.handlers.Add(1)
+
+	go func() {
+		defer c.handlers.Done()
+		defer c.removeStream(st)
+
+		sw := newH2ResponseWriter(c, st)
+		w := response.NewWriter(sw)
+
+		c.server.handler(&w, st.req)
+
+		err := w.Finish()
+		if err != nil && !errors.Is(err, errStreamClosed) {
+			log.Printf("failed to flush response to stream %d: %v", st.id, err)
+		}
+
+		sw.finish()
+	}()
+}
+
+func (c *h2Conn) writeFrame(f http2.Frame) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	err := http2.WriteFrame(c.bw, f)
+	if err != nil {
+		return err
+	}
+
+	return c.bw.Flush()
+}
+
+// writeHeaders writes a header block, split into a HEADERS frame and as
+// many CONTINUATION frames as the client's max frame size calls for.
+func (c *h2Conn) writeHeaders(streamID uint32, fields []http2.HeaderField, endStream bool) error {
+	block := http2.Encoder{}.Encode(nil, fields...)
+
+	c.mu.Lock()
+	maxFrameSize := int(c.maxFrameSize)
+	c.mu.Unlock()
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	frameType := http2.FrameHeaders
+	for first := true; first || len(block) > 0; first = false {
+		n := min(len(block), maxFrameSize)
+
+		var flags http2.Flags
+		if first && endStream {
+			flags |= http2.FlagEndStream
+		}
+		if n == len(block) {
+			flags |= http2.FlagEndHeaders
+		}
+
+		err := http2.WriteFrame(c.bw, http2.Frame{Type: frameType, Flags: flags, StreamID: streamID, Payload: block[:n]})
+		if err != nil {
+			return err
+		}
+
+		block = block[n:]
+		frameType = http2.FrameContinuation
+	}
+
+	return c.bw.Flush()
+}
+
+// writeData writes p as DATA frames, waiting for the client to open the
+// send windows as needed.
+func (c *h2Conn) writeData(st *h2Stream, p []byte, endStream bool) error {
+	for {
+		c.mu.Lock()
+		for !st.reset && len(p) > 0 && (st.sendWindow <= 0 || c.sendWindow <= 0) {
+			c.cond.Wait()
+		}
+
+		if st.reset {
+			c.mu.Unlock()
+			return errStreamClosed
+		}
+
+		n := min(int64(len(p)), st.sendWindow, c.sendWindow, int64(c.maxFrameSize))
+		st.sendWindow -= n
+		c.sendWindow -= n
+		c.mu.Unlock()
+
+		var flags http2.Flags
+		if endStream && n == int64(len(p)) {
+			flags = http2.FlagEndStream
+		}
+
+		err := c.writeFrame(http2.Frame{Type: http2.FrameData, Flags: flags, StreamID: st.id, Payload: p[:n]})
+		if err != nil {
+			return err
+		}
+
+		p = p[n:]
+		if len(p) == 0 {
+			return nil
+		}
+	}
+}
+
+// newH2Request builds a request from the decoded header block, checking it
+// is well-formed. Refer to RFC 9113 8.3.1.
+func newH2Request(fields []http2.HeaderField) (*request.Request, error) {
+	req := &request.Request{
+		Headers: headers.NewHeaders(),
+		Body:    make([]byte, 0),
+		State:   request.DONE,
+	}
+
+	pseudo := make(map[string]string)
+	regular := false
+
+	for _, hf := range fields {
+		if strings.HasPrefix(hf.Name, ":") {
+			if regular {
+				return nil, errors.New("pseudo-header after regular header")
+			}
+
+			switch hf.Name {
+			case ":method", ":scheme", ":authority", ":path":
+			default:
+				return nil, fmt.Errorf("unknown pseudo-header %v", hf.Name)
+			}
+
+			if _, ok := pseudo[hf.Name]; ok {
+				return nil, fmt.Errorf("duplicate pseudo-header %v", hf.Name)
+			}
+
+			pseudo[hf.Name] = hf.Value
+			continue
+		}
+		regular = true
+
+		if hf.Name != strings.ToLower(hf.Name) {
+			return nil, fmt.Errorf("uppercase header name %v", hf.Name)
+		}
+
+		if slices.Contains(h2ConnectionHeaders, hf.Name) {
+			return nil, fmt.Errorf("connection-specific header %v", hf.Name)
+		}
+
+		if hf.Name == "te" && hf.Value != "trailers" {
+			return nil, errors.New("te header other than trailers")
+		}
+
+		// Cookies may be split into several fields, which are joined with
+		// "; " instead of ", ". Refer to RFC 9113 8.2.3.
+		if prior := req.Headers.Get("cookie"); hf.Name == "cookie" && prior != "" {
+			req.Headers.Replace("cookie", prior+"; "+hf.Value)
+			continue
+		}
+
+		req.Headers.Set(hf.Name, hf.Value)
+	}
+
+	method := pseudo[":method"]
+	target := pseudo[":path"]
+
+	switch {
+	case method == "":
+		return nil, errors.New("missing :method")
+	case method == "CONNECT":
+		if pseudo[":authority"] == "" || pseudo[":scheme"] != "" || target != "" {
+			return nil, errors.New("malformed CONNECT request")
+		}
+		target = pseudo[":authority"]
+	case pseudo[":scheme"] == "" || target == "":
+		return nil, errors.New("missing :scheme or :path")
+	}
+
+	req.RequestLine = request.RequestLine{
+		Method:        method,
+		RequestTarget: target,
+		HttpVersion:   "2",
+	}
+
+	if authority := pseudo[":authority"]; authority != "" && req.Headers.Get("host") == "" {
+		req.Headers.Set("host", authority)
+	}
+
+	return req, nil
+}
+
+// h2cUpgradeSettings returns the settings of a request asking to upgrade to
+// h2c. ok is false for any other request. Refer to RFC 7540 3.2.
+func h2cUpgradeSettings(req *request.Request) ([]http2.Setting, bool) {
+	connection := req.Headers.Get("connection")
+	if !hasToken(req.Headers.Get("upgrade"), "h2c") ||
+		!hasToken(connection, "upgrade") || !hasToken(connection, "http2-settings") {
+		return nil, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(req.Headers.Get("http2-settings"), "="))
+	if err != nil {
+		return nil, false
+	}
+
+	settings, err := http2.ParseSettings(payload)
+	if err != nil {
+		return nil, false
+	}
+
+	return settings, true
+}
+
+// upgradeH2C switches the connection to HTTP/2, answering req on stream 1.
+func (s *Server) upgradeH2C(ctx context.Context, w *response.Writer, req *request.Request, settings []http2.Setting) {
+	err := w.WriteStatusLine(response.StatusSwitchingProtocols)
+	if err != nil {
+		log.Printf("failed to write status line to conn: %v", err)
+		return
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", "h2c")
+
+	err = w.WriteHeaders(h)
+	if err != nil {
+		log.Printf("failed to write headers to conn: %v", err)
+		return
+	}
+
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		log.Printf("failed to hijack conn: %v", err)
+		return
+	}
+
+	for _, name := range []string{"connection", "upgrade", "http2-settings"} {
+		req.Headers.Del(name)
+	}
+	req.RequestLine.HttpVersion = "2"
+
+	br := bufio.NewReaderSize(io.MultiReader(bytes.NewReader(buffered), conn), h2BufferSize)
+	s.serveH2(ctx, conn, br, req, settings)
+}
+
+// hasH2Preface reports whether the client starts with the HTTP/2
+// connection preface, i.e. speaks HTTP/2 with prior knowledge. Refer to
+// RFC 9113 3.3.
+func hasH2Preface(br *bufio.Reader) bool {
+	// Peek a byte at a time, an HTTP/1.1 request may be shorter than the
+	// preface.
+	for n := 1; n <= len(http2.ClientPreface); n++ {
+		peeked, err := br.Peek(n)
+		if err != nil || peeked[n-1] != http2.ClientPreface[n-1] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hasToken reports whether the comma-separated list contains token, ignoring
+// case.
+func hasToken(list, token string) bool {
+	for _, element := range strings.Split(list, ",") {
+		if strings.EqualFold(strings.TrimSpace(element), token) {
+			return true
+		}
+	}
+
+	return false
+}
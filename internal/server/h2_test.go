@@ -0,0 +1,534 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/conntest"
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/http2"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// h2Handler answers according to the path, the way the handlers in main do
+// over HTTP/1.1.
+func h2Handler(w *response.Writer, req *request.Request) {
+	h := headers.NewHeaders()
+	h.Set("X-Remote-Addr", req.RemoteAddr)
+	h.Set("X-Proto", req.RequestLine.HttpVersion)
+
+	switch req.RequestLine.RequestTarget {
+	case "/echo":
+		w.WriteStatusLine(response.StatusOK)
+		h.Set("Content-Length", fmt.Sprint(len(req.Body)))
+		h.Set("Connection", "close")
+		w.WriteHeaders(h)
+		w.WriteBody(req.Body)
+	case "/large":
+		body := strings.Repeat("0123456789", 100_000)
+		w.WriteStatusLine(response.StatusOK)
+		h.Set("Content-Length", fmt.Sprint(len(body)))
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	case "/stream":
+		w.WriteStatusLine(response.StatusOK)
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Checksum")
+		w.WriteHeaders(h)
+
+		sum := sha256.New()
+		for _, part := range []string{"part one, ", "part two"} {
+			w.WriteChunkedBody([]byte(part))
+			w.Flush()
+			sum.Write([]byte(part))
+		}
+		w.WriteChunkedBodyDone()
+
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Checksum", hex.EncodeToString(sum.Sum(nil)))
+		w.WriteTrailers(trailers)
+	case "/hints":
+		w.WriteEarlyHints(response.PreloadLink("/style.css", "style"))
+		w.WriteStatusLine(response.StatusOK)
+		h.Set("Content-Length", "2")
+		w.WriteHeaders(h)
+		w.WriteBody([]byte("ok"))
+	case "/until-close":
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte("until the end"))
+	case "/nothing":
+	default:
+		body := fmt.Sprintf("%v %v", req.RequestLine.Method, req.RequestLine.RequestTarget)
+		w.WriteStatusLine(response.StatusOK)
+		h.Set("Content-Length", fmt.Sprint(len(body)))
+		h.Set("X-Host", req.Headers.Get("host"))
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}
+}
+
+func TestH2C(t *testing.T) {
+	s, err := Serve(0, h2Handler)
+	require.NoError(t, err)
+	defer s.Close()
+	url := "http://" + s.Addr().String()
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	transport := &http.Transport{Protocols: &protocols}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+
+	get := func(path string) (*http.Response, string) {
+		resp, err := client.Get(url + path)
+		require.NoError(t, err)
+		return resp, conntest.ReadBody(t, resp.Body)
+	}
+
+	// Test: prior knowledge
+	resp, body := get("/path?q=1")
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "GET /path?q=1", body)
+	assert.Equal(t, "2", resp.Header.Get("X-Proto"))
+	assert.Equal(t, s.Addr().String(), resp.Header.Get("X-Host"))
+
+	// Test: request body, connection-specific headers are dropped
+	resp, err = client.Post(url+"/echo", "text/plain", strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", conntest.ReadBody(t, resp.Body))
+	assert.Empty(t, resp.Header.Get("Connection"))
+
+	// Test: bodies bigger than the flow control windows
+	resp, body = get("/large")
+	assert.Equal(t, int64(1_000_000), resp.ContentLength)
+	assert.Equal(t, strings.Repeat("0123456789", 100_000), body)
+
+	// Test: chunked bodies and trailers
+	resp, body = get("/stream")
+	assert.Equal(t, "part one, part two", body)
+	sum := sha256.Sum256([]byte(body))
+	assert.Equal(t, hex.EncodeToString(sum[:]), resp.Trailer.Get("X-Checksum"))
+
+	// Test: interim responses
+	resp, body = get("/hints")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "ok", body)
+
+	// Test: bodies without a length
+	_, body = get("/until-close")
+	assert.Equal(t, "until the end", body)
+
+	// Test: HEAD
+	resp, err = client.Head(url + "/path")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, int64(len("HEAD /path")), resp.ContentLength)
+
+	// Test: handlers not writing a response reset the stream
+	_, err = client.Get(url + "/nothing")
+	assert.Error(t, err)
+
+	// Test: concurrent streams share the conn
+	var wg sync.WaitGroup
+	addrs := make([]string, 20)
+	for i := range addrs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, err := client.Get(fmt.Sprintf("%v/concurrent/%d", url, i))
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, fmt.Sprintf("GET /concurrent/%d", i), string(body))
+			addrs[i] = resp.Header.Get("X-Remote-Addr")
+		}()
+	}
+	wg.Wait()
+	for _, addr := range addrs {
+		assert.Equal(t, addrs[0], addr)
+	}
+
+	// Test: HTTP/1.1 still works on the same port
+	resp, err = http.Get(url + "/path")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 1, resp.ProtoMajor)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+// h2Frames reads frames from br until fn returns true.
+func h2Frames(t *testing.T, br *bufio.Reader, fn func(f *http2.Frame) bool) {
+	t.Helper()
+
+	for {
+		f, err := http2.ReadFrame(br, http2.DefaultMaxFrameSize)
+		require.NoError(t, err)
+
+		if fn(f) {
+			return
+		}
+	}
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	s, err := Serve(0, h2Handler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// SETTINGS_MAX_CONCURRENT_STREAMS 100, SETTINGS_INITIAL_WINDOW_SIZE 65535
+	_, err = io.WriteString(conn, "POST /echo HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\n"+
+		"HTTP2-Settings: AAMAAABkAAQAAP__\r\n"+
+		"Content-Length: 5\r\n"+
+		"\r\n"+
+		"hello")
+	require.NoError(t, err)
+
+	// Test: the server switches protocols
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 101, resp.StatusCode)
+	assert.Equal(t, "h2c", resp.Header.Get("Upgrade"))
+
+	_, err = io.WriteString(conn, http2.ClientPreface)
+	require.NoError(t, err)
+	require.NoError(t, http2.WriteFrame(conn, http2.Frame{Type: http2.FrameSettings}))
+
+	// Test: the upgrade request is answered on stream 1
+	decoder := http2.NewDecoder(http2.DefaultHeaderTableSize, 0)
+	var fields []http2.HeaderField
+	var body []byte
+	h2Frames(t, br, func(f *http2.Frame) bool {
+		if f.StreamID != 1 {
+			return false
+		}
+
+		switch f.Type {
+		case http2.FrameHeaders:
+			fields, err = decoder.Decode(f.Payload)
+			require.NoError(t, err)
+		case http2.FrameData:
+			body = append(body, f.Payload...)
+		}
+
+		return f.Has(http2.FlagEndStream)
+	})
+	assert.Contains(t, fields, http2.HeaderField{Name: ":status", Value: "200"})
+	assert.Equal(t, "hello", string(body))
+
+	// Test: stream 1 is closed, new requests use the next streams
+	block := http2.Encoder{}.Encode(nil,
+		http2.HeaderField{Name: ":method", Value: "GET"},
+		http2.HeaderField{Name: ":scheme", Value: "http"},
+		http2.HeaderField{Name: ":path", Value: "/next"},
+		http2.HeaderField{Name: ":authority", Value: "example.com"},
+	)
+	require.NoError(t, http2.WriteFrame(conn, http2.Frame{Type: http2.FrameHeaders, Flags: http2.FlagEndHeaders | http2.FlagEndStream, StreamID: 3, Payload: block}))
+
+	body = nil
+	h2Frames(t, br, func(f *http2.Frame) bool {
+		if f.StreamID == 3 && f.Type == http2.FrameData {
+			body = append(body, f.Payload...)
+		}
+		return f.StreamID == 3 && f.Has(http2.FlagEndStream)
+	})
+	assert.Equal(t, "GET /next", string(body))
+}
+
+func TestH2CProtocolErrors(t *testing.T) {
+	s, err := Serve(0, h2Handler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	_, err = io.WriteString(conn, http2.ClientPreface)
+	require.NoError(t, err)
+	require.NoError(t, http2.WriteFrame(conn, http2.Frame{Type: http2.FrameSettings}))
+
+	headersFrame := func(streamID uint32, fields ...http2.HeaderField) http2.Frame {
+		return http2.Frame{
+			Type:     http2.FrameHeaders,
+			Flags:    http2.FlagEndHeaders | http2.FlagEndStream,
+			StreamID: streamID,
+			Payload:  http2.Encoder{}.Encode(nil, fields...),
+		}
+	}
+
+	valid := []http2.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+	}
+
+	// Test: PING is answered
+	require.NoError(t, http2.WriteFrame(conn, http2.Frame{Type: http2.FramePing, Payload: []byte("12345678")}))
+	h2Frames(t, br, func(f *http2.Frame) bool {
+		return f.Type == http2.FramePing && f.Has(http2.FlagAck) && string(f.Payload) == "12345678"
+	})
+
+	// Test: malformed requests reset the stream
+	for i, fields := range [][]http2.HeaderField{
+		append(valid, http2.HeaderField{Name: "connection", Value: "close"}),
+		append(valid, http2.HeaderField{Name: "X-Upper", Value: "case"}),
+		append([]http2.HeaderField{{Name: "x-first", Value: "1"}}, valid...),
+		valid[1:],
+	} {
+		streamID := uint32(2*i + 1)
+		require.NoError(t, http2.WriteFrame(conn, headersFrame(streamID, fields...)))
+
+		h2Frames(t, br, func(f *http2.Frame) bool {
+			if f.Type != http2.FrameRSTStream || f.StreamID != streamID {
+				return false
+			}
+
+			code, err := f.ErrCode()
+			require.NoError(t, err)
+			assert.Equal(t, http2.ErrCodeProtocol, code)
+			return true
+		})
+	}
+
+	// Test: streams initiated by the client must be odd
+	require.NoError(t, http2.WriteFrame(conn, headersFrame(100, valid...)))
+	h2Frames(t, br, func(f *http2.Frame) bool {
+		if f.Type != http2.FrameGoAway {
+			return false
+		}
+
+		_, code, err := f.GoAway()
+		require.NoError(t, err)
+		assert.Equal(t, http2.ErrCodeProtocol, code)
+		return true
+	})
+
+	// Test: the conn is closed after GOAWAY
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestH2RequestBody(t *testing.T) {
+	s, err := Serve(0, h2Handler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	_, err = io.WriteString(conn, http2.ClientPreface)
+	require.NoError(t, err)
+	require.NoError(t, http2.WriteFrame(conn, http2.Frame{Type: http2.FrameSettings}))
+
+	post := func(streamID uint32, fields ...http2.HeaderField) {
+		fields = append([]http2.HeaderField{
+			{Name: ":method", Value: "POST"},
+			{Name: ":scheme", Value: "http"},
+			{Name: ":path", Value: "/echo"},
+		}, fields...)
+		require.NoError(t, http2.WriteFrame(conn, http2.Frame{
+			Type:     http2.FrameHeaders,
+			Flags:    http2.FlagEndHeaders,
+			StreamID: streamID,
+			Payload:  http2.Encoder{}.Encode(nil, fields...),
+		}))
+	}
+
+	// refused reads frames up to the 413 and RST_STREAM on the stream.
+	decoder := http2.NewDecoder(http2.DefaultHeaderTableSize, 0)
+	refused := func(streamID uint32) {
+		var fields []http2.HeaderField
+		h2Frames(t, br, func(f *http2.Frame) bool {
+			if f.StreamID != streamID {
+				return false
+			}
+
+			switch f.Type {
+			case http2.FrameHeaders:
+				fields, err = decoder.Decode(f.Payload)
+				require.NoError(t, err)
+			case http2.FrameRSTStream:
+				code, err := f.ErrCode()
+				require.NoError(t, err)
+				assert.Equal(t, http2.ErrCodeNo, code)
+				return true
+			}
+			return false
+		})
+		assert.Contains(t, fields, http2.HeaderField{Name: ":status", Value: "413"})
+	}
+
+	// Test: the connection window is held until the handler is done with
+	// the body
+	post(1)
+	require.NoError(t, http2.WriteFrame(conn, http2.Frame{Type: http2.FrameData, Flags: http2.FlagEndStream, StreamID: 1, Payload: make([]byte, 1000)}))
+	h2Frames(t, br, func(f *http2.Frame) bool {
+		if f.Type == http2.FrameWindowUpdate && f.StreamID == 0 {
+			increment, err := f.WindowIncrement()
+			require.NoError(t, err)
+			assert.Equal(t, uint32(h2ConnWindowSize-http2.DefaultInitialWindowSize), increment)
+		}
+		return f.StreamID == 1 && f.Has(http2.FlagEndStream)
+	})
+	h2Frames(t, br, func(f *http2.Frame) bool {
+		if f.Type != http2.FrameWindowUpdate || f.StreamID != 0 {
+			return false
+		}
+
+		increment, err := f.WindowIncrement()
+		require.NoError(t, err)
+		assert.Equal(t, uint32(1000), increment)
+		return true
+	})
+
+	// Test: bodies declared too large are refused before they're sent
+	post(3, http2.HeaderField{Name: "content-length", Value: fmt.Sprint(h2MaxBodySize + 1)})
+	refused(3)
+
+	// Test: bodies growing too large are refused
+	post(5)
+	chunk := make([]byte, http2.DefaultMaxFrameSize)
+	go func() {
+		for sent := 0; sent <= h2MaxBodySize; sent += len(chunk) {
+			err := http2.WriteFrame(conn, http2.Frame{Type: http2.FrameData, StreamID: 5, Payload: chunk})
+			if err != nil {
+				return
+			}
+		}
+	}()
+	refused(5)
+}
+
+func TestH2Shutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			close(started)
+			<-release
+		}
+		h2Handler(w, req)
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		_, err = io.WriteString(conn, http2.ClientPreface)
+		require.NoError(t, err)
+		require.NoError(t, http2.WriteFrame(conn, http2.Frame{Type: http2.FrameSettings}))
+		return conn, bufio.NewReader(conn)
+	}
+
+	get := func(conn net.Conn, streamID uint32, path string) {
+		require.NoError(t, http2.WriteFrame(conn, http2.Frame{
+			Type:     http2.FrameHeaders,
+			Flags:    http2.FlagEndHeaders | http2.FlagEndStream,
+			StreamID: streamID,
+			Payload: http2.Encoder{}.Encode(nil,
+				http2.HeaderField{Name: ":method", Value: "GET"},
+				http2.HeaderField{Name: ":scheme", Value: "http"},
+				http2.HeaderField{Name: ":path", Value: path},
+			),
+		}))
+	}
+
+	goAway := func(br *bufio.Reader) {
+		h2Frames(t, br, func(f *http2.Frame) bool {
+			if f.Type != http2.FrameGoAway {
+				return false
+			}
+
+			lastStreamID, code, err := f.GoAway()
+			require.NoError(t, err)
+			assert.Equal(t, uint32(1), lastStreamID)
+			assert.Equal(t, http2.ErrCodeNo, code)
+			return true
+		})
+	}
+
+	// One conn done with its stream, another waiting for a response.
+	idleConn, idleBR := dial()
+	get(idleConn, 1, "/path")
+	h2Frames(t, idleBR, func(f *http2.Frame) bool {
+		return f.StreamID == 1 && f.Has(http2.FlagEndStream)
+	})
+
+	busyConn, busyBR := dial()
+	get(busyConn, 1, "/slow")
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- s.Shutdown(ctx)
+	}()
+
+	// Test: idle conns get GOAWAY and are closed right away
+	goAway(idleBR)
+	_, err = idleBR.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: busy conns get GOAWAY, and streams opened after it are refused
+	goAway(busyBR)
+	get(busyConn, 3, "/path")
+	h2Frames(t, busyBR, func(f *http2.Frame) bool {
+		if f.Type != http2.FrameRSTStream || f.StreamID != 3 {
+			return false
+		}
+
+		code, err := f.ErrCode()
+		require.NoError(t, err)
+		assert.Equal(t, http2.ErrCodeRefusedStream, code)
+		return true
+	})
+
+	// Test: the streams open are answered, then the conn is closed
+	close(release)
+	h2Frames(t, busyBR, func(f *http2.Frame) bool {
+		return f.StreamID == 1 && f.Has(http2.FlagEndStream)
+	})
+	_, err = busyBR.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	select {
+	case err := <-shutdown:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown didn't return once the conns were closed")
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/http2"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+)
+
+// h2ResponseWriter lets handlers answer HTTP/2 streams with the same
+// response.Writer as HTTP/1.1 connections. The writer is handed this as its
+// conn, and the HTTP/1.1 response it writes is parsed back and sent as
+// HEADERS and DATA frames. That way everything built on top of the writer,
+// such as compression, works the same over both.
+type h2ResponseWriter struct {
+	c  *h2Conn
+	st *h2Stream
+
+	resp    *response.Response
+	pending bytes.Buffer
+
+	interimSent int
+	headersSent bool
+	ended       bool
+	err         error
+}
+
+func newH2ResponseWriter(c *h2Conn, st *h2Stream) *h2ResponseWriter {
+	return &h2ResponseWriter{
+		c:    c,
+		st:   st,
+		resp: response.NewResponse(st.req.RequestLine.Method),
+	}
+}
+
+func (sw *h2ResponseWriter) Write(p []byte) (int, error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+
+	sw.pending.Write(p)
+
+	for sw.pending.Len() > 0 && !sw.resp.Done() {
+		n, err := sw.resp.Parse(sw.pending.Bytes())
+		if err != nil {
+			sw.abort(err)
+			return 0, err
+		}
+		sw.pending.Next(n)
+
+		err = sw.send()
+		if err != nil {
+			sw.abort(err)
+			return 0, err
+		}
+
+		if n == 0 {
+			break
+		}
+	}
+
+	// Anything written past the end of the response has nowhere to go.
+	if sw.resp.Done() {
+		sw.pending.Reset()
+	}
+
+	return len(p), nil
+}
+
+// send sends whatever the parser made of the response so far.
+func (sw *h2ResponseWriter) send() error {
+	r := sw.resp
+
+	for ; sw.interimSent < len(r.Interim); sw.interimSent++ {
+		interim := r.Interim[sw.interimSent]
+		err := sw.c.writeHeaders(sw.st.id, h2Fields(interim.StatusLine.StatusCode, interim.Headers), false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !r.HeadersDone() {
+		return nil
+	}
+
+	if !sw.headersSent {
+		if r.StatusLine.StatusCode == response.StatusSwitchingProtocols {
+			return errors.New("switching protocols is not supported over HTTP/2")
+		}
+
+		sw.headersSent = true
+		sw.ended = r.Done() && len(r.Body) == 0 && len(r.Trailers) == 0
+
+		err := sw.c.writeHeaders(sw.st.id, h2Fields(r.StatusLine.StatusCode, r.Headers), sw.ended)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(r.Body) > 0 {
+		sw.ended = r.Done() && len(r.Trailers) == 0
+
+		err := sw.c.writeData(sw.st, r.Body, sw.ended)
+		if err != nil {
+			return err
+		}
+		r.Body = r.Body[:0]
+	}
+
+	if r.Done() && !sw.ended {
+		sw.ended = true
+
+		if len(r.Trailers) > 0 {
+			return sw.c.writeHeaders(sw.st.id, h2Fields("", r.Trailers), true)
+		}
+		return sw.c.writeData(sw.st, nil, true)
+	}
+
+	return nil
+}
+
+// finish ends the stream once the handler has returned.
+func (sw *h2ResponseWriter) finish() {
+	if sw.err != nil || sw.ended {
+		return
+	}
+
+	// The body ran until the end of the "connection".
+	if sw.headersSent && sw.resp.DelimitedByClose() {
+		sw.ended = true
+		err := sw.c.writeData(sw.st, nil, true)
+		if err != nil {
+			sw.abort(err)
+		}
+		return
+	}
+
+	// The handler didn't write a complete response.
+	sw.abort(errors.New("incomplete response"))
+}
+
+// abort resets the stream after err, unless the stream is already gone.
+func (sw *h2ResponseWriter) abort(err error) {
+	if sw.err != nil {
+		return
+	}
+	sw.err = err
+
+	if !errors.Is(err, errStreamClosed) {
+		sw.c.resetStream(sw.st.id, http2.ErrCodeInternal)
+	}
+}
+
+// h2Fields turns a status code and headers into a header block, leaving out
+// the headers HTTP/2 doesn't allow. Trailers have no status.
+func h2Fields(statusCode string, h headers.Headers) []http2.HeaderField {
+	fields := make([]http2.HeaderField, 0, len(h)+1)
+	if statusCode != "" {
+		fields = append(fields, http2.HeaderField{Name: ":status", Value: statusCode})
+	}
+
+	for key := range h {
+		name := strings.ToLower(key)
+
+		if name == "te" || slices.Contains(h2ConnectionHeaders, name) {
+			continue
+		}
+
+		for _, value := range h.Values(key) {
+			fields = append(fields, http2.HeaderField{Name: name, Value: value})
+		}
+	}
+
+	return fields
+}
+
+// The rest of net.Conn, of which only Write is of use.
+
+func (sw *h2ResponseWriter) Read(p []byte) (int, error) {
+	return 0, errors.New("HTTP/2 streams can't be read from as a conn")
+}
+
+func (sw *h2ResponseWriter) Close() error {
+	return nil
+}
+
+func (sw *h2ResponseWriter) LocalAddr() net.Addr {
+	return sw.c.conn.LocalAddr()
+}
+
+func (sw *h2ResponseWriter) RemoteAddr() net.Addr {
+	return sw.c.conn.RemoteAddr()
+}
+
+func (sw *h2ResponseWriter) SetDeadline(t time.Time) error      { return nil }
+func (sw *h2ResponseWriter) SetReadDeadline(t time.Time) error  { return nil }
+func (sw *h2ResponseWriter) SetWriteDeadline(t time.Time) error { return nil }
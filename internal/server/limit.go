@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+)
+
+const (
+	// DefaultRetryAfter is how long clients rejected for being over
+	// MaxConns are told to wait.
+	DefaultRetryAfter = time.Second
+
+	// How long to wait before accepting again after an error, doubling on
+	// every error in a row.
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+
+	// How long a rejected client gets to take its 503.
+	rejectTimeout = time.Second
+	// How much of a rejected request's body is read, so that closing the
+	// conn doesn't reset it before the client reads the 503.
+	rejectDrainSize = 64 << 10
+)
+
+// ConnLimitMode is what happens to connections over Server.MaxConns.
+type ConnLimitMode int
+
+const (
+	// Connections aren't accepted until there's room for them.
+	ConnLimitBlock ConnLimitMode = iota
+	// Connections are accepted and answered right away with 503 Service
+	// Unavailable and a Retry-After.
+	ConnLimitReject
+)
+
+// ParseConnLimitMode parses "block" or "reject".
+func ParseConnLimitMode(mode string) (ConnLimitMode, error) {
+	switch mode {
+	case "", "block":
+		return ConnLimitBlock, nil
+	case "reject":
+		return ConnLimitReject, nil
+	}
+
+	return 0, fmt.Errorf("unknown connection limit mode: %q", mode)
+}
+
+func (s *Server) releaseSlot() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// reject answers conn with 503 Service Unavailable, without handling the
+// request.
+func (s *Server) reject(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+
+	// Clients don't expect a response before they've sent their request,
+	// so wait for the headers, whether or not they make sense.
+	br := bufioReaderPool.Get().(*bufio.Reader)
+	br.Reset(conn)
+	defer func() {
+		br.Reset(nil)
+		bufioReaderPool.Put(br)
+	}()
+	request.RequestHeadersFromReader(br)
+
+	retryAfter := s.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = DefaultRetryAfter
+	}
+	body := []byte("server is at capacity, try again later")
+
+	w := response.NewWriter(conn)
+	h := headers.NewHeaders()
+	h.Set("Retry-After", fmt.Sprint(int(math.Ceil(retryAfter.Seconds()))))
+	h.Set("Content-Length", fmt.Sprint(len(body)))
+	h.Set("Connection", "close")
+
+	err := w.WriteStatusLine(response.StatusServiceUnavailable)
+	if err == nil {
+		err = w.WriteHeaders(h)
+	}
+	if err == nil {
+		_, err = w.WriteBody(body)
+	}
+	if finishErr := w.Finish(); err == nil {
+		err = finishErr
+	}
+	if err != nil {
+		log.Printf("failed to reject connection: %v", err)
+		return
+	}
+
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	io.Copy(io.Discard, io.LimitReader(br, rejectDrainSize))
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingHandler holds up every request until release is closed, keeping
+// track of how many it holds at once.
+type blockingHandler struct {
+	started chan struct{}
+	release chan struct{}
+
+	mu     sync.Mutex
+	active int
+	most   int
+}
+
+func newBlockingHandler() *blockingHandler {
+	return &blockingHandler{
+		started: make(chan struct{}, 10),
+		release: make(chan struct{}),
+	}
+}
+
+func (b *blockingHandler) handle(w *response.Writer, req *request.Request) {
+	b.mu.Lock()
+	b.active++
+	b.most = max(b.most, b.active)
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.active--
+		b.mu.Unlock()
+	}()
+
+	b.started <- struct{}{}
+	<-b.release
+
+	w.WriteStatusLine(response.StatusOK)
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "0")
+	w.WriteHeaders(h)
+}
+
+func serveLimited(t *testing.T, handler Handler, mode ConnLimitMode) *Server {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := NewServer([]net.Listener{listener}, handler)
+	s.MaxConns = 2
+	s.ConnLimitMode = mode
+	s.RetryAfter = 1500 * time.Millisecond
+	go s.Listen()
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func TestConnLimitBlock(t *testing.T) {
+	b := newBlockingHandler()
+	s := serveLimited(t, b.handle, ConnLimitBlock)
+	url := "http://" + s.Addr().String()
+
+	// Test: conns over the limit wait their turn
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, err := http.Get(url)
+			if assert.NoError(t, err) {
+				resp.Body.Close()
+				assert.Equal(t, 200, resp.StatusCode)
+			}
+		}()
+	}
+
+	<-b.started
+	<-b.started
+	select {
+	case <-b.started:
+		t.Fatal("more requests served than MaxConns")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(b.release)
+	wg.Wait()
+	assert.Equal(t, 2, b.most)
+}
+
+func TestConnLimitReject(t *testing.T) {
+	b := newBlockingHandler()
+	s := serveLimited(t, b.handle, ConnLimitReject)
+	url := "http://" + s.Addr().String()
+
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, err := http.Get(url)
+			if assert.NoError(t, err) {
+				resp.Body.Close()
+			}
+		}()
+	}
+	<-b.started
+	<-b.started
+
+	// Test: conns over the limit are told to come back later
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+
+	// Test: rejected conns don't take up a slot
+	close(b.release)
+	wg.Wait()
+	resp, err = http.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestParseConnLimitMode(t *testing.T) {
+	mode, err := ParseConnLimitMode("reject")
+	require.NoError(t, err)
+	assert.Equal(t, ConnLimitReject, mode)
+
+	mode, err = ParseConnLimitMode("")
+	require.NoError(t, err)
+	assert.Equal(t, ConnLimitBlock, mode)
+
+	_, err = ParseConnLimitMode("drop")
+	assert.Error(t, err)
+}
+
+// failingListener fails to accept a few times, then waits to be closed.
+type failingListener struct {
+	net.Listener
+	failures int
+
+	mu      sync.Mutex
+	calls   []time.Time
+	retried chan struct{}
+	closed  chan struct{}
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	l.calls = append(l.calls, time.Now())
+	calls := len(l.calls)
+	l.mu.Unlock()
+
+	if calls <= l.failures {
+		return nil, errors.New("too many open files")
+	}
+	if calls == l.failures+1 {
+		close(l.retried)
+	}
+
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *failingListener) Close() error {
+	close(l.closed)
+	return nil
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	listener := &failingListener{
+		failures: 4,
+		retried:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	s := NewServer([]net.Listener{listener}, nil)
+	go s.Listen()
+	defer s.Close()
+
+	// Test: every failure doubles the wait before accepting again
+	<-listener.retried
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+	for i := 1; i < len(listener.calls); i++ {
+		wait := listener.calls[i].Sub(listener.calls[i-1])
+		assert.GreaterOrEqual(t, wait, minAcceptBackoff<<(i-1))
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The file descriptor of the first socket passed by systemd socket
+// activation. Refer to sd_listen_fds(3).
+const listenFDsStart = 3
+
+// Listen listens on address, which is either a TCP host:port, such as
+// ":42069", "127.0.0.1:8080" or "[::1]:8080", or the path of a Unix domain
+// socket prefixed with "unix:", such as "unix:/run/httpserver.sock".
+//
+// unixMode is the permissions of Unix domain sockets. Zero leaves them to
+// the umask.
+func Listen(address string, unixMode fs.FileMode) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		return ListenUnix(path, unixMode)
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %v: %w", address, err)
+	}
+
+	return listener, nil
+}
+
+// ListenReusePort opens n TCP listeners on the same address with
+// SO_REUSEPORT, leaving it to the kernel to spread connections across them.
+// Served with ServeListeners, each gets its own accept goroutine, so a
+// single accept loop doesn't hold up servers taking on many new connections.
+// It's only supported on Linux.
+func ListenReusePort(address string, n int) ([]net.Listener, error) {
+	if strings.HasPrefix(address, "unix:") {
+		return nil, fmt.Errorf("failed to listen on %v: SO_REUSEPORT is for TCP only", address)
+	}
+	if n < 1 {
+		return nil, fmt.Errorf("failed to listen on %v: need at least one listener, got %d", address, n)
+	}
+
+	config := net.ListenConfig{Control: reusePort}
+	listeners := make([]net.Listener, 0, n)
+	for range n {
+		listener, err := config.Listen(context.Background(), "tcp", address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on %v: %w", address, err)
+		}
+		listeners = append(listeners, listener)
+
+		// The rest have to bind to the same port, in case it was picked
+		// by the kernel.
+		address = listener.Addr().String()
+	}
+
+	return listeners, nil
+}
+
+// ListenUnix listens on the Unix domain socket at path. A socket left behind
+// by a server that didn't shut down cleanly is removed first, but one that's
+// still in use isn't. The socket is removed again when the listener is
+// closed.
+func ListenUnix(path string, mode fs.FileMode) (net.Listener, error) {
+	err := removeStaleSocket(path)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %v: %w", path, err)
+	}
+
+	if mode != 0 {
+		err = os.Chmod(path, mode)
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to set permissions of %v: %w", path, err)
+		}
+	}
+
+	return listener, nil
+}
+
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat %v: %w", path, err)
+	}
+
+	// Never remove anything that isn't ours to remove.
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("failed to listen on %v: file exists and is not a socket", path)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("failed to listen on %v: socket is in use", path)
+	}
+
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale socket %v: %w", path, err)
+	}
+
+	return nil
+}
+
+// InheritedListeners returns the listening sockets passed down by systemd
+// socket activation, or by anything else following the same protocol of
+// setting LISTEN_PID, LISTEN_FDS and optionally LISTEN_FDNAMES. It returns
+// nil if there are none. Listeners handed over by Upgrade are picked up the
+// same way.
+//
+// The variables are unset, so they aren't passed on to child processes.
+func InheritedListeners() ([]net.Listener, error) {
+	pid := os.Getenv("LISTEN_PID")
+	fds := os.Getenv("LISTEN_FDS")
+	names := os.Getenv("LISTEN_FDNAMES")
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if fds == "" {
+		return nil, nil
+	}
+
+	// The sockets were meant for someone else.
+	_, upgraded := upgradedFrom()
+	if pid != strconv.Itoa(os.Getpid()) && !upgraded {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %q", fds)
+	}
+
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+
+	listeners := make([]net.Listener, 0, n)
+	for i := range n {
+		fd := listenFDsStart + i
+
+		name := fmt.Sprintf("LISTEN_FD_%d", fd)
+		if i < len(fdNames) {
+			name = fdNames[i]
+		}
+
+		// FileListener works on a duplicate, so the original is closed
+		// either way.
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to use inherited socket %v: %w", name, err)
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/johndosdos/http-from-tcp/internal/conntest"
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pidHandler answers with the pid of the process serving the request.
+func pidHandler(w *response.Writer, req *request.Request) {
+	body := strconv.Itoa(os.Getpid())
+
+	w.WriteStatusLine(response.StatusOK)
+	h := headers.NewHeaders()
+	h.Set("Content-Length", fmt.Sprint(len(body)))
+	h.Set("X-Remote-Addr", req.RemoteAddr)
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+}
+
+// getVia sends a GET request over conns from dial.
+func getVia(t *testing.T, dial func() (net.Conn, error)) *http.Response {
+	t.Helper()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial()
+		},
+	}}
+
+	resp, err := client.Get("http://localhost/")
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestListen(t *testing.T) {
+	// Test: TCP over IPv4 and IPv6
+	for _, address := range []string{"127.0.0.1:0", "[::1]:0"} {
+		listener, err := Listen(address, 0)
+		if err != nil && address == "[::1]:0" {
+			t.Log("skipping IPv6, not available:", err)
+			continue
+		}
+		require.NoError(t, err)
+
+		s := ServeListener(listener, pidHandler)
+		resp := getVia(t, func() (net.Conn, error) { return net.Dial("tcp", s.Addr().String()) })
+		assert.Equal(t, strconv.Itoa(os.Getpid()), conntest.ReadBody(t, resp.Body))
+		s.Close()
+	}
+
+	// Test: invalid address
+	_, err := Listen("not an address", 0)
+	assert.Error(t, err)
+}
+
+// countingListener counts the conns it accepts.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+func TestListenReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only supported on Linux")
+	}
+
+	// Test: the listeners share the port the kernel picked
+	listeners, err := ListenReusePort("127.0.0.1:0", 4)
+	require.NoError(t, err)
+	require.Len(t, listeners, 4)
+
+	counting := make([]*countingListener, len(listeners))
+	wrapped := make([]net.Listener, len(listeners))
+	for i, listener := range listeners {
+		assert.Equal(t, listeners[0].Addr(), listener.Addr())
+		counting[i] = &countingListener{Listener: listener}
+		wrapped[i] = counting[i]
+	}
+
+	// Test: connections are spread across every listener
+	s := ServeListeners(wrapped, pidHandler)
+	defer s.Close()
+	for range 64 {
+		resp := getVia(t, func() (net.Conn, error) { return net.Dial("tcp", s.Addr().String()) })
+		assert.Equal(t, 200, resp.StatusCode)
+		resp.Body.Close()
+	}
+	for _, l := range counting {
+		assert.NotZero(t, l.accepted.Load())
+	}
+
+	// Test: invalid arguments
+	_, err = ListenReusePort("unix:/tmp/http.sock", 2)
+	assert.Error(t, err)
+	_, err = ListenReusePort("127.0.0.1:0", 0)
+	assert.Error(t, err)
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "http.sock")
+
+	// Test: served over the socket, with the permissions asked for
+	listener, err := Listen("unix:"+path, 0o600)
+	require.NoError(t, err)
+	s := ServeListener(listener, pidHandler)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, fs.ModeSocket|0o600, info.Mode()&(fs.ModeType|fs.ModePerm))
+
+	resp := getVia(t, func() (net.Conn, error) { return net.Dial("unix", path) })
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, strconv.Itoa(os.Getpid()), conntest.ReadBody(t, resp.Body))
+
+	// Test: sockets in use aren't taken over
+	_, err = ListenUnix(path, 0)
+	assert.ErrorContains(t, err, "in use")
+
+	// Test: the socket is removed on close
+	require.NoError(t, s.Close())
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// Test: stale sockets are replaced
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err = ListenUnix(path, 0)
+	require.NoError(t, err)
+	listener.Close()
+
+	// Test: other files are left alone
+	require.NoError(t, os.WriteFile(path, []byte("keep me"), 0o644))
+	_, err = ListenUnix(path, 0)
+	assert.ErrorContains(t, err, "not a socket")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "keep me", string(data))
+}
+
+func TestInheritedListeners(t *testing.T) {
+	// Run as the child process below.
+	if os.Getenv("TEST_INHERITED_LISTENERS") == "1" {
+		// Only the child's own pid is known to be right, which whoever
+		// started it would normally set.
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+		listeners, err := InheritedListeners()
+		if err != nil || len(listeners) != 1 {
+			fmt.Println("failed:", len(listeners), err)
+			os.Exit(1)
+		}
+		s := ServeListener(listeners[0], pidHandler)
+		defer s.Close()
+
+		fmt.Println("ready")
+		io.Copy(io.Discard, os.Stdin)
+		return
+	}
+
+	// Test: no sockets
+	listeners, err := InheritedListeners()
+	require.NoError(t, err)
+	assert.Nil(t, listeners)
+
+	// Test: sockets meant for another process are ignored
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	listeners, err = InheritedListeners()
+	require.NoError(t, err)
+	assert.Nil(t, listeners)
+	assert.Empty(t, os.Getenv("LISTEN_FDS"))
+
+	// Test: a socket passed to a child process is served by the child
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	file, err := listener.(*net.TCPListener).File()
+	require.NoError(t, err)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInheritedListeners$")
+	cmd.Env = append(os.Environ(), "TEST_INHERITED_LISTENERS=1", "LISTEN_FDS=1", "LISTEN_FDNAMES=http")
+	cmd.ExtraFiles = []*os.File{file}
+	stdin, err := cmd.StdinPipe()
+	require.NoError(t, err)
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+	defer cmd.Wait()
+	defer stdin.Close()
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "ready\n", line)
+
+	// Leave accepting to the child.
+	addr := listener.Addr().String()
+	file.Close()
+	listener.Close()
+
+	resp := getVia(t, func() (net.Conn, error) { return net.Dial("tcp", addr) })
+	assert.Equal(t, strconv.Itoa(cmd.Process.Pid), conntest.ReadBody(t, resp.Body))
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ClientAuth is whether clients have to authenticate with a certificate.
+type ClientAuth int
+
+const (
+	// Clients aren't asked for a certificate.
+	ClientAuthNone ClientAuth = iota
+	// Clients may send a certificate. If they do, it has to be signed by one
+	// of the client CAs.
+	ClientAuthOptional
+	// Clients must send a certificate signed by one of the client CAs.
+	ClientAuthRequire
+)
+
+// ParseClientAuth parses "none", "optional" or "require".
+func ParseClientAuth(mode string) (ClientAuth, error) {
+	switch mode {
+	case "", "none":
+		return ClientAuthNone, nil
+	case "optional":
+		return ClientAuthOptional, nil
+	case "require":
+		return ClientAuthRequire, nil
+	}
+
+	return 0, fmt.Errorf("unknown client auth mode: %q", mode)
+}
+
+// LoadClientCAs reads the CA certificates client certificates are verified
+// against. Each file may hold several PEM encoded certificates.
+func LoadClientCAs(files ...string) (*x509.CertPool, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no client CAs given")
+	}
+
+	pool := x509.NewCertPool()
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CAs: %w", err)
+		}
+
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %v", file)
+		}
+	}
+
+	return pool, nil
+}
+
+// WithClientAuth returns a copy of config authenticating clients by
+// certificate according to mode. The identity of an authenticated client is
+// available to handlers through request.Request.ClientIdentity.
+func WithClientAuth(config *tls.Config, clientCAs *x509.CertPool, mode ClientAuth) *tls.Config {
+	config = config.Clone()
+	config.ClientCAs = clientCAs
+
+	switch mode {
+	case ClientAuthOptional:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		config.ClientAuth = tls.NoClientCert
+	}
+
+	return config
+}
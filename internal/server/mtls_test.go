@@ -0,0 +1,119 @@
+package server
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverFiles, serverPool := writeCert(t, dir, "server", "a.example.com")
+	clientFiles, _ := writeCert(t, dir, "client", "billing.internal")
+	strangerFiles, _ := writeCert(t, dir, "stranger", "billing.internal")
+
+	certs, err := LoadCertificates(serverFiles)
+	require.NoError(t, err)
+	clientCAs, err := LoadClientCAs(clientFiles.CertFile)
+	require.NoError(t, err)
+
+	clientCert, err := tls.LoadX509KeyPair(clientFiles.CertFile, clientFiles.KeyFile)
+	require.NoError(t, err)
+	strangerCert, err := tls.LoadX509KeyPair(strangerFiles.CertFile, strangerFiles.KeyFile)
+	require.NoError(t, err)
+
+	handler := func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+
+		h := headers.NewHeaders()
+		if identity := req.ClientIdentity(); identity != nil {
+			h.Set("X-Client-Subject", identity.Subject.CommonName)
+			h.Set("X-Client-Names", strings.Join(identity.DNSNames, ","))
+		}
+		h.Set("Content-Length", "0")
+		w.WriteHeaders(h)
+	}
+
+	serve := func(mode ClientAuth) *Server {
+		s, err := ServeTLS(0, handler, WithClientAuth(certs.TLSConfig(), clientCAs, mode))
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+
+	config := func(clientCerts ...tls.Certificate) *tls.Config {
+		return &tls.Config{
+			ServerName:   "a.example.com",
+			RootCAs:      serverPool,
+			Certificates: clientCerts,
+		}
+	}
+
+	// Test: required, the verified identity is exposed to the handler
+	s := serve(ClientAuthRequire)
+	resp, _, err := tlsRequest(t, s, config(clientCert))
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "billing.internal", resp.Header.Get("X-Client-Subject"))
+	assert.Equal(t, "billing.internal", resp.Header.Get("X-Client-Names"))
+
+	// Test: required, clients without a certificate are turned away
+	_, _, err = tlsRequest(t, s, config())
+	assert.Error(t, err)
+
+	// Test: required, certificates from other CAs are turned away
+	_, _, err = tlsRequest(t, s, config(strangerCert))
+	assert.Error(t, err)
+
+	// Test: optional, clients without a certificate are anonymous
+	s = serve(ClientAuthOptional)
+	resp, _, err = tlsRequest(t, s, config())
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("X-Client-Subject"))
+
+	resp, _, err = tlsRequest(t, s, config(clientCert))
+	require.NoError(t, err)
+	assert.Equal(t, "billing.internal", resp.Header.Get("X-Client-Subject"))
+
+	// Test: optional, certificates that are sent still have to verify
+	_, _, err = tlsRequest(t, s, config(strangerCert))
+	assert.Error(t, err)
+
+	// Test: none, certificates aren't asked for
+	s = serve(ClientAuthNone)
+	resp, _, err = tlsRequest(t, s, config(clientCert))
+	require.NoError(t, err)
+	assert.Empty(t, resp.Header.Get("X-Client-Subject"))
+}
+
+func TestLoadClientCAs(t *testing.T) {
+	dir := t.TempDir()
+
+	// Test: file without certificates
+	path := filepath.Join(dir, "empty.pem")
+	require.NoError(t, os.WriteFile(path, []byte("nothing here"), 0o600))
+	_, err := LoadClientCAs(path)
+	assert.Error(t, err)
+
+	// Test: missing file
+	_, err = LoadClientCAs(filepath.Join(dir, "missing.pem"))
+	assert.Error(t, err)
+
+	// Test: client auth modes
+	for mode, want := range map[string]ClientAuth{"": ClientAuthNone, "none": ClientAuthNone, "optional": ClientAuthOptional, "require": ClientAuthRequire} {
+		got, err := ParseClientAuth(mode)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, mode)
+	}
+	_, err = ParseClientAuth("sometimes")
+	assert.Error(t, err)
+}
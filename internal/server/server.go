@@ -1,11 +1,18 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/johndosdos/http-from-tcp/internal/headers"
 	"github.com/johndosdos/http-from-tcp/internal/request"
@@ -49,10 +56,46 @@ func (he *HandlerError) Write(w *response.Writer) {
 	}
 }
 
+// Readers are reused across connections, the same as the response writers'
+// buffers.
+var bufioReaderPool = sync.Pool{
+	New: func() any {
+		return bufio.NewReaderSize(nil, request.BUFFER_SIZE)
+	},
+}
+
 type Server struct {
-	listener net.Listener
-	isClosed atomic.Bool
-	handler  Handler
+	// MaxConns limits how many connections are served at once. Zero means
+	// no limit. Set it, like the other fields, before calling Listen.
+	MaxConns int
+	// ConnLimitMode is what happens to connections over MaxConns.
+	ConnLimitMode ConnLimitMode
+	// RetryAfter is how long clients are told to wait when rejected by
+	// ConnLimitReject. Zero means DefaultRetryAfter.
+	RetryAfter time.Duration
+	// ConnState, if set, is called whenever a connection changes state. It's
+	// called synchronously, so it should be quick.
+	ConnState func(net.Conn, ConnState)
+	// BaseContext is what the contexts of requests derive from, so values
+	// set on it reach every handler. Nil means context.Background.
+	BaseContext context.Context
+
+	listeners []net.Listener
+	isClosed  atomic.Bool
+	done      chan struct{}
+	handler   Handler
+
+	// Cancelled to make handlers still running give up.
+	stopCtx    context.Context
+	cancelStop context.CancelFunc
+
+	// Holds a slot for every conn served, if MaxConns is set.
+	slots chan struct{}
+
+	// mu orders adding to conns against closing, so that Shutdown doesn't
+	// miss conns accepted as the server closes.
+	mu    sync.Mutex
+	conns sync.WaitGroup
 }
 
 func Serve(port int, handler Handler) (*Server, error) {
@@ -61,44 +104,247 @@ func Serve(port int, handler Handler) (*Server, error) {
 		return nil, fmt.Errorf("error at port %d: %w", port, err)
 	}
 
-	server := &Server{
-		listener: listener,
-		handler:  handler,
-	}
+	return ServeListener(listener, handler), nil
+}
+
+// ServeListener serves connections accepted by listener, which may be any
+// listener returned by Listen, ListenUnix or InheritedListeners.
+func ServeListener(listener net.Listener, handler Handler) *Server {
+	return ServeListeners([]net.Listener{listener}, handler)
+}
+
+// ServeListeners serves connections accepted by all of listeners, each in
+// its own goroutine, such as those returned by ListenReusePort.
+func ServeListeners(listeners []net.Listener, handler Handler) *Server {
+	server := NewServer(listeners, handler)
 	go server.Listen()
 
-	return server, nil
+	return server
 }
 
+// NewServer returns a server for listeners like ServeListeners, but one that
+// doesn't serve until Listen is called, so it can be configured first.
+func NewServer(listeners []net.Listener, handler Handler) *Server {
+	stopCtx, cancelStop := context.WithCancel(context.Background())
+
+	return &Server{
+		listeners:  listeners,
+		done:       make(chan struct{}),
+		handler:    handler,
+		stopCtx:    stopCtx,
+		cancelStop: cancelStop,
+	}
+}
+
+// Addr returns the address the server is listening on, that of the first
+// listener if there are several.
+func (s *Server) Addr() net.Addr {
+	return s.listeners[0].Addr()
+}
+
+// Close stops accepting connections and cancels the contexts of the
+// requests being served, without waiting for them.
 func (s *Server) Close() error {
-	s.isClosed.Store(true)
-	return s.listener.Close()
+	err := s.closeListeners()
+	s.cancelStop()
+
+	return err
+}
+
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	if !s.isClosed.Swap(true) {
+		close(s.done)
+	}
+	s.mu.Unlock()
+
+	var errs []error
+	for _, listener := range s.listeners {
+		errs = append(errs, listener.Close())
+	}
+
+	return errors.Join(errs...)
 }
 
+// Shutdown stops accepting connections, then waits for the ones being
+// served to finish. If ctx is done first, the contexts of the requests
+// still being served are cancelled. HTTP/2 connections are sent GOAWAY and
+// closed once their open streams are done. Hijacked connections, such as
+// WebSockets, only end when the client closes them or their handler gives
+// up, so ctx should have a deadline.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.closeListeners()
+	defer s.cancelStop()
+
+	done := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Listen accepts connections on every listener, each in its own goroutine,
+// until the server is closed.
 func (s *Server) Listen() {
+	if s.MaxConns > 0 {
+		s.slots = make(chan struct{}, s.MaxConns)
+	}
+
+	var wg sync.WaitGroup
+	for _, listener := range s.listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.accept(listener)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *Server) accept(listener net.Listener) {
+	var backoff time.Duration
+
 	for {
-		conn, err := s.listener.Accept()
+		// Connections over the limit are left waiting in the listen
+		// backlog until one of ours finishes.
+		held := false
+		if s.slots != nil && s.ConnLimitMode == ConnLimitBlock {
+			select {
+			case s.slots <- struct{}{}:
+				held = true
+			case <-s.done:
+				return
+			}
+		}
+
+		conn, err := listener.Accept()
 		// Check if the server is closed. There are instances where the server
 		// unexpectedly shuts down after accepting a connection.
 		if err != nil {
-			if s.isClosed.Load() {
+			if held {
+				s.releaseSlot()
+			}
+
+			if s.isClosed.Load() || errors.Is(err, net.ErrClosed) {
 				log.Printf("server closed, stopped listening: %v", err)
 				return
-			} else {
-				log.Printf("error accepting connection: %v", err)
+			}
+
+			// Errors such as running out of file descriptors last a while,
+			// so don't spin on them.
+			backoff = min(max(2*backoff, minAcceptBackoff), maxAcceptBackoff)
+			log.Printf("error accepting connection, retrying in %v: %v", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-s.done:
+				return
+			}
+			continue
+		}
+		backoff = 0
+
+		s.mu.Lock()
+		if s.isClosed.Load() {
+			s.mu.Unlock()
+			if held {
+				s.releaseSlot()
+			}
+			conn.Close()
+			continue
+		}
+		s.conns.Add(1)
+		s.mu.Unlock()
+
+		if s.slots != nil && !held {
+			select {
+			case s.slots <- struct{}{}:
+			default:
+				go func() {
+					defer s.conns.Done()
+					s.reject(conn)
+				}()
 				continue
 			}
 		}
-		go s.Handle(conn)
+
+		go func() {
+			defer s.conns.Done()
+			defer s.releaseSlot()
+			s.Handle(conn)
+		}()
 	}
 }
 
 func (s *Server) Handle(conn net.Conn) {
-	defer conn.Close()
+	s.setState(conn, StateNew)
+
+	// Requests on conn get a context that's cancelled once the client goes
+	// away or the server stops, or at the latest when we're done with conn.
+	base := s.BaseContext
+	if base == nil {
+		base = context.Background()
+	}
+	ctx, cancel := context.WithCancel(base)
+	defer cancel()
+	stop := context.AfterFunc(s.stopCtx, cancel)
+	defer stop()
+
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		var err error
+		tlsState, err = handshake(tlsConn)
+		if err != nil {
+			log.Printf("TLS handshake failed: %v", err)
+			conn.Close()
+			s.setState(conn, StateClosed)
+			return
+		}
+	}
+
+	br := bufioReaderPool.Get().(*bufio.Reader)
+	br.Reset(conn)
+	defer func() {
+		br.Reset(nil)
+		bufioReaderPool.Put(br)
+	}()
 
 	w := response.NewWriter(conn)
+	w.SetReader(br)
+	// Anything the handler left in the buffer is flushed once it returns.
+	// Hijacked conns are left alone, they're the handler's to close.
+	handlerHijacked := false
+	defer func() {
+		if err := w.Finish(); err != nil {
+			log.Printf("failed to flush response to conn: %v", err)
+		}
 
-	parsedReq, err := request.RequestFromReader(conn)
+		if !w.Hijacked() {
+			conn.Close()
+		}
+		if !handlerHijacked {
+			s.setState(conn, StateClosed)
+		}
+	}()
+
+	if _, err := br.Peek(1); err == nil {
+		s.setState(conn, StateActive)
+	}
+
+	// Cleartext clients may speak HTTP/2 right away, having been told
+	// elsewhere that we do.
+	if tlsState == nil && hasH2Preface(br) {
+		s.serveH2(ctx, conn, br, nil, nil)
+		return
+	}
+
+	parsedReq, err := request.RequestHeadersFromReader(br)
 	if err != nil {
 		handlerError := &HandlerError{
 			StatusCode: response.StatusBadRequest,
@@ -108,5 +354,73 @@ func (s *Server) Handle(conn net.Conn) {
 		return
 	}
 
+	parsedReq.RemoteAddr = remoteAddr(conn)
+	parsedReq.TLS = tlsState
+	parsedReq.SetContext(ctx)
+
+	switch expect := parsedReq.Headers.Get("expect"); {
+	case parsedReq.ExpectsContinue():
+		// The client holds the body back until we tell it to go ahead, so
+		// leave it to the handler to read it. That way the handler can
+		// reject the request, e.g. with 413 or 417, without ever
+		// receiving the body. A handler that has answered already may
+		// still read the body, with no 100 to send. Refer to RFC 9110
+		// 10.1.1.
+		parsedReq.SetBeforeBodyRead(func() error {
+			if w.StatusLineWritten() {
+				return nil
+			}
+			return w.WriteContinue()
+		})
+	case expect != "" && !strings.EqualFold(expect, "100-continue"):
+		handlerError := &HandlerError{
+			StatusCode: response.StatusExpectationFailed,
+			Message:    fmt.Sprintf("unsupported expectation: %v", expect),
+		}
+		handlerError.Write(&w)
+		return
+	default:
+		_, err = parsedReq.ReadBody()
+		if err != nil {
+			handlerError := &HandlerError{
+				StatusCode: response.StatusBadRequest,
+				Message:    err.Error(),
+			}
+			handlerError.Write(&w)
+			return
+		}
+	}
+
+	if settings, ok := h2cUpgradeSettings(parsedReq); ok && tlsState == nil && parsedReq.State == request.DONE {
+		s.upgradeH2C(ctx, &w, parsedReq, settings)
+		return
+	}
+
+	// With the whole request read, the client has nothing more to send
+	// until it gets the response, unless it goes away. Requests whose body
+	// is left to the handler can't be watched, as the handler reads from
+	// the same conn.
+	stopWatching := func() {}
+	if parsedReq.State == request.DONE {
+		stopWatching = watchConn(conn, br, cancel)
+		defer stopWatching()
+	}
+	w.SetBeforeHijack(func() {
+		stopWatching()
+		handlerHijacked = true
+		s.setState(conn, StateHijacked)
+	})
+
 	s.handler(&w, parsedReq)
 }
+
+// remoteAddr returns the address of the client on conn. Clients on Unix
+// domain sockets usually have none.
+func remoteAddr(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+
+	return addr.String()
+}
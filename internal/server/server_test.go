@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/conntest"
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		close(started)
+		<-release
+
+		w.WriteStatusLine(response.StatusOK)
+		h := headers.NewHeaders()
+		h.Set("Content-Length", "0")
+		w.WriteHeaders(h)
+	})
+	require.NoError(t, err)
+	addr := s.Addr().String()
+
+	done := make(chan *http.Response)
+	go func() {
+		resp, err := http.Get("http://" + addr)
+		assert.NoError(t, err)
+		done <- resp
+	}()
+	<-started
+
+	// Test: in-flight requests hold up shutdown until ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+
+	// Test: no new connections are accepted
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+
+	// Test: in-flight requests are answered, then shutdown completes
+	close(release)
+	resp := <-done
+	require.NotNil(t, resp)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.Shutdown(ctx)
+	assert.NoError(t, ctx.Err())
+}
+
+func TestExpectContinue(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		// The handler may answer before reading the body.
+		early := req.RequestLine.RequestTarget == "/early"
+		if early {
+			w.WriteStatusLine(response.StatusOK)
+		}
+
+		body, err := req.ReadBody()
+		if err != nil {
+			body = []byte(err.Error())
+		}
+
+		if !early {
+			w.WriteStatusLine(response.StatusOK)
+		}
+		h := headers.NewHeaders()
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeaders(h)
+		w.WriteBody(body)
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	send := func(target string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		_, err = io.WriteString(conn, "POST "+target+" HTTP/1.1\r\n"+
+			"Host: localhost\r\n"+
+			"Content-Length: 5\r\n"+
+			"Expect: 100-continue\r\n"+
+			"\r\n")
+		require.NoError(t, err)
+		return conn, bufio.NewReader(conn)
+	}
+
+	// Test: the client is told to go ahead once the body is read
+	conn, br := send("/upload")
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n", line)
+	line, err = br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n", line)
+
+	_, err = io.WriteString(conn, "hello")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "hello", conntest.ReadBody(t, resp.Body))
+
+	// Test: after the final status line, the body is read without a 100,
+	// as clients send it anyway after a while
+	conn, br = send("/early")
+	_, err = io.WriteString(conn, "hello")
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "hello", conntest.ReadBody(t, resp.Body))
+}
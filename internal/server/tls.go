@@ -0,0 +1,237 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Limit on the time a client has to complete the TLS handshake.
+const handshakeTimeout = 10 * time.Second
+
+// How often Watch checks the certificate files for changes.
+const DefaultWatchInterval = 5 * time.Second
+
+// CertFiles names a certificate chain and its private key, both PEM encoded.
+type CertFiles struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Certificates holds the certificates served over TLS. They are picked by
+// the server name the client asks for (SNI), and can be reloaded from their
+// files at any time. Connections already established keep the certificate
+// they were handshaken with, new ones get the reloaded ones.
+type Certificates struct {
+	files []CertFiles
+
+	mu    sync.RWMutex
+	certs []*tls.Certificate
+	// Certificates by the lowercase names they are valid for, including
+	// wildcard names such as "*.example.com".
+	byName map[string]*tls.Certificate
+	// Modification times of the files as of the last load.
+	modTimes map[string]time.Time
+}
+
+// LoadCertificates loads the given certificates. The first one is served to
+// clients that don't send a server name or ask for one none of the
+// certificates is valid for.
+func LoadCertificates(files ...CertFiles) (*Certificates, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no certificates given")
+	}
+
+	c := &Certificates{files: files}
+
+	err := c.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Reload reads the certificate files again. If any of them fails to load,
+// the certificates in use are kept.
+func (c *Certificates) Reload() error {
+	certs := make([]*tls.Certificate, 0, len(c.files))
+	byName := make(map[string]*tls.Certificate)
+	modTimes := make(map[string]time.Time)
+
+	for _, f := range c.files {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate %v: %w", f.CertFile, err)
+		}
+
+		for _, name := range certNames(cert.Leaf) {
+			// Earlier certificates take precedence.
+			if _, ok := byName[name]; !ok {
+				byName[name] = &cert
+			}
+		}
+		certs = append(certs, &cert)
+
+		for _, path := range []string{f.CertFile, f.KeyFile} {
+			if info, err := os.Stat(path); err == nil {
+				modTimes[path] = info.ModTime()
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.certs = certs
+	c.byName = byName
+	c.modTimes = modTimes
+	c.mu.Unlock()
+
+	return nil
+}
+
+// certNames returns the lowercase names leaf is valid for.
+func certNames(leaf *x509.Certificate) []string {
+	if leaf == nil {
+		return nil
+	}
+
+	names := leaf.DNSNames
+	// The common name only counts for certificates without SANs.
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+
+	lower := make([]string, len(names))
+	for i, name := range names {
+		lower[i] = strings.ToLower(name)
+	}
+
+	return lower
+}
+
+// GetCertificate picks the certificate for the server name in hello. It is
+// meant for tls.Config.GetCertificate.
+func (c *Certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		if cert, ok := c.byName[name]; ok {
+			return cert, nil
+		}
+
+		// A wildcard only stands for the leftmost label.
+		if _, parent, ok := strings.Cut(name, "."); ok {
+			if cert, ok := c.byName["*."+parent]; ok {
+				return cert, nil
+			}
+		}
+	}
+
+	return c.certs[0], nil
+}
+
+// TLSConfig returns a config serving the certificates.
+func (c *Certificates) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: c.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// changed reports whether any of the files was modified since the last load.
+func (c *Certificates) changed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, f := range c.files {
+		for _, path := range []string{f.CertFile, f.KeyFile} {
+			info, err := os.Stat(path)
+			if err != nil {
+				// The file may be in the middle of being replaced.
+				continue
+			}
+
+			if !info.ModTime().Equal(c.modTimes[path]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Watch reloads the certificates on SIGHUP and whenever their files change,
+// checking them every interval. Calling the returned function stops it.
+func (c *Certificates) Watch(interval time.Duration) func() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-sigChan:
+			case <-ticker.C:
+				if !c.changed() {
+					continue
+				}
+			case <-done:
+				return
+			}
+
+			err := c.Reload()
+			if err != nil {
+				log.Printf("failed to reload certificates: %v", err)
+				continue
+			}
+			log.Println("certificates reloaded")
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(sigChan)
+			ticker.Stop()
+			close(done)
+		})
+	}
+}
+
+// ServeTLS is Serve over TLS, configured by config.
+func ServeTLS(port int, handler Handler, config *tls.Config) (*Server, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("error at port %d: %w", port, err)
+	}
+
+	return ServeListener(tls.NewListener(listener, config), handler), nil
+}
+
+// handshake completes the TLS handshake of conn, so that its state is known
+// before the request is read.
+func handshake(conn *tls.Conn) (*tls.ConnectionState, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	err := conn.Handshake()
+	if err != nil {
+		return nil, err
+	}
+
+	state := conn.ConnectionState()
+	return &state, nil
+}
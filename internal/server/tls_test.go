@@ -0,0 +1,220 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCert generates a self-signed certificate for names into dir, and
+// returns its files along with a pool trusting it.
+func writeCert(t *testing.T, dir, prefix string, names ...string) (CertFiles, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	files := CertFiles{
+		CertFile: filepath.Join(dir, prefix+".crt"),
+		KeyFile:  filepath.Join(dir, prefix+".key"),
+	}
+	require.NoError(t, os.WriteFile(files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return files, pool
+}
+
+// tlsRequest sends a request over a new TLS conn to s, configured by config.
+func tlsRequest(t *testing.T, s *Server, config *tls.Config) (*http.Response, *tls.Conn, error) {
+	t.Helper()
+
+	conn, err := tls.Dial("tcp", s.Addr().String(), config)
+	if err != nil {
+		return nil, nil, err
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	_, err = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %v\r\n\r\n", config.ServerName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resp, conn, nil
+}
+
+// tlsGet sends a request over a new TLS conn to s and returns the response
+// along with the certificate the server presented.
+func tlsGet(t *testing.T, s *Server, serverName string, pool *x509.CertPool) (*http.Response, *x509.Certificate) {
+	t.Helper()
+
+	resp, conn, err := tlsRequest(t, s, &tls.Config{
+		ServerName: serverName,
+		RootCAs:    pool,
+	})
+	require.NoError(t, err)
+
+	return resp, conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	first, firstPool := writeCert(t, dir, "first", "a.example.com")
+	second, secondPool := writeCert(t, dir, "second", "*.b.example.com")
+
+	certs, err := LoadCertificates(first, second)
+	require.NoError(t, err)
+
+	s, err := ServeTLS(0, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+
+		h := headers.NewHeaders()
+		if req.TLS != nil {
+			h.Set("X-Server-Name", req.TLS.ServerName)
+			h.Set("X-Tls-Version", tls.VersionName(req.TLS.Version))
+		}
+		h.Set("Content-Length", "0")
+		w.WriteHeaders(h)
+	}, certs.TLSConfig())
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: the TLS state is exposed to the handler
+	resp, cert := tlsGet(t, s, "a.example.com", firstPool)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "a.example.com", resp.Header.Get("X-Server-Name"))
+	assert.Equal(t, "TLS 1.3", resp.Header.Get("X-Tls-Version"))
+	assert.Equal(t, []string{"a.example.com"}, cert.DNSNames)
+
+	// Test: certificates are picked by server name, including wildcards
+	_, cert = tlsGet(t, s, "www.b.example.com", secondPool)
+	assert.Equal(t, []string{"*.b.example.com"}, cert.DNSNames)
+
+	_, cert = tlsGet(t, s, "WWW.B.EXAMPLE.COM", secondPool)
+	assert.Equal(t, []string{"*.b.example.com"}, cert.DNSNames)
+
+	// Test: unknown names get the first certificate
+	conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{
+		ServerName:         "unknown.example.com",
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.example.com"}, conn.ConnectionState().PeerCertificates[0].DNSNames)
+	conn.Close()
+
+	// Test: reloading doesn't drop established conns
+	established, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{
+		ServerName: "a.example.com",
+		RootCAs:    firstPool,
+	})
+	require.NoError(t, err)
+	defer established.Close()
+
+	_, reloadedPool := writeCert(t, dir, "first", "a.example.com")
+	require.NoError(t, certs.Reload())
+
+	_, err = fmt.Fprint(established, "GET / HTTP/1.1\r\nHost: a.example.com\r\n\r\n")
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(bufio.NewReader(established), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Test: new conns get the reloaded certificate
+	resp, _ = tlsGet(t, s, "a.example.com", reloadedPool)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Test: a failed reload keeps the certificates in use
+	require.NoError(t, os.WriteFile(first.KeyFile, []byte("not a key"), 0o600))
+	assert.Error(t, certs.Reload())
+	resp, _ = tlsGet(t, s, "a.example.com", reloadedPool)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Test: at least one certificate is required
+	_, err = LoadCertificates()
+	assert.Error(t, err)
+}
+
+func TestCertificatesWatch(t *testing.T) {
+	dir := t.TempDir()
+	files, _ := writeCert(t, dir, "cert", "a.example.com")
+
+	certs, err := LoadCertificates(files)
+	require.NoError(t, err)
+	loaded, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+	require.NoError(t, err)
+
+	reloaded := func() bool {
+		cert, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+		if err != nil || cert == loaded {
+			return false
+		}
+
+		loaded = cert
+		return true
+	}
+
+	// Test: changed files are reloaded
+	stop := certs.Watch(10 * time.Millisecond)
+
+	writeCert(t, dir, "cert", "a.example.com")
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(files.CertFile, later, later))
+
+	assert.Eventually(t, reloaded, time.Second, 10*time.Millisecond)
+	stop()
+
+	// Test: SIGHUP reloads the certificates
+	stop = certs.Watch(time.Hour)
+	defer stop()
+
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	assert.Eventually(t, reloaded, time.Second, 10*time.Millisecond)
+}
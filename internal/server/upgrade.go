@@ -0,0 +1,144 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The pid of the process that started us with Upgrade. Go can't know the pid
+// of a child before starting it, so unlike systemd, Upgrade can't set
+// LISTEN_PID. The child checks this against its parent instead.
+const upgradePIDEnv = "UPGRADE_PID"
+
+// Upgrade starts a new instance of the running binary, with the same
+// arguments, and hands it listeners. The new instance picks them up with
+// InheritedListeners and calls UpgradeReady once it's serving, which
+// signals us with SIGTERM to drain our own connections and exit. Until
+// then both instances accept connections on the same sockets, so none are
+// refused. If the new instance fails to start, we carry on serving.
+//
+// Listeners must be the ones from Listen, ListenUnix or InheritedListeners,
+// not wrapped, e.g. by tls.NewListener. Unix domain sockets are no longer
+// removed on close, as the new instance is still using them.
+func Upgrade(listeners []net.Listener) (*os.Process, error) {
+	return upgrade(listeners, os.Args[1:])
+}
+
+func upgrade(listeners []net.Listener, args []string) (*os.Process, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find executable: %w", err)
+	}
+
+	files := make([]*os.File, 0, len(listeners))
+	names := make([]string, 0, len(listeners))
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	for _, listener := range listeners {
+		l, ok := listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("failed to hand over %v: %T has no file descriptor", listener.Addr(), listener)
+		}
+
+		file, err := l.File()
+		if err != nil {
+			return nil, fmt.Errorf("failed to hand over %v: %w", listener.Addr(), err)
+		}
+		files = append(files, file)
+		// Names can't contain colons, which separate them.
+		names = append(names, strings.ReplaceAll(listener.Addr().String(), ":", "_"))
+	}
+
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		upgradePIDEnv+"="+strconv.Itoa(os.Getpid()),
+	)
+
+	err = cmd.Start()
+	// Passing the files on puts the sockets in blocking mode, for us as well
+	// as for the child as they're the same sockets. Blocking accepts can't be
+	// interrupted by closing the listener, so switch back right away.
+	for _, listener := range listeners {
+		setNonblock(listener)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to start %v: %w", executable, err)
+	}
+
+	for _, listener := range listeners {
+		if l, ok := listener.(*net.UnixListener); ok {
+			l.SetUnlinkOnClose(false)
+		}
+	}
+
+	go func() {
+		err := cmd.Wait()
+		log.Printf("upgraded process %d exited: %v", cmd.Process.Pid, err)
+	}()
+
+	return cmd.Process, nil
+}
+
+func setNonblock(listener net.Listener) {
+	sc, ok := listener.(syscall.Conn)
+	if !ok {
+		return
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	rc.Control(func(fd uintptr) {
+		syscall.SetNonblock(int(fd), true)
+	})
+}
+
+// upgradedFrom returns the pid of our parent if it started us with Upgrade.
+func upgradedFrom() (int, bool) {
+	pid, err := strconv.Atoi(os.Getenv(upgradePIDEnv))
+	if err != nil || pid != os.Getppid() {
+		return 0, false
+	}
+
+	return pid, true
+}
+
+// UpgradeReady tells the process that started us with Upgrade that we're
+// serving, so it can drain its connections and exit. It does nothing if we
+// weren't started by Upgrade.
+func UpgradeReady() error {
+	pid, ok := upgradedFrom()
+	os.Unsetenv(upgradePIDEnv)
+	if !ok {
+		return nil
+	}
+
+	parent, err := os.FindProcess(pid)
+	if err != nil {
+		return fmt.Errorf("failed to find parent process %d: %w", pid, err)
+	}
+
+	err = parent.Signal(syscall.SIGTERM)
+	if err != nil {
+		return fmt.Errorf("failed to signal parent process %d: %w", pid, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/conntest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpgrade(t *testing.T) {
+	// Run as the new process started below.
+	if os.Getenv("TEST_UPGRADE") == "1" {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGTERM)
+
+		listeners, err := InheritedListeners()
+		if err != nil || len(listeners) != 2 {
+			fmt.Println("failed:", len(listeners), err)
+			os.Exit(1)
+		}
+		for _, listener := range listeners {
+			s := ServeListener(listener, pidHandler)
+			defer s.Close()
+		}
+
+		err = UpgradeReady()
+		if err != nil {
+			fmt.Println("failed:", err)
+			os.Exit(1)
+		}
+
+		<-sigChan
+		return
+	}
+
+	// Test: not started by Upgrade
+	assert.NoError(t, UpgradeReady())
+
+	// Test: the new process takes over the sockets and tells us to stop
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+
+	path := t.TempDir() + "/http.sock"
+	tcpListener, err := Listen("127.0.0.1:0", 0)
+	require.NoError(t, err)
+	unixListener, err := Listen("unix:"+path, 0)
+	require.NoError(t, err)
+	listeners := []net.Listener{tcpListener, unixListener}
+
+	var servers []*Server
+	for _, listener := range listeners {
+		servers = append(servers, ServeListener(listener, pidHandler))
+	}
+	resp := getVia(t, func() (net.Conn, error) { return net.Dial("unix", path) })
+	assert.Equal(t, strconv.Itoa(os.Getpid()), conntest.ReadBody(t, resp.Body))
+
+	t.Setenv("TEST_UPGRADE", "1")
+	process, err := upgrade(listeners, []string{"-test.run=^TestUpgrade$"})
+	require.NoError(t, err)
+	defer process.Signal(syscall.SIGTERM)
+
+	select {
+	case <-sigChan:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the new process never became ready")
+	}
+
+	for _, s := range servers {
+		s.Close()
+	}
+
+	// Test: the unix socket is left for the new process
+	resp = getVia(t, func() (net.Conn, error) { return net.Dial("unix", path) })
+	assert.Equal(t, strconv.Itoa(process.Pid), conntest.ReadBody(t, resp.Body))
+
+	resp = getVia(t, func() (net.Conn, error) { return net.Dial("tcp", tcpListener.Addr().String()) })
+	assert.Equal(t, strconv.Itoa(process.Pid), conntest.ReadBody(t, resp.Body))
+}
@@ -0,0 +1,254 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+)
+
+// Event is a single message sent to the client. Refer to the HTML Living
+// Standard 9.2 Server-sent events.
+type Event struct {
+	// ID sets the client's last event ID, which it sends back in the
+	// Last-Event-ID header when reconnecting.
+	ID string
+	// Event is the event type. Clients dispatch untyped events as "message".
+	Event string
+	// Data is the payload. Multi-line data is split into several data lines.
+	Data string
+	// Retry tells the client how long to wait before reconnecting.
+	Retry time.Duration
+}
+
+var ErrStreamClosed = errors.New("event stream closed")
+
+// Stream writes server-sent events to a client over a chunked response.
+type Stream struct {
+	w           *response.Writer
+	lastEventID string
+
+	mu     sync.Mutex
+	closed bool
+	err    error
+
+	done      chan struct{}
+	closeDone sync.Once
+	// Stops watching the request's context.
+	stopWatching func() bool
+}
+
+// NewStream writes the status line and headers of an event stream response.
+// The handler must call Close before returning.
+func NewStream(w *response.Writer, req *request.Request) (*Stream, error) {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Transfer-Encoding", "chunked")
+
+	err := w.WriteStatusLine(response.StatusOK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write status line to conn: %v", err)
+	}
+
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write headers to conn: %v", err)
+	}
+
+	// Let the client know the stream is open right away rather than when the
+	// first event is sent.
+	err = w.Flush()
+	if err != nil {
+		return nil, fmt.Errorf("failed to flush headers: %v", err)
+	}
+
+	s := &Stream{
+		w:           w,
+		lastEventID: req.Headers.Get("last-event-id"),
+		done:        make(chan struct{}),
+	}
+
+	// The server cancels the request's context once the client goes away,
+	// which on an idle stream is long before a write fails.
+	s.stopWatching = context.AfterFunc(req.Context(), s.finish)
+
+	return s, nil
+}
+
+// LastEventID returns the ID of the last event the client received before
+// reconnecting, so that the handler can resume the stream from there. It is
+// empty on the first connection.
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed once the stream is closed, either by the handler or because
+// the client went away, or once the request's context is done.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the write error that ended the stream, if any.
+func (s *Stream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// Send writes the event and flushes it to the client.
+func (s *Stream) Send(e Event) error {
+	frame, err := formatEvent(e)
+	if err != nil {
+		return err
+	}
+
+	return s.write(frame)
+}
+
+// Comment writes a comment line, which clients ignore. It is mostly useful
+// to keep idle connections from being dropped by proxies.
+func (s *Stream) Comment(text string) error {
+	var frame strings.Builder
+
+	for _, line := range splitLines(text) {
+		frame.WriteString(": " + line + "\n")
+	}
+	frame.WriteString("\n")
+
+	return s.write(frame.String())
+}
+
+// KeepAlive sends a comment every interval until the stream is done. Writing
+// to a client that went away fails, which is how we notice disconnects on
+// otherwise idle streams.
+func (s *Stream) KeepAlive(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				s.Comment("keep-alive")
+			}
+		}
+	}()
+}
+
+// Close ends the event stream. It is safe to call more than once.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.stopWatching()
+	s.finish()
+
+	// The client is gone, there is no one to end the body for.
+	if s.err != nil {
+		return nil
+	}
+
+	_, err := s.w.WriteChunkedBodyDone()
+	if err != nil {
+		return err
+	}
+
+	err = s.w.WriteTrailers(headers.NewHeaders())
+	if err != nil {
+		return err
+	}
+
+	return s.w.Flush()
+}
+
+func (s *Stream) write(frame string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		if s.err != nil {
+			return s.err
+		}
+		return ErrStreamClosed
+	}
+
+	_, err := s.w.WriteChunkedBody([]byte(frame))
+	if err == nil {
+		err = s.w.Flush()
+	}
+
+	if err != nil {
+		// Most likely the client disconnected. Either way the stream can't
+		// be used anymore.
+		s.err = fmt.Errorf("failed to write event: %w", err)
+		s.closed = true
+		s.stopWatching()
+		s.finish()
+		return s.err
+	}
+
+	return nil
+}
+
+// finish closes the Done channel.
+func (s *Stream) finish() {
+	s.closeDone.Do(func() {
+		close(s.done)
+	})
+}
+
+func formatEvent(e Event) (string, error) {
+	if strings.ContainsAny(e.ID, "\r\n\x00") {
+		return "", errors.New("invalid event: id must not contain newlines or NUL")
+	}
+
+	if strings.ContainsAny(e.Event, "\r\n") {
+		return "", errors.New("invalid event: event type must not contain newlines")
+	}
+
+	var frame strings.Builder
+
+	if e.Event != "" {
+		frame.WriteString("event: " + e.Event + "\n")
+	}
+
+	if e.ID != "" {
+		frame.WriteString("id: " + e.ID + "\n")
+	}
+
+	if e.Retry > 0 {
+		frame.WriteString(fmt.Sprintf("retry: %d\n", e.Retry.Milliseconds()))
+	}
+
+	for _, line := range splitLines(e.Data) {
+		frame.WriteString("data: " + line + "\n")
+	}
+
+	// A blank line dispatches the event.
+	frame.WriteString("\n")
+
+	return frame.String(), nil
+}
+
+// splitLines splits on any of the line endings the event stream format
+// accepts.
+func splitLines(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+
+	return strings.Split(s, "\n")
+}
@@ -0,0 +1,140 @@
+package sse
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+	"github.com/johndosdos/http-from-tcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatEvent(t *testing.T) {
+	// Test: data only
+	frame, err := formatEvent(Event{Data: "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, "data: hello\n\n", frame)
+
+	// Test: all fields
+	frame, err = formatEvent(Event{ID: "42", Event: "progress", Data: "50%", Retry: 3 * time.Second})
+	require.NoError(t, err)
+	assert.Equal(t, "event: progress\nid: 42\nretry: 3000\ndata: 50%\n\n", frame)
+
+	// Test: multi-line data
+	frame, err = formatEvent(Event{Data: "line one\nline two\r\nline three"})
+	require.NoError(t, err)
+	assert.Equal(t, "data: line one\ndata: line two\ndata: line three\n\n", frame)
+
+	// Test: invalid id
+	_, err = formatEvent(Event{ID: "4\n2"})
+	require.Error(t, err)
+}
+
+func TestStream(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	req := &request.Request{
+		Headers: headers.Headers{"last-event-id": "Event-7"},
+	}
+
+	// Failures are reported back here, FailNow only works on the test
+	// goroutine.
+	type result struct {
+		stream *Stream
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		w := response.NewWriter(serverConn)
+		stream, err := NewStream(&w, req)
+		if err != nil {
+			// Don't leave the client waiting for the response.
+			serverConn.Close()
+		}
+		results <- result{stream, err}
+	}()
+
+	reader := bufio.NewReader(clientConn)
+	resp, respErr := http.ReadResponse(reader, nil)
+
+	r := <-results
+	require.NoError(t, r.err)
+	require.NoError(t, respErr)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	stream := r.stream
+	assert.Equal(t, "Event-7", stream.LastEventID())
+
+	// Test: events are flushed as they are sent
+	sent := make(chan error, 1)
+	go func() {
+		sent <- stream.Send(Event{ID: "Event-8", Data: "hello"})
+	}()
+	buffer := make([]byte, 64)
+	n, err := resp.Body.Read(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "id: Event-8\ndata: hello\n\n", string(buffer[:n]))
+	require.NoError(t, <-sent)
+
+	// Test: a failed write ends the stream
+	clientConn.Close()
+	err = stream.Send(Event{Data: "anyone there?"})
+	require.Error(t, err)
+	select {
+	case <-stream.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stream not done after client disconnected")
+	}
+	require.NoError(t, stream.Close())
+}
+
+func TestStreamClientGone(t *testing.T) {
+	// The handler reports back here once the stream is done.
+	results := make(chan error, 1)
+	s, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		stream, err := NewStream(w, req)
+		if err != nil {
+			results <- err
+			return
+		}
+		defer stream.Close()
+
+		select {
+		case <-stream.Done():
+			results <- nil
+		case <-time.After(5 * time.Second):
+			results <- errors.New("stream not done after the client went away")
+		}
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, "GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// Test: the stream is done as soon as the client goes away, with no
+	// write having to fail first
+	conn.Close()
+	select {
+	case err := <-results:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("stream not done after the client went away")
+	}
+}
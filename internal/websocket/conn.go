@@ -0,0 +1,411 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Message types, the same as the opcodes of the frames that carry them.
+const (
+	TextMessage   = opText
+	BinaryMessage = opBinary
+	CloseMessage  = opClose
+	PingMessage   = opPing
+	PongMessage   = opPong
+)
+
+// Close status codes. Refer to RFC 6455 7.4.1.
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005
+	CloseAbnormalClosure         = 1006
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseInternalServerErr       = 1011
+)
+
+// Default limit on the size of a message assembled from its frames.
+const DefaultMaxMessageSize int64 = 1 << 20
+
+// How long Close waits for the peer to answer our Close frame.
+const closeTimeout = 5 * time.Second
+
+var ErrCloseSent = errors.New("websocket: close frame has already been sent")
+
+// CloseError is returned by ReadMessage once the peer has closed the
+// connection.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: connection closed: %d %s", e.Code, e.Text)
+}
+
+// ProtocolError is returned by ReadMessage when the peer breaks the
+// protocol. The connection is closed with Code before it is returned.
+type ProtocolError struct {
+	Code    int
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("websocket: %s", e.Message)
+}
+
+func newProtocolError(message string) error {
+	return &ProtocolError{
+		Code:    CloseProtocolError,
+		Message: message,
+	}
+}
+
+// Conn is the server side of a WebSocket connection.
+//
+// One goroutine may read while others write. Writes are serialized, so
+// control frames can be sent from any goroutine.
+type Conn struct {
+	// MaxMessageSize is the largest message ReadMessage accepts. Bigger
+	// messages close the connection with CloseMessageTooBig.
+	MaxMessageSize int64
+
+	conn net.Conn
+	br   *bufio.Reader
+
+	readMu  sync.Mutex
+	readErr error
+
+	writeMu   sync.Mutex
+	bw        *bufio.Writer
+	closeSent bool
+}
+
+func newConn(conn net.Conn, br *bufio.Reader) *Conn {
+	return &Conn{
+		MaxMessageSize: DefaultMaxMessageSize,
+		conn:           conn,
+		br:             br,
+		bw:             bufio.NewWriter(conn),
+	}
+}
+
+// ReadMessage reads the next text or binary message, reassembling fragmented
+// messages. Pings are answered and pongs dropped along the way.
+//
+// Once the peer closes the connection a *CloseError is returned, after our
+// side of the closing handshake has been sent and the conn closed.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+
+	messageType, message, err := c.readMessage()
+	if err != nil {
+		c.readErr = err
+		c.fail(err)
+		return 0, nil, err
+	}
+
+	return messageType, message, nil
+}
+
+func (c *Conn) readMessage() (int, []byte, error) {
+	messageType := 0
+	var message []byte
+
+	for {
+		fh, err := readFrameHeader(c.br)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		// Refer to RFC 6455 5.1
+		if !fh.masked {
+			return 0, nil, newProtocolError("client frames must be masked")
+		}
+
+		if isControl(fh.opcode) {
+			payload, err := c.readPayload(fh)
+			if err != nil {
+				return 0, nil, err
+			}
+
+			err = c.handleControl(fh.opcode, payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		switch fh.opcode {
+		case opText, opBinary:
+			if messageType != 0 {
+				return 0, nil, newProtocolError("new message started before the previous one finished")
+			}
+			messageType = int(fh.opcode)
+		case opContinuation:
+			if messageType == 0 {
+				return 0, nil, newProtocolError("continuation frame without a message to continue")
+			}
+		}
+
+		if int64(len(message))+fh.length > c.MaxMessageSize {
+			return 0, nil, &ProtocolError{
+				Code:    CloseMessageTooBig,
+				Message: fmt.Sprintf("message exceeds %d bytes", c.MaxMessageSize),
+			}
+		}
+
+		payload, err := c.readPayload(fh)
+		if err != nil {
+			return 0, nil, err
+		}
+		message = append(message, payload...)
+
+		if !fh.fin {
+			continue
+		}
+
+		if messageType == TextMessage && !utf8.Valid(message) {
+			return 0, nil, &ProtocolError{
+				Code:    CloseInvalidFramePayloadData,
+				Message: "invalid UTF-8 in text message",
+			}
+		}
+
+		return messageType, message, nil
+	}
+}
+
+func (c *Conn) readPayload(fh frameHeader) ([]byte, error) {
+	payload := make([]byte, fh.length)
+
+	_, err := io.ReadFull(c.br, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if fh.masked {
+		maskBytes(fh.mask, 0, payload)
+	}
+
+	return payload, nil
+}
+
+func (c *Conn) handleControl(opcode byte, payload []byte) error {
+	switch opcode {
+	case opPing:
+		// A closing conn doesn't need to answer pings.
+		err := c.WriteControl(PongMessage, payload)
+		if err != nil && !errors.Is(err, ErrCloseSent) {
+			return err
+		}
+	case opPong:
+		// Unsolicited pongs serve as heartbeats and need no answer.
+	case opClose:
+		closeErr, err := parseClosePayload(payload)
+		if err != nil {
+			return err
+		}
+
+		// Echo the status code back, unless we started the handshake.
+		// Refer to RFC 6455 5.5.1.
+		code := closeErr.Code
+		if code == CloseNoStatusReceived {
+			code = 0
+		}
+		c.writeClose(code, "")
+
+		return closeErr
+	}
+
+	return nil
+}
+
+func parseClosePayload(payload []byte) (*CloseError, error) {
+	if len(payload) == 0 {
+		return &CloseError{Code: CloseNoStatusReceived}, nil
+	}
+
+	if len(payload) == 1 {
+		return nil, newProtocolError("invalid close frame payload")
+	}
+
+	code := int(binary.BigEndian.Uint16(payload[:2]))
+	if !isValidCloseCode(code) {
+		return nil, newProtocolError(fmt.Sprintf("invalid close code %d", code))
+	}
+
+	text := payload[2:]
+	if !utf8.Valid(text) {
+		return nil, &ProtocolError{
+			Code:    CloseInvalidFramePayloadData,
+			Message: "invalid UTF-8 in close reason",
+		}
+	}
+
+	return &CloseError{Code: code, Text: string(text)}, nil
+}
+
+// isValidCloseCode reports whether code may be sent in a Close frame. Codes
+// like 1005 and 1006 only exist for reporting and must never be sent.
+func isValidCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003,
+		code >= 1007 && code <= 1011,
+		code >= 3000 && code <= 4999:
+		return true
+	}
+
+	return false
+}
+
+// fail tears the connection down after a read error. Protocol violations are
+// reported to the peer first.
+func (c *Conn) fail(err error) {
+	var protocolErr *ProtocolError
+	if errors.As(err, &protocolErr) {
+		c.writeClose(protocolErr.Code, protocolErr.Message)
+	}
+
+	c.conn.Close()
+}
+
+// WriteMessage sends data as a single text or binary frame.
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("websocket: invalid message type %d", messageType)
+	}
+
+	return c.writeFrame(byte(messageType), data)
+}
+
+// WriteControl sends a ping or pong frame.
+func (c *Conn) WriteControl(messageType int, data []byte) error {
+	if messageType != PingMessage && messageType != PongMessage {
+		return fmt.Errorf("websocket: invalid control message type %d", messageType)
+	}
+
+	if len(data) > maxControlPayload {
+		return errors.New("websocket: control frame payload too long")
+	}
+
+	return c.writeFrame(byte(messageType), data)
+}
+
+// Ping sends a ping. The peer's pong is dropped by ReadMessage.
+func (c *Conn) Ping(data []byte) error {
+	return c.WriteControl(PingMessage, data)
+}
+
+func (c *Conn) writeFrame(opcode byte, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return ErrCloseSent
+	}
+
+	err := writeFrame(c.bw, true, opcode, nil, data)
+	if err != nil {
+		return err
+	}
+
+	return c.bw.Flush()
+}
+
+// writeClose sends a Close frame, unless one has been sent already. A zero
+// code sends a Close frame without a payload.
+func (c *Conn) writeClose(code int, reason string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	c.closeSent = true
+
+	var payload []byte
+	if code != 0 {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(code))
+
+		// Close frames are control frames, so the reason has to be short.
+		// It has to stay valid UTF-8 too, so don't cut a character in half.
+		if n := maxControlPayload - 2; len(reason) > n {
+			for n > 0 && !utf8.RuneStart(reason[n]) {
+				n--
+			}
+			reason = reason[:n]
+		}
+		payload = append(payload, reason...)
+	}
+
+	err := writeFrame(c.bw, true, opClose, nil, payload)
+	if err != nil {
+		return err
+	}
+
+	return c.bw.Flush()
+}
+
+// Close starts the closing handshake with the given status code and waits
+// for the peer to answer before closing the conn. If another goroutine is
+// blocked in ReadMessage, it receives the answer and Close just waits for it
+// to return.
+func (c *Conn) Close(code int, reason string) error {
+	if !isValidCloseCode(code) {
+		return fmt.Errorf("websocket: invalid close code %d", code)
+	}
+
+	err := c.writeClose(code, reason)
+	if err != nil && !errors.Is(err, ErrCloseSent) {
+		c.conn.Close()
+		return err
+	}
+
+	// Don't wait forever on a peer that never answers.
+	c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for c.readErr == nil {
+		_, _, err := c.readMessage()
+		if err != nil {
+			c.readErr = err
+		}
+	}
+
+	return c.conn.Close()
+}
+
+// SetReadDeadline sets the deadline for reading from the underlying conn,
+// which can be used to drop idle clients.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for writing to the underlying conn.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// RemoteAddr returns the address of the peer.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
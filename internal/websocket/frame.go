@@ -0,0 +1,183 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+/*
+	Base framing protocol, refer to RFC 6455 5.2
+
+	 0                   1                   2                   3
+	 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	+-+-+-+-+-------+-+-------------+-------------------------------+
+	|F|R|R|R| opcode|M| Payload len |    Extended payload length    |
+	|I|S|S|S|  (4)  |A|     (7)     |             (16/64)           |
+	|N|V|V|V|       |S|             |   (if payload len==126/127)   |
+	| |1|2|3|       |K|             |                               |
+	+-+-+-+-+-------+-+-------------+ - - - - - - - - - - - - - - - +
+	|     Extended payload length continued, if payload len == 127  |
+	+ - - - - - - - - - - - - - - - +-------------------------------+
+	|                               |Masking-key, if MASK set to 1  |
+	+-------------------------------+-------------------------------+
+	| Masking-key (continued)       |          Payload Data         |
+	+-------------------------------- - - - - - - - - - - - - - - - +
+*/
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+const (
+	finBit  = 0x80
+	rsvBits = 0x70
+	maskBit = 0x80
+)
+
+// Control frames can't carry more than this. Refer to RFC 6455 5.5.
+const maxControlPayload = 125
+
+type frameHeader struct {
+	fin    bool
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length int64
+}
+
+func isControl(opcode byte) bool {
+	return opcode&0x8 != 0
+}
+
+// readFrameHeader reads a frame header off the wire and checks the parts of
+// it that don't depend on connection state.
+func readFrameHeader(r io.Reader) (frameHeader, error) {
+	var fh frameHeader
+	buffer := make([]byte, 8)
+
+	_, err := io.ReadFull(r, buffer[:2])
+	if err != nil {
+		return fh, err
+	}
+
+	fh.fin = buffer[0]&finBit != 0
+	fh.opcode = buffer[0] & 0x0F
+	fh.masked = buffer[1]&maskBit != 0
+	length := int64(buffer[1] & 0x7F)
+
+	// We don't negotiate any extensions, so none of the reserved bits may be
+	// set.
+	if buffer[0]&rsvBits != 0 {
+		return fh, newProtocolError("reserved bits set")
+	}
+
+	switch fh.opcode {
+	case opContinuation, opText, opBinary, opClose, opPing, opPong:
+	default:
+		return fh, newProtocolError(fmt.Sprintf("unknown opcode %#x", fh.opcode))
+	}
+
+	switch length {
+	case 126:
+		_, err = io.ReadFull(r, buffer[:2])
+		if err != nil {
+			return fh, err
+		}
+		length = int64(binary.BigEndian.Uint16(buffer[:2]))
+	case 127:
+		_, err = io.ReadFull(r, buffer[:8])
+		if err != nil {
+			return fh, err
+		}
+
+		// The most significant bit must be 0.
+		n := binary.BigEndian.Uint64(buffer[:8])
+		if n>>63 != 0 {
+			return fh, newProtocolError("invalid payload length")
+		}
+		length = int64(n)
+	}
+	fh.length = length
+
+	if isControl(fh.opcode) {
+		if !fh.fin {
+			return fh, newProtocolError("fragmented control frame")
+		}
+
+		if fh.length > maxControlPayload {
+			return fh, newProtocolError("control frame payload too long")
+		}
+	}
+
+	if fh.masked {
+		_, err = io.ReadFull(r, fh.mask[:])
+		if err != nil {
+			return fh, err
+		}
+	}
+
+	return fh, nil
+}
+
+// writeFrame writes a single frame. Frames sent by a client are masked with
+// a fresh key, frames sent by a server never are.
+func writeFrame(w io.Writer, fin bool, opcode byte, mask *[4]byte, payload []byte) error {
+	header := make([]byte, 0, 14)
+
+	b0 := opcode
+	if fin {
+		b0 |= finBit
+	}
+	header = append(header, b0)
+
+	var b1 byte
+	if mask != nil {
+		b1 = maskBit
+	}
+
+	length := len(payload)
+	switch {
+	case length <= 125:
+		header = append(header, b1|byte(length))
+	case length <= 0xFFFF:
+		header = append(header, b1|126)
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header = append(header, b1|127)
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	if mask != nil {
+		header = append(header, mask[:]...)
+
+		masked := make([]byte, length)
+		copy(masked, payload)
+		maskBytes(*mask, 0, masked)
+		payload = masked
+	}
+
+	_, err := w.Write(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(payload)
+	return err
+}
+
+// maskBytes XORs p with the masking key, pos being the offset of p in the
+// frame payload. It returns the position after p. Masking and unmasking are
+// the same operation. Refer to RFC 6455 5.3.
+func maskBytes(key [4]byte, pos int, p []byte) int {
+	for i := range p {
+		p[i] ^= key[(pos+i)&3]
+	}
+
+	return (pos + len(p)) & 3
+}
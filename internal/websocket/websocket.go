@@ -0,0 +1,116 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+)
+
+// Appended to the client's key to compute Sec-WebSocket-Accept. Refer to
+// RFC 6455 1.3.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// The only version of the protocol there is.
+const supportedVersion = "13"
+
+// Upgrade performs the opening handshake and takes over the connection. If
+// the request isn't a valid WebSocket handshake, an error response is
+// written and an error returned. Refer to RFC 6455 4.2.
+func Upgrade(w *response.Writer, req *request.Request) (*Conn, error) {
+	if req.RequestLine.Method != "GET" {
+		return nil, reject(w, response.StatusMethodNotAllowed, headers.NewHeaders(), "websocket handshake must be a GET request")
+	}
+
+	if !headerHasToken(req.Headers, "connection", "upgrade") {
+		return nil, reject(w, response.StatusBadRequest, headers.NewHeaders(), "missing 'upgrade' token in Connection header")
+	}
+
+	if !headerHasToken(req.Headers, "upgrade", "websocket") {
+		return nil, reject(w, response.StatusBadRequest, headers.NewHeaders(), "missing 'websocket' token in Upgrade header")
+	}
+
+	// Tell the client which version we speak so it can retry with it.
+	if req.Headers.Get("sec-websocket-version") != supportedVersion {
+		h := headers.NewHeaders()
+		h.Set("Sec-WebSocket-Version", supportedVersion)
+		return nil, reject(w, response.StatusUpgradeRequired, h, "unsupported websocket version")
+	}
+
+	key := req.Headers.Get("sec-websocket-key")
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != 16 {
+		return nil, reject(w, response.StatusBadRequest, headers.NewHeaders(), "invalid Sec-WebSocket-Key header")
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", acceptKey(key))
+
+	err = w.WriteStatusLine(response.StatusSwitchingProtocols)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write status line to conn: %v", err)
+	}
+
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write headers to conn: %v", err)
+	}
+
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to hijack connection: %v", err)
+	}
+
+	// A client may send its first frames right behind the handshake.
+	var r io.Reader = conn
+	if len(buffered) > 0 {
+		r = io.MultiReader(bytes.NewReader(buffered), conn)
+	}
+
+	return newConn(conn, bufio.NewReader(r)), nil
+}
+
+func acceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// headerHasToken reports whether the comma separated header value contains
+// token, ignoring case.
+func headerHasToken(h headers.Headers, name, token string) bool {
+	for _, value := range strings.Split(h.Get(name), ",") {
+		if strings.EqualFold(strings.TrimSpace(value), token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func reject(w *response.Writer, statusCode string, h headers.Headers, message string) error {
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(message)))
+
+	err := w.WriteStatusLine(statusCode)
+	if err != nil {
+		log.Printf("failed to write status line to conn: %v", err)
+	} else if err = w.WriteHeaders(h); err != nil {
+		log.Printf("failed to write headers to conn: %v", err)
+	} else if _, err = w.WriteBody([]byte(message)); err != nil {
+		log.Printf("failed to write body to conn: %v", err)
+	}
+
+	return errors.New("websocket: " + message)
+}
@@ -0,0 +1,267 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/johndosdos/http-from-tcp/internal/headers"
+	"github.com/johndosdos/http-from-tcp/internal/request"
+	"github.com/johndosdos/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testMask = [4]byte{0x37, 0xfa, 0x21, 0x3d}
+
+func handshakeRequest() *request.Request {
+	return &request.Request{
+		RequestLine: request.RequestLine{
+			Method:        "GET",
+			RequestTarget: "/chat",
+			HttpVersion:   "1.1",
+		},
+		Headers: headers.Headers{
+			"host":                  "localhost:42069",
+			"upgrade":               "websocket",
+			"connection":            "keep-alive, Upgrade",
+			"sec-websocket-key":     "dGhlIHNhbXBsZSBub25jZQ==",
+			"sec-websocket-version": "13",
+		},
+	}
+}
+
+// upgrade runs Upgrade on one end of a pipe and returns the server conn
+// along with the client end, positioned after the handshake response.
+func upgrade(t *testing.T, req *request.Request) (*Conn, *http.Response, net.Conn, *bufio.Reader, error) {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() {
+		serverConn.Close()
+		clientConn.Close()
+	})
+
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	results := make(chan result, 1)
+
+	go func() {
+		w := response.NewWriter(serverConn)
+		conn, err := Upgrade(&w, req)
+		w.Finish()
+		if err != nil {
+			serverConn.Close()
+		}
+		results <- result{conn, err}
+	}()
+
+	br := bufio.NewReader(clientConn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+
+	r := <-results
+	return r.conn, resp, clientConn, br, r.err
+}
+
+func readFrame(t *testing.T, r io.Reader) (frameHeader, []byte) {
+	t.Helper()
+
+	fh, err := readFrameHeader(r)
+	require.NoError(t, err)
+	assert.False(t, fh.masked)
+
+	payload := make([]byte, fh.length)
+	_, err = io.ReadFull(r, payload)
+	require.NoError(t, err)
+
+	return fh, payload
+}
+
+func echo(conn *Conn) <-chan error {
+	errs := make(chan error, 1)
+
+	go func() {
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			err = conn.WriteMessage(messageType, message)
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	return errs
+}
+
+func TestUpgrade(t *testing.T) {
+	// Test: valid handshake
+	conn, resp, _, _, err := upgrade(t, handshakeRequest())
+	require.NoError(t, err)
+	require.NotNil(t, conn)
+	assert.Equal(t, 101, resp.StatusCode)
+	assert.Equal(t, "websocket", resp.Header.Get("Upgrade"))
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+
+	// Test: missing upgrade
+	req := handshakeRequest()
+	delete(req.Headers, "upgrade")
+	_, resp, _, _, err = upgrade(t, req)
+	require.Error(t, err)
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// Test: unsupported version
+	req = handshakeRequest()
+	req.Headers["sec-websocket-version"] = "8"
+	_, resp, _, _, err = upgrade(t, req)
+	require.Error(t, err)
+	assert.Equal(t, 426, resp.StatusCode)
+	assert.Equal(t, "13", resp.Header.Get("Sec-WebSocket-Version"))
+
+	// Test: invalid key
+	req = handshakeRequest()
+	req.Headers["sec-websocket-key"] = "short"
+	_, resp, _, _, err = upgrade(t, req)
+	require.Error(t, err)
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestConn(t *testing.T) {
+	conn, _, client, br, err := upgrade(t, handshakeRequest())
+	require.NoError(t, err)
+	errs := echo(conn)
+
+	// Test: echo text message
+	require.NoError(t, writeFrame(client, true, opText, &testMask, []byte("hello")))
+	fh, payload := readFrame(t, br)
+	assert.Equal(t, byte(opText), fh.opcode)
+	assert.True(t, fh.fin)
+	assert.Equal(t, "hello", string(payload))
+
+	// Test: fragmented message with a ping in between
+	require.NoError(t, writeFrame(client, false, opBinary, &testMask, []byte("frag")))
+	go writeFrame(client, true, opPing, &testMask, []byte("are you there"))
+	fh, payload = readFrame(t, br)
+	assert.Equal(t, byte(opPong), fh.opcode)
+	assert.Equal(t, "are you there", string(payload))
+	require.NoError(t, writeFrame(client, true, opContinuation, &testMask, []byte("mented")))
+	fh, payload = readFrame(t, br)
+	assert.Equal(t, byte(opBinary), fh.opcode)
+	assert.Equal(t, "fragmented", string(payload))
+
+	// Test: large message with extended payload length
+	large := strings.Repeat("x", 70000)
+	go writeFrame(client, true, opText, &testMask, []byte(large))
+	fh, payload = readFrame(t, br)
+	assert.Equal(t, int64(70000), fh.length)
+	assert.Equal(t, large, string(payload))
+
+	// Test: closing handshake started by the client
+	closePayload := binary.BigEndian.AppendUint16(nil, CloseNormalClosure)
+	go writeFrame(client, true, opClose, &testMask, append(closePayload, "bye"...))
+	fh, payload = readFrame(t, br)
+	assert.Equal(t, byte(opClose), fh.opcode)
+	assert.Equal(t, uint16(CloseNormalClosure), binary.BigEndian.Uint16(payload))
+
+	err = <-errs
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CloseNormalClosure, closeErr.Code)
+	assert.Equal(t, "bye", closeErr.Text)
+}
+
+func TestConnProtocolErrors(t *testing.T) {
+	// Test: unmasked client frame
+	conn, _, client, br, err := upgrade(t, handshakeRequest())
+	require.NoError(t, err)
+	errs := echo(conn)
+	go writeFrame(client, true, opText, nil, []byte("hello"))
+	fh, payload := readFrame(t, br)
+	assert.Equal(t, byte(opClose), fh.opcode)
+	assert.Equal(t, uint16(CloseProtocolError), binary.BigEndian.Uint16(payload))
+	var protocolErr *ProtocolError
+	require.ErrorAs(t, <-errs, &protocolErr)
+
+	// Test: message over the size limit
+	conn, _, client, br, err = upgrade(t, handshakeRequest())
+	require.NoError(t, err)
+	conn.MaxMessageSize = 4
+	errs = echo(conn)
+	go writeFrame(client, true, opBinary, &testMask, []byte("too long"))
+	fh, payload = readFrame(t, br)
+	assert.Equal(t, byte(opClose), fh.opcode)
+	assert.Equal(t, uint16(CloseMessageTooBig), binary.BigEndian.Uint16(payload))
+	require.ErrorAs(t, <-errs, &protocolErr)
+
+	// Test: invalid UTF-8 in text message
+	conn, _, client, br, err = upgrade(t, handshakeRequest())
+	require.NoError(t, err)
+	errs = echo(conn)
+	go writeFrame(client, true, opText, &testMask, []byte{0xff, 0xfe})
+	fh, payload = readFrame(t, br)
+	assert.Equal(t, byte(opClose), fh.opcode)
+	assert.Equal(t, uint16(CloseInvalidFramePayloadData), binary.BigEndian.Uint16(payload))
+	require.ErrorAs(t, <-errs, &protocolErr)
+
+	// Test: continuation without a message
+	conn, _, client, br, err = upgrade(t, handshakeRequest())
+	require.NoError(t, err)
+	errs = echo(conn)
+	go writeFrame(client, true, opContinuation, &testMask, []byte("orphan"))
+	fh, payload = readFrame(t, br)
+	assert.Equal(t, byte(opClose), fh.opcode)
+	assert.Equal(t, uint16(CloseProtocolError), binary.BigEndian.Uint16(payload))
+	require.ErrorAs(t, <-errs, &protocolErr)
+}
+
+func TestConnClose(t *testing.T) {
+	conn, _, client, br, err := upgrade(t, handshakeRequest())
+	require.NoError(t, err)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- conn.Close(CloseGoingAway, "shutting down")
+	}()
+
+	// Test: server starts the closing handshake
+	fh, payload := readFrame(t, br)
+	assert.Equal(t, byte(opClose), fh.opcode)
+	assert.Equal(t, uint16(CloseGoingAway), binary.BigEndian.Uint16(payload))
+	assert.Equal(t, "shutting down", string(payload[2:]))
+
+	// Test: server waits for the client's answer before closing the conn
+	require.NoError(t, writeFrame(client, true, opClose, &testMask, payload[:2]))
+	require.NoError(t, <-closed)
+
+	// Test: writes after close fail
+	assert.ErrorIs(t, conn.WriteMessage(TextMessage, []byte("late")), ErrCloseSent)
+
+	// Test: long reasons are cut short without splitting a character
+	conn, _, client, br, err = upgrade(t, handshakeRequest())
+	require.NoError(t, err)
+
+	go func() {
+		closed <- conn.Close(CloseGoingAway, strings.Repeat("é", 100))
+	}()
+
+	_, payload = readFrame(t, br)
+	assert.LessOrEqual(t, len(payload), maxControlPayload)
+	assert.True(t, utf8.Valid(payload[2:]))
+	assert.Equal(t, strings.Repeat("é", 61), string(payload[2:]))
+
+	require.NoError(t, writeFrame(client, true, opClose, &testMask, payload[:2]))
+	require.NoError(t, <-closed)
+}